@@ -19,21 +19,22 @@ func (c *Client) Auth() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	rsp, err := http.DefaultClient.Do(req)
+	rsp, err := c.do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed sending auth request: %w", err)
 	}
 	defer rsp.Body.Close()
-	io.Copy(io.Discard, rsp.Body)
 
 	if rsp.StatusCode == http.StatusOK {
 		// no auth needed
+		io.Copy(io.Discard, rsp.Body)
 		return "", nil
 	}
 
 	if rsp.StatusCode != http.StatusUnauthorized {
-		return "", fmt.Errorf("unexpected status %s", rsp.Status)
+		return "", newRegistryError(rsp)
 	}
+	io.Copy(io.Discard, rsp.Body)
 
 	// The Www-Authenticate header tells us where to go to get a token
 	vals, err := parseWWWAuthenticate(rsp.Header.Get("Www-Authenticate"))
@@ -48,9 +49,14 @@ func (c *Client) Auth() (string, error) {
 	q := u.Query()
 	q.Set("service", vals["service"])
 	q.Set("scope", "repository:"+c.Name+":pull,push")
+	for _, name := range c.MountFrom {
+		q.Add("scope", "repository:"+name+":pull")
+	}
 	u.RawQuery = q.Encode()
 
-	fmt.Printf("get %s\n", u)
+	realm := *u
+	realm.RawQuery = ""
+	c.event(Event{Kind: EventAuth, URL: realm.String()})
 
 	req, err = http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
@@ -59,13 +65,13 @@ func (c *Client) Auth() (string, error) {
 
 	req.SetBasicAuth(c.User, c.Password)
 
-	rsp, err = http.DefaultClient.Do(req)
+	rsp, err = c.do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed sending auth request: %w", err)
 	}
 	defer rsp.Body.Close()
 	if rsp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected status %s", rsp.Status)
+		return "", newRegistryError(rsp)
 	}
 	body, err := io.ReadAll(rsp.Body)
 	if err != nil {
@@ -0,0 +1,52 @@
+package scratchbuild_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestAuthBadPassword(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{User: "user", Password: "pass"})
+	defer r.Close()
+
+	o := r.ClientOptions("test/app")
+	o.Password = "wrong"
+	_, err := scratchbuild.New(&o).Auth()
+	var regErr *scratchbuild.RegistryError
+	if !errors.As(err, &regErr) {
+		t.Fatalf("expected a RegistryError, got %v", err)
+	}
+	if regErr.StatusCode != http.StatusUnauthorized || !regErr.HasCode(scratchbuild.ErrorCodeUnauthorized) {
+		t.Errorf("unexpected error %v", regErr)
+	}
+}
+
+func TestAuthNotNeeded(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	o := r.ClientOptions("test/app")
+	token, err := scratchbuild.New(&o).Auth()
+	if err != nil || token != "" {
+		t.Errorf("expected no token and no error, got %q, %v", token, err)
+	}
+}
+
+func TestPushWithoutToken(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{User: "user", Password: "pass"})
+	defer r.Close()
+
+	o := r.ClientOptions("test/app", "latest")
+	_, err := scratchbuild.New(&o).BuildImage(&appConfig, appLayer(t))
+	var regErr *scratchbuild.RegistryError
+	if !errors.As(err, &regErr) || regErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401 error, got %v", err)
+	}
+	if len(r.Tags("test/app")) != 0 {
+		t.Error("expected nothing to be pushed")
+	}
+}
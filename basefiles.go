@@ -0,0 +1,216 @@
+package scratchbuild
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// BaseUser is a user in the base files layer
+type BaseUser struct {
+	Name string `json:"name"`
+	UID  int    `json:"uid"`
+	// GID is the user's primary group. If no group has this ID, a group with
+	// the user's name is added.
+	GID int `json:"gid"`
+	// Home is the user's home directory, which is created owned by the user.
+	// It defaults to /home/<name>, or /root for root.
+	Home string `json:"home"`
+	// Shell defaults to /sbin/nologin
+	Shell string `json:"shell"`
+}
+
+// BaseGroup is a group in the base files layer
+type BaseGroup struct {
+	Name    string   `json:"name"`
+	GID     int      `json:"gid"`
+	Members []string `json:"members"`
+}
+
+// BaseFiles describes the base files layer built by BaseFilesLayer
+type BaseFiles struct {
+	// Users are written to /etc/passwd. If nil, DefaultBaseUsers are used.
+	// Root is added first if it is not listed, as there is always a root user.
+	Users []BaseUser `json:"users"`
+	// Groups are written to /etc/group, along with a group for each user
+	// whose primary group is not listed.
+	Groups []BaseGroup `json:"groups"`
+}
+
+// DefaultBaseUsers are the users in the base files layer if none are given:
+// root, and nonroot with ID 65532 for programs that shouldn't run as root.
+var DefaultBaseUsers = []BaseUser{
+	{Name: "root", UID: 0, GID: 0, Home: "/root"},
+	{Name: "nonroot", UID: 65532, GID: 65532, Home: "/home/nonroot"},
+}
+
+// nsswitchConf tells the C library and Go's resolver to use local files, then
+// DNS
+const nsswitchConf = `passwd: files
+group: files
+shadow: files
+hosts: files dns
+networks: files
+protocols: files
+services: files
+`
+
+// BaseFilesLayer builds a layer with the files most programs expect an
+// operating system to provide: /etc/passwd and /etc/group listing the users
+// and groups, /etc/nsswitch.conf, a home directory for each user and a /tmp
+// directory anyone can write to. Put it below layers made with TarDirectory or
+// a LayerWriter. The layer is the same each time it is built from the same
+// BaseFiles. A nil BaseFiles gives the default users and their groups.
+func BaseFilesLayer(b *BaseFiles) ([]byte, error) {
+	if b == nil {
+		b = &BaseFiles{}
+	}
+	users := b.Users
+	if users == nil {
+		users = DefaultBaseUsers
+	}
+	users = append([]BaseUser(nil), users...)
+	if !hasRoot(users) {
+		users = append([]BaseUser{DefaultBaseUsers[0]}, users...)
+	}
+	groups, err := baseGroups(users, b.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	var passwd bytes.Buffer
+	names := make(map[string]bool, len(users))
+	for i := range users {
+		u := &users[i]
+		if err := checkBaseName(u.Name, "user"); err != nil {
+			return nil, err
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("user %s is listed more than once", u.Name)
+		}
+		names[u.Name] = true
+		if u.UID < 0 || u.GID < 0 {
+			return nil, fmt.Errorf("user %s: IDs must not be negative", u.Name)
+		}
+		if u.Home == "" {
+			u.Home = "/home/" + u.Name
+			if u.UID == 0 {
+				u.Home = "/root"
+			}
+		}
+		if !path.IsAbs(u.Home) {
+			return nil, fmt.Errorf("user %s: home directory %s must be an absolute path", u.Name, u.Home)
+		}
+		if u.Shell == "" {
+			u.Shell = "/sbin/nologin"
+		}
+		fmt.Fprintf(&passwd, "%s:x:%d:%d:%s:%s:%s\n", u.Name, u.UID, u.GID, u.Name, u.Home, u.Shell)
+	}
+
+	var group bytes.Buffer
+	for _, g := range groups {
+		fmt.Fprintf(&group, "%s:x:%d:%s\n", g.Name, g.GID, strings.Join(g.Members, ","))
+	}
+
+	var buf bytes.Buffer
+	lw := NewLayerWriter(&buf)
+	if err := lw.Mkdir("/etc", 0o755); err != nil {
+		return nil, err
+	}
+	if err := lw.AddBytes("/etc/passwd", passwd.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	if err := lw.AddBytes("/etc/group", group.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	if err := lw.AddBytes("/etc/nsswitch.conf", []byte(nsswitchConf), 0o644); err != nil {
+		return nil, err
+	}
+	if err := lw.Mkdir("/tmp", os.ModeSticky|0o777); err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if path.Clean(u.Home) == "/" {
+			continue
+		}
+		// Parent directories belong to root
+		if err := lw.Mkdir(path.Dir(u.Home), 0o755); err != nil {
+			return nil, err
+		}
+		lw.SetOwner(u.UID, u.GID)
+		if err := lw.Mkdir(u.Home, 0o700); err != nil {
+			return nil, err
+		}
+		lw.SetOwner(0, 0)
+	}
+	if err := lw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func hasRoot(users []BaseUser) bool {
+	for _, u := range users {
+		if u.Name == "root" {
+			return true
+		}
+	}
+	return false
+}
+
+// baseGroups checks the groups and adds a group for each user whose primary
+// group is missing
+func baseGroups(users []BaseUser, groups []BaseGroup) ([]BaseGroup, error) {
+	names := make(map[string]bool, len(groups))
+	gids := make(map[int]bool, len(groups))
+	for _, g := range groups {
+		if err := checkBaseName(g.Name, "group"); err != nil {
+			return nil, err
+		}
+		if names[g.Name] {
+			return nil, fmt.Errorf("group %s is listed more than once", g.Name)
+		}
+		if g.GID < 0 {
+			return nil, fmt.Errorf("group %s: IDs must not be negative", g.Name)
+		}
+		for _, m := range g.Members {
+			if err := checkBaseName(m, "group member"); err != nil {
+				return nil, err
+			}
+		}
+		names[g.Name] = true
+		gids[g.GID] = true
+	}
+
+	groups = append([]BaseGroup(nil), groups...)
+	for _, u := range users {
+		if gids[u.GID] {
+			continue
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("user %s has primary group %d, but group %s has a different ID", u.Name, u.GID, u.Name)
+		}
+		groups = append(groups, BaseGroup{Name: u.Name, GID: u.GID})
+		names[u.Name] = true
+		gids[u.GID] = true
+	}
+	return groups, nil
+}
+
+// checkBaseName checks a user or group name can be written to /etc/passwd or
+// /etc/group. Names that are numbers would be taken as IDs.
+func checkBaseName(name, what string) error {
+	if name == "" {
+		return fmt.Errorf("%s names must not be empty", what)
+	}
+	if strings.ContainsAny(name, ":,\n \t") {
+		return fmt.Errorf("%s name %q must not contain colons, commas or whitespace", what, name)
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return fmt.Errorf("%s name %q must not be a number", what, name)
+	}
+	return nil
+}
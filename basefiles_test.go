@@ -0,0 +1,63 @@
+package scratchbuild_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+func TestBaseFilesLayerAlwaysHasRoot(t *testing.T) {
+	tests := []struct {
+		name   string
+		users  []scratchbuild.BaseUser
+		passwd string
+	}{
+		{
+			name:   "no users",
+			users:  []scratchbuild.BaseUser{},
+			passwd: "root:x:0:0:root:/root:/sbin/nologin\n",
+		},
+		{
+			name:   "root not listed",
+			users:  []scratchbuild.BaseUser{{Name: "app", UID: 1000, GID: 1000}},
+			passwd: "root:x:0:0:root:/root:/sbin/nologin\napp:x:1000:1000:app:/home/app:/sbin/nologin\n",
+		},
+		{
+			name:   "root listed",
+			users:  []scratchbuild.BaseUser{{Name: "app", UID: 1000, GID: 1000}, {Name: "root", Shell: "/bin/false"}},
+			passwd: "app:x:1000:1000:app:/home/app:/sbin/nologin\nroot:x:0:0:root:/root:/bin/false\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layer, err := scratchbuild.BaseFilesLayer(&scratchbuild.BaseFiles{Users: test.users})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(bytes.NewReader(layer))
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					t.Fatal("no etc/passwd in the layer")
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if h.Name != "etc/passwd" {
+					continue
+				}
+				passwd, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(passwd) != test.passwd {
+					t.Errorf("expected %q, got %q", test.passwd, passwd)
+				}
+				return
+			}
+		})
+	}
+}
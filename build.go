@@ -1,95 +1,350 @@
 package scratchbuild
 
 import (
-	"bytes"
 	"fmt"
+	"sync"
 	"time"
 
 	// We need to import this to register the hash function for the digest
 	_ "crypto/sha256"
 	"encoding/json"
 
-	"github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 )
 
-// BuildImage builds a simple container image from a single layer and uploads it
-// to a repository
-func (c *Client) BuildImage(imageConfig *ImageConfig, layer []byte) error {
-	dig := digest.FromBytes(layer)
+// BuildResult describes an image built and pushed by BuildImage
+type BuildResult struct {
+	// ManifestDigest is the digest of the image manifest
+	ManifestDigest digest.Digest `json:"manifestDigest"`
+	// ManifestSize is the size of the image manifest
+	ManifestSize int64 `json:"manifestSize"`
+	// MediaType is the media type of the manifest
+	MediaType string `json:"mediaType"`
+	// Platform is the platform the image is for. It is not set for an index.
+	Platform *Platform `json:"platform,omitempty"`
+	// ConfigDigest is the digest of the image configuration blob. It is empty
+	// for an index.
+	ConfigDigest digest.Digest `json:"configDigest,omitempty"`
+	// Layers describes each layer of the image, bottom-most first
+	Layers []LayerResult `json:"layers,omitempty"`
+	// Tags lists each tag pushed and the reference it resolves to
+	Tags []TagResult `json:"tags"`
+	// Changed is true if any tag was pushed, and false if every tag already
+	// pointed to this image
+	Changed bool `json:"changed"`
+	// Skipped lists the blobs that were not uploaded because the repository
+	// already had them
+	Skipped []digest.Digest `json:"skipped,omitempty"`
+	// Destinations reports the push to each of Options.Destinations, in the
+	// same order. Changed is true if any destination changed.
+	Destinations []DestinationResult `json:"destinations,omitempty"`
+}
+
+// DestinationResult describes the push of a built image to one of
+// Options.Destinations
+type DestinationResult struct {
+	// Repository is the fully-qualified repository name
+	Repository string `json:"repository"`
+	// Tags lists each tag pushed and the reference it resolves to
+	Tags []TagResult `json:"tags"`
+	// Changed is true if any tag was pushed
+	Changed bool `json:"changed"`
+	// Skipped lists the blobs the repository already had
+	Skipped []digest.Digest `json:"skipped,omitempty"`
+	// Err is set if the push failed, and Error is its message
+	Err   error  `json:"-"`
+	Error string `json:"error,omitempty"`
+}
+
+// LayerResult describes a layer of a built image
+type LayerResult struct {
+	// Digest is the digest of the compressed layer, as referenced by the manifest
+	Digest digest.Digest `json:"digest"`
+	// Size is the size of the compressed layer
+	Size int64 `json:"size"`
+	// DiffID is the digest of the uncompressed layer, as referenced by the
+	// image configuration
+	DiffID digest.Digest `json:"diffID"`
+	// UncompressedSize is the size of the uncompressed layer
+	UncompressedSize int64 `json:"uncompressedSize"`
+}
+
+// TagResult describes a tag pushed by BuildImage
+type TagResult struct {
+	// Tag is the tag (or digest) the manifest was pushed to
+	Tag string `json:"tag"`
+	// Reference is the fully-qualified reference of the image by digest, e.g.
+	// eu.gcr.io/proj/app@sha256:...
+	Reference string `json:"reference"`
+	// Changed is false if the tag already pointed to the image, in which case
+	// the manifest was not pushed again
+	Changed bool `json:"changed"`
+}
 
-	b := &bytes.Buffer{}
-	gw := pgzip.NewWriter(b)
-	if _, err := gw.Write(layer); err != nil {
-		return fmt.Errorf("failed to compress image layer: %w", err)
+// BuildImage builds a simple container image from uncompressed tar layers,
+// bottom-most first, and uploads it to a repository. The image configuration
+// is checked first with Validate. Unless Options.NoLayerChecks is set,
+// BuildImage then checks the layers contain the program to run, as an
+// executable file, the working directory, and any user and group names in
+// /etc/passwd and /etc/group. A dynamically linked program is an error unless
+// its loader and libraries are in the layers too.
+//
+// If Options.Platform has no architecture it is read from the ELF header of the
+// program, defaulting to amd64. With NoLayerChecks, layers that can't be read
+// just mean the default is used.
+//
+// If Options.Destinations is set the image is pushed to the client's repository
+// and every destination concurrently. The image is built just once. If any push
+// fails BuildImage returns a *PushError along with the result, which shows
+// which pushes succeeded.
+func (c *Client) BuildImage(imageConfig *ImageConfig, layers ...[]byte) (*BuildResult, error) {
+	if err := imageConfig.Validate(); err != nil {
+		return nil, err
 	}
-	if err := gw.Close(); err != nil {
-		return fmt.Errorf("failed to compress image layer: %w", err)
+	// The layers are only read if we check them or need the architecture
+	var (
+		ix   *layerIndex
+		prog *imageProgram
+	)
+	if !c.NoLayerChecks || c.Platform.Architecture == "" {
+		var err error
+		if ix, err = indexLayers(layers); err != nil && !c.NoLayerChecks {
+			return nil, err
+		}
+		if ix != nil {
+			prog = ix.program(imageConfig)
+		}
 	}
 
-	compressedLayer := b.Bytes()
-	compressedDig := digest.FromBytes(compressedLayer)
+	platform := c.Platform
+	if platform.Architecture == "" {
+		platform.Architecture = "amd64"
+		if prog != nil && prog.binary != nil && prog.binary.architecture != "" {
+			platform.Architecture = prog.binary.architecture
+			if platform.Variant == "" {
+				platform.Variant = prog.binary.variant
+			}
+		}
+	}
+	if platform.OS == "" {
+		platform.OS = "linux"
+	}
 
-	if err := c.sendBlob(compressedDig, compressedLayer); err != nil {
-		return fmt.Errorf("failed to send image layer: %w", err)
+	if !c.NoLayerChecks {
+		if err := ix.check(imageConfig, platform, prog); err != nil {
+			return nil, err
+		}
 	}
 
-	now := time.Now().UTC()
+	result := &BuildResult{}
+	var (
+		blobs   []blob
+		diffIDs []digest.Digest
+		// Then a manifest to say what layers we have
+		manifest = Manifest{
+			Versioned: SchemaVersion,
+			Layers:    []Descriptor{},
+		}
+	)
+	for i, layer := range layers {
+		dig := digest.FromBytes(layer)
+
+		compressedLayer, err := c.LayerCache.compress(dig, layer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress image layer %d: %w", i, err)
+		}
+		compressedDig := digest.FromBytes(compressedLayer)
+
+		result.Layers = append(result.Layers, LayerResult{
+			Digest:           compressedDig,
+			Size:             int64(len(compressedLayer)),
+			DiffID:           dig,
+			UncompressedSize: int64(len(layer)),
+		})
+		manifest.Layers = append(manifest.Layers, Descriptor{
+			MediaType: MediaTypeLayer,
+			Digest:    compressedDig,
+			Size:      int64(len(compressedLayer)),
+		})
+		// These must be the digest over the uncompressed content
+		diffIDs = append(diffIDs, dig)
+		what := "image layer"
+		if len(layers) > 1 {
+			what = fmt.Sprintf("image layer %d", i)
+		}
+		blobs = append(blobs, blob{digest: compressedDig, data: compressedLayer, what: what})
+	}
+
+	created := c.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	created = created.UTC()
 	image := Image{
-		Created:      &now,
-		Architecture: "amd64",
-		OS:           "linux",
+		Created:      &created,
+		Author:       c.Author,
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		OSVersion:    platform.OSVersion,
+		OSFeatures:   platform.OSFeatures,
+		Variant:      platform.Variant,
 		Config:       *imageConfig,
 		RootFS: RootFS{
-			Type: "layers",
-			// These must be the digest over the uncompressed content
-			DiffIDs: []digest.Digest{
-				dig,
-			},
+			Type:    "layers",
+			DiffIDs: diffIDs,
 		},
 	}
 
 	imageData, err := json.Marshal(&image)
 	if err != nil {
-		return fmt.Errorf("could not marshal image config: %w", err)
+		return nil, fmt.Errorf("could not marshal image config: %w", err)
 	}
 
 	imageDigest := digest.FromBytes(imageData)
+	result.ConfigDigest = imageDigest
+	blobs = append(blobs, blob{digest: imageDigest, data: imageData, what: "image description"})
 
-	// Perhaps we send the image config as a blob?
-	if err := c.sendBlob(imageDigest, imageData); err != nil {
-		return fmt.Errorf("could not send image description: %w", err)
-	}
-
-	// Then a manifest to say what layers we have
-	manifest := Manifest{
-		Versioned: SchemaVersion,
-		Layers: []Descriptor{
-			{
-				MediaType: MediaTypeLayer,
-				Digest:    compressedDig,
-				Size:      int64(len(compressedLayer)),
-			},
-		},
-		Config: Descriptor{
-			MediaType: MediaTypeImageConfig,
-			Digest:    imageDigest,
-			Size:      int64(len(imageData)),
-		},
+	manifest.Config = Descriptor{
+		MediaType: MediaTypeImageConfig,
+		Digest:    imageDigest,
+		Size:      int64(len(imageData)),
 	}
 
 	manifestData, err := json.Marshal(&manifest)
 	if err != nil {
-		return fmt.Errorf("could not marshal manifest: %w", err)
+		return nil, fmt.Errorf("could not marshal manifest: %w", err)
+	}
+
+	result.ManifestDigest = digest.FromBytes(manifestData)
+	result.ManifestSize = int64(len(manifestData))
+
+	result.MediaType = MediaTypeManifest
+	result.Platform = &platform
+
+	return c.push(result, blobs, MediaTypeManifest, manifestData)
+}
+
+// Descriptor returns a descriptor for the manifest that was pushed, for use in
+// an index
+func (r *BuildResult) Descriptor() Descriptor {
+	return Descriptor{
+		MediaType: r.MediaType,
+		Digest:    r.ManifestDigest,
+		Size:      r.ManifestSize,
+		Platform:  r.Platform,
+	}
+}
+
+// push sends blobs and a manifest to the client's repository and to each of
+// the destinations, filling in the push details in result
+func (c *Client) push(result *BuildResult, blobs []blob, mediaType string, manifestData []byte) (*BuildResult, error) {
+	manifestDigest := result.ManifestDigest
+	if len(c.Destinations) == 0 {
+		pushed, err := c.pushImage(blobs, manifestDigest, manifestData, mediaType)
+		if err != nil {
+			return nil, err
+		}
+		result.Tags, result.Changed, result.Skipped = pushed.Tags, pushed.Changed, pushed.Skipped
+		return result, nil
+	}
+
+	// Push to our own repository and every destination at once. The blobs are
+	// only read, so they can be shared.
+	clients := make([]*Client, 0, len(c.Destinations)+1)
+	clients = append(clients, c)
+	for i := range c.Destinations {
+		clients = append(clients, c.destination(&c.Destinations[i]))
+	}
+	pushes := make([]DestinationResult, len(clients))
+	var wg sync.WaitGroup
+	for i, dc := range clients {
+		wg.Add(1)
+		go func(dc *Client, pushed *DestinationResult) {
+			defer wg.Done()
+			pushed.Repository = dc.repository()
+			if dc != c {
+				if err := dc.authDestination(); err != nil {
+					pushed.Err = err
+					return
+				}
+			}
+			p, err := dc.pushImage(blobs, manifestDigest, manifestData, mediaType)
+			if err != nil {
+				pushed.Err = err
+				return
+			}
+			pushed.Tags, pushed.Changed, pushed.Skipped = p.Tags, p.Changed, p.Skipped
+		}(dc, &pushes[i])
 	}
+	wg.Wait()
 
-	manifestDigest := digest.FromBytes(manifestData)
+	var pushErr PushError
+	for i := range pushes {
+		if pushes[i].Err != nil {
+			pushes[i].Error = pushes[i].Err.Error()
+			pushErr.Errors = append(pushErr.Errors, &DestinationError{Repository: pushes[i].Repository, Err: pushes[i].Err})
+		}
+	}
+	result.Tags, result.Changed, result.Skipped = pushes[0].Tags, pushes[0].Changed, pushes[0].Skipped
+	result.Destinations = pushes[1:]
+	for _, pushed := range result.Destinations {
+		result.Changed = result.Changed || pushed.Changed
+	}
+	if len(pushErr.Errors) > 0 {
+		return result, &pushErr
+	}
+	return result, nil
+}
+
+// blob is a blob of a built image, ready to send
+type blob struct {
+	digest digest.Digest
+	data   []byte
+	// what describes the blob for error messages
+	what string
+}
+
+// pushImage sends the blobs of an image to the client's repository, then the
+// manifest to each of its tags
+func (c *Client) pushImage(blobs []blob, manifestDigest digest.Digest, manifestData []byte, mediaType string) (*DestinationResult, error) {
+	tags := c.Tags
+	if len(tags) == 0 {
+		// With no tags we push by digest, so the image is at least reachable
+		tags = []string{manifestDigest.String()}
+	}
+	for _, tag := range tags {
+		if isDigest(tag) && tag != manifestDigest.String() {
+			return nil, fmt.Errorf("cannot push by digest %s: the image has digest %s", tag, manifestDigest)
+		}
+	}
+	if err := c.checkTags(tags, manifestDigest); err != nil {
+		return nil, err
+	}
+
+	// Now we know the push makes sense we can send the blobs
+	result := &DestinationResult{Repository: c.repository()}
+	for _, b := range blobs {
+		skipped, err := c.sendBlob(b.digest, b.data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send %s: %w", b.what, err)
+		}
+		if skipped {
+			result.Skipped = append(result.Skipped, b.digest)
+		}
+	}
 
-	for _, tag := range c.Tags {
-		if err := c.sendManifest(manifestDigest, manifestData, MediaTypeManifest, tag); err != nil {
-			return fmt.Errorf("could not send manifest for tag %s: %w", tag, err)
+	for _, tag := range tags {
+		changed, err := c.pushManifest(manifestDigest, manifestData, mediaType, tag)
+		if err != nil {
+			return nil, fmt.Errorf("could not send manifest for tag %s: %w", tag, err)
 		}
+		result.Changed = result.Changed || changed
+		result.Tags = append(result.Tags, TagResult{
+			Tag:       tag,
+			Reference: c.repository() + "@" + manifestDigest.String(),
+			Changed:   changed,
+		})
 	}
 
-	return nil
+	return result, nil
 }
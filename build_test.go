@@ -0,0 +1,155 @@
+package scratchbuild_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+// tagChanges summarises the tags in a result as tag: changed
+func tagChanges(tags []scratchbuild.TagResult) map[string]bool {
+	m := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		m[tag.Tag] = tag.Changed
+	}
+	return m
+}
+
+func TestSkipUnchangedManifest(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	first := pushApp(t, r, "test/app", "v1")
+	if !first.Changed || !tagChanges(first.Tags)["v1"] {
+		t.Errorf("expected the first push to change v1, got %+v", first.Tags)
+	}
+
+	// Pushing the same image again changes nothing
+	puts := countRequests(r, "PUT /v2/test/app/manifests/")
+	again := pushApp(t, r, "test/app", "v1", "v2")
+	if n := countRequests(r, "PUT /v2/test/app/manifests/") - puts; n != 1 {
+		t.Errorf("expected only v2 to be pushed, got %d manifest pushes", n)
+	}
+	if again.ManifestDigest != first.ManifestDigest {
+		t.Fatalf("expected the same image, got %s and %s", first.ManifestDigest, again.ManifestDigest)
+	}
+	if changes := tagChanges(again.Tags); changes["v1"] || !changes["v2"] || !again.Changed {
+		t.Errorf("expected only v2 to change, got %v", changes)
+	}
+	if again.Tags[0].Reference != r.URL[len("http://"):]+"/test/app@"+first.ManifestDigest.String() {
+		t.Errorf("unexpected reference %s", again.Tags[0].Reference)
+	}
+
+	unchanged := pushApp(t, r, "test/app", "v1", "v2")
+	if unchanged.Changed || len(unchanged.Skipped) != 2 {
+		t.Errorf("expected nothing to change, got %+v", unchanged)
+	}
+
+	// A different image moves the tag
+	c := newClient(t, r, "test/app", "v1")
+	c.Author = "someone else"
+	changed, err := c.BuildImage(&appConfig, appLayer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed.Changed || !tagChanges(changed.Tags)["v1"] {
+		t.Errorf("expected v1 to change, got %+v", changed.Tags)
+	}
+	if data, _, _ := r.Manifest("test/app", "v1"); digest.FromBytes(data) != changed.ManifestDigest {
+		t.Error("v1 does not point to the new image")
+	}
+}
+
+func TestNoOverwrite(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	first := pushApp(t, r, "test/app", "v1")
+
+	c := newClient(t, r, "test/app", "v2", "v1")
+	c.NoOverwrite = true
+
+	// Pushing the same image again is fine
+	if _, err := c.BuildImage(&appConfig, appLayer(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A different image is refused before anything is pushed, even to the
+	// tag that is free
+	c.Tags = []string{"v3", "v1"}
+	c.Author = "someone else"
+	uploads := countRequests(r, "POST ")
+	_, err := c.BuildImage(&appConfig, appLayer(t))
+	var exists *scratchbuild.TagExistsError
+	if !errors.As(err, &exists) {
+		t.Fatalf("expected a TagExistsError, got %v", err)
+	}
+	if exists.Tag != "v1" || exists.Existing != first.ManifestDigest || exists.Repository != r.URL[len("http://"):]+"/test/app" {
+		t.Errorf("unexpected error %+v", exists)
+	}
+	if n := countRequests(r, "POST ") - uploads; n != 0 {
+		t.Errorf("expected no uploads, got %d", n)
+	}
+	if tags, want := r.Tags("test/app"), []string{"v1", "v2"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("expected tags %v, got %v", want, tags)
+	}
+
+	// Pushing by digest is always allowed
+	c.Tags = nil
+	if _, err := c.BuildImage(&appConfig, appLayer(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNoLayerChecksPushesAnyLayer(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	// The layer isn't a tar file, so it can't be checked or searched for the
+	// program's architecture
+	layer := []byte("not a tar file")
+	c := newClient(t, r, "test/app", "latest")
+	if _, err := c.BuildImage(&appConfig, layer); err == nil || !strings.Contains(err.Error(), "could not read layer 0") {
+		t.Fatalf("expected the layer checks to fail, got %v", err)
+	}
+
+	c.NoLayerChecks = true
+	result, err := c.BuildImage(&appConfig, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Platform.Architecture != "amd64" {
+		t.Errorf("expected the default architecture, got %+v", result.Platform)
+	}
+
+	// A program that isn't a valid ELF file also leaves the default
+	bad := testLayerWith(t, "app", 0o755, []byte("\x7fELF not really"))
+	if result, err = c.BuildImage(&appConfig, bad); err != nil {
+		t.Fatal(err)
+	}
+	if result.Platform.Architecture != "amd64" {
+		t.Errorf("expected the default architecture, got %+v", result.Platform)
+	}
+}
+
+// testLayerWith is a layer holding a single file
+func testLayerWith(t *testing.T, name string, mode int64, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: mode, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,247 @@
+package scratchbuild
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DefaultProtectedTags are tag patterns that a RetentionPolicy never deletes
+// unless told otherwise: latest, and semantic version releases such as v1.4.2.
+// They are used when RetentionPolicy.Protect is nil.
+var DefaultProtectedTags = []*regexp.Regexp{
+	regexp.MustCompile(`^latest$`),
+	regexp.MustCompile(`^v?\d+\.\d+\.\d+$`),
+}
+
+// RetentionPolicy decides which tags in a repository to keep. A tag is deleted
+// only if it matches Match, is not protected, is not one of the KeepLast newest
+// matching tags, and is older than OlderThan. At least one of KeepLast and
+// OlderThan must be set.
+type RetentionPolicy struct {
+	// Match limits the policy to tags matching this pattern. Other tags are
+	// kept. If nil the policy applies to every tag.
+	Match *regexp.Regexp
+	// KeepLast keeps this many of the most recently created matching tags.
+	KeepLast int
+	// OlderThan keeps matching tags created more recently than this.
+	OlderThan time.Duration
+	// Protect lists patterns for tags that are never deleted. If nil,
+	// DefaultProtectedTags is used. Set it to an empty, non-nil slice to
+	// protect nothing.
+	Protect []*regexp.Regexp
+}
+
+// TagInfo describes a tag in a CleanupPlan
+type TagInfo struct {
+	// Tag is the tag
+	Tag string `json:"tag"`
+	// Digest is the digest of the manifest the tag points to
+	Digest digest.Digest `json:"digest"`
+	// Created is when the image was created, according to its configuration.
+	// It is zero if the configuration does not say.
+	Created time.Time `json:"created,omitempty"`
+	// Reason explains why the tag is kept or deleted
+	Reason string `json:"reason"`
+}
+
+// CleanupPlan lists the tags a RetentionPolicy keeps and deletes
+type CleanupPlan struct {
+	Keep   []TagInfo `json:"keep"`
+	Delete []TagInfo `json:"delete"`
+}
+
+// PlanCleanup applies a retention policy to the tags in the repository and
+// works out which to delete. It does not delete anything: pass the plan to
+// ExecuteCleanup for that. now is the time ages are measured from.
+//
+// Deleting a tag deletes the manifest it points to, and with it every other tag
+// on that manifest. So a tag is never planned for deletion if it shares a
+// manifest with a tag that is kept, or if an index that is kept refers to it.
+func (c *Client) PlanCleanup(policy *RetentionPolicy, now time.Time) (*CleanupPlan, error) {
+	if policy.KeepLast <= 0 && policy.OlderThan <= 0 {
+		return nil, errors.New("retention policy must set KeepLast or OlderThan")
+	}
+
+	protect := policy.Protect
+	if protect == nil {
+		protect = DefaultProtectedTags
+	}
+
+	tags, err := c.ListTags(0)
+	if err != nil {
+		return nil, fmt.Errorf("could not list tags: %w", err)
+	}
+
+	var (
+		plan       CleanupPlan
+		candidates []TagInfo
+		created    = make(map[digest.Digest]time.Time)
+		children   = make(map[digest.Digest][]digest.Digest)
+	)
+	for _, tag := range tags {
+		data, desc, err := c.GetManifest(tag)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch manifest for tag %s: %w", tag, err)
+		}
+		info := TagInfo{Tag: tag, Digest: desc.Digest}
+		if isIndex(desc.MediaType) {
+			var index Index
+			if err := json.Unmarshal(data, &index); err != nil {
+				return nil, fmt.Errorf("could not unmarshal index for tag %s: %w", tag, err)
+			}
+			for _, m := range index.Manifests {
+				children[desc.Digest] = append(children[desc.Digest], m.Digest)
+			}
+		}
+
+		if isProtected(protect, tag) {
+			info.Reason = "protected"
+			plan.Keep = append(plan.Keep, info)
+			continue
+		}
+		if policy.Match != nil && !policy.Match.MatchString(tag) {
+			info.Reason = "does not match"
+			plan.Keep = append(plan.Keep, info)
+			continue
+		}
+
+		t, ok := created[desc.Digest]
+		if !ok {
+			t, err = c.imageCreated(data, desc)
+			if err != nil {
+				return nil, fmt.Errorf("could not find creation time for tag %s: %w", tag, err)
+			}
+			created[desc.Digest] = t
+		}
+		info.Created = t
+		if t.IsZero() {
+			info.Reason = "creation time unknown"
+			plan.Keep = append(plan.Keep, info)
+			continue
+		}
+		candidates = append(candidates, info)
+	}
+
+	// Newest first
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Created.After(candidates[j].Created)
+	})
+
+	for i, info := range candidates {
+		switch {
+		case i < policy.KeepLast:
+			info.Reason = fmt.Sprintf("one of the newest %d", policy.KeepLast)
+			plan.Keep = append(plan.Keep, info)
+		case policy.OlderThan > 0 && now.Sub(info.Created) < policy.OlderThan:
+			info.Reason = fmt.Sprintf("newer than %s", policy.OlderThan)
+			plan.Keep = append(plan.Keep, info)
+		default:
+			var reasons []string
+			if policy.KeepLast > 0 {
+				reasons = append(reasons, fmt.Sprintf("not one of the newest %d", policy.KeepLast))
+			}
+			if policy.OlderThan > 0 {
+				reasons = append(reasons, fmt.Sprintf("older than %s", policy.OlderThan))
+			}
+			info.Reason = strings.Join(reasons, ", ")
+			plan.Delete = append(plan.Delete, info)
+		}
+	}
+
+	// Don't delete manifests that kept tags still point to, either directly or
+	// from an index
+	kept := make(map[digest.Digest]string, len(plan.Keep))
+	for _, info := range plan.Keep {
+		kept[info.Digest] = "shares manifest with kept tag " + info.Tag
+		for _, child := range children[info.Digest] {
+			kept[child] = "in index of kept tag " + info.Tag
+		}
+	}
+	deletes := plan.Delete[:0]
+	for _, info := range plan.Delete {
+		if reason, ok := kept[info.Digest]; ok {
+			info.Reason = reason
+			plan.Keep = append(plan.Keep, info)
+			continue
+		}
+		deletes = append(deletes, info)
+	}
+	plan.Delete = deletes
+
+	return &plan, nil
+}
+
+// ExecuteCleanup deletes the manifests of the tags a CleanupPlan says to
+// delete. It carries on past failures and reports them all at the end, except
+// that it stops at once if the registry does not support deletion.
+func (c *Client) ExecuteCleanup(plan *CleanupPlan) error {
+	var failures []string
+	done := make(map[digest.Digest]bool, len(plan.Delete))
+	for _, info := range plan.Delete {
+		if done[info.Digest] {
+			continue
+		}
+		done[info.Digest] = true
+		if err := c.DeleteManifest(info.Digest); err != nil {
+			if errors.Is(err, ErrUnsupported) {
+				return err
+			}
+			failures = append(failures, fmt.Sprintf("%s (%s): %s", info.Tag, info.Digest, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to delete %d manifests: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func isProtected(protect []*regexp.Regexp, tag string) bool {
+	for _, re := range protect {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageCreated finds the creation time of an image from its configuration. For
+// an index we use the first image in it.
+func (c *Client) imageCreated(data []byte, desc Descriptor) (time.Time, error) {
+	if isIndex(desc.MediaType) {
+		var index Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return time.Time{}, fmt.Errorf("could not unmarshal index: %w", err)
+		}
+		if len(index.Manifests) == 0 {
+			return time.Time{}, nil
+		}
+		childData, childDesc, err := c.GetManifest(index.Manifests[0].Digest.String())
+		if err != nil {
+			return time.Time{}, err
+		}
+		return c.imageCreated(childData, childDesc)
+	}
+
+	if !isImageManifest(desc.MediaType) {
+		return time.Time{}, nil
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return time.Time{}, fmt.Errorf("could not unmarshal manifest: %w", err)
+	}
+	image, err := c.GetImage(&manifest)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if image.Created == nil {
+		return time.Time{}, nil
+	}
+	return *image.Created, nil
+}
@@ -0,0 +1,209 @@
+package scratchbuild_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+// pushBuilds pushes an image created on each of the days given to a tag
+// "build-<day>", and returns their results by tag. Day 1 is 2020-01-01.
+func pushBuilds(t *testing.T, r *scratchbuildtest.Registry, days ...int) map[string]*scratchbuild.BuildResult {
+	t.Helper()
+	results := make(map[string]*scratchbuild.BuildResult)
+	layer := appLayer(t)
+	for _, day := range days {
+		tag := "build-" + strconv.Itoa(day)
+		o := r.ClientOptions("test/app", tag)
+		o.Created = time.Date(2020, 1, day, 0, 0, 0, 0, time.UTC)
+		result, err := scratchbuild.New(&o).BuildImage(&appConfig, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[tag] = result
+	}
+	return results
+}
+
+// tagReasons summarises plan entries as tag: reason
+func tagReasons(infos []scratchbuild.TagInfo) map[string]string {
+	m := make(map[string]string, len(infos))
+	for _, info := range infos {
+		m[info.Tag] = info.Reason
+	}
+	return m
+}
+
+func TestPlanCleanup(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	results := pushBuilds(t, r, 1, 2, 3, 4)
+
+	// latest and a release share manifests with builds
+	for tag, build := range map[string]string{"latest": "build-4", "v1.0.0": "build-1"} {
+		data, mediaType, _ := r.Manifest("test/app", build)
+		r.PutManifest("test/app", mediaType, data, tag)
+	}
+
+	c := newClient(t, r, "test/app")
+	plan, err := c.PlanCleanup(&scratchbuild.RetentionPolicy{
+		Match:    regexp.MustCompile(`^build-`),
+		KeepLast: 1,
+		Protect:  scratchbuild.DefaultProtectedTags,
+	}, time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]string{
+		"build-1": "shares manifest with kept tag v1.0.0",
+		"build-4": "one of the newest 1",
+		"latest":  "protected",
+		"v1.0.0":  "protected",
+	}; !reflect.DeepEqual(tagReasons(plan.Keep), want) {
+		t.Errorf("unexpected tags kept: %v", tagReasons(plan.Keep))
+	}
+	if want := map[string]string{
+		"build-2": "not one of the newest 1",
+		"build-3": "not one of the newest 1",
+	}; !reflect.DeepEqual(tagReasons(plan.Delete), want) {
+		t.Errorf("unexpected tags deleted: %v", tagReasons(plan.Delete))
+	}
+	for _, info := range plan.Delete {
+		if info.Digest != results[info.Tag].ManifestDigest {
+			t.Errorf("%s has the wrong digest", info.Tag)
+		}
+	}
+
+	if err := c.ExecuteCleanup(plan); err != nil {
+		t.Fatal(err)
+	}
+	if tags, want := r.Tags("test/app"), []string{"build-1", "build-4", "latest", "v1.0.0"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("expected %v left, got %v", want, tags)
+	}
+}
+
+func TestPlanCleanupOlderThan(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	pushBuilds(t, r, 1, 2, 3)
+
+	plan, err := newClient(t, r, "test/app").PlanCleanup(&scratchbuild.RetentionPolicy{
+		OlderThan: 36 * time.Hour,
+	}, time.Date(2020, 1, 4, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"build-3": "newer than 36h0m0s"}; !reflect.DeepEqual(tagReasons(plan.Keep), want) {
+		t.Errorf("unexpected tags kept: %v", tagReasons(plan.Keep))
+	}
+	if want := map[string]string{"build-1": "older than 36h0m0s", "build-2": "older than 36h0m0s"}; !reflect.DeepEqual(tagReasons(plan.Delete), want) {
+		t.Errorf("unexpected tags deleted: %v", tagReasons(plan.Delete))
+	}
+	for _, info := range plan.Delete {
+		if info.Created.IsZero() {
+			t.Errorf("%s has no creation time", info.Tag)
+		}
+	}
+}
+
+func TestPlanCleanupDefaultProtect(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	pushBuilds(t, r, 1, 2)
+	data, mediaType, _ := r.Manifest("test/app", "build-1")
+	r.PutManifest("test/app", mediaType, data, "latest")
+
+	c := newClient(t, r, "test/app")
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	// A policy that doesn't say what to protect protects the defaults
+	plan, err := c.PlanCleanup(&scratchbuild.RetentionPolicy{OlderThan: time.Hour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"build-2": "older than 1h0m0s"}; !reflect.DeepEqual(tagReasons(plan.Delete), want) {
+		t.Errorf("unexpected tags deleted: %v", tagReasons(plan.Delete))
+	}
+	if reason := tagReasons(plan.Keep)["latest"]; reason != "protected" {
+		t.Errorf("unexpected reason %q for latest", reason)
+	}
+
+	// An empty list protects nothing
+	plan, err = c.PlanCleanup(&scratchbuild.RetentionPolicy{OlderThan: time.Hour, Protect: []*regexp.Regexp{}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Keep) != 0 || len(plan.Delete) != 3 {
+		t.Errorf("expected every tag to be deleted, kept %v", tagReasons(plan.Keep))
+	}
+}
+
+func TestPlanCleanupKeepsIndexContent(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	results := pushBuilds(t, r, 1, 2)
+
+	// An index that isn't cleaned up refers to build-1
+	index, err := json.Marshal(scratchbuild.Index{
+		Versioned: scratchbuild.Versioned{SchemaVersion: 2, MediaType: scratchbuild.MediaTypeOCIIndex},
+		Manifests: []scratchbuild.Descriptor{{
+			MediaType: results["build-1"].MediaType,
+			Digest:    results["build-1"].ManifestDigest,
+			Size:      results["build-1"].ManifestSize,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.PutManifest("test/app", scratchbuild.MediaTypeOCIIndex, index, "multi")
+
+	plan, err := newClient(t, r, "test/app").PlanCleanup(&scratchbuild.RetentionPolicy{
+		Match:    regexp.MustCompile(`^build-`),
+		KeepLast: 1,
+	}, time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Delete) != 0 {
+		t.Errorf("expected nothing to be deleted, got %v", tagReasons(plan.Delete))
+	}
+	if reason := tagReasons(plan.Keep)["build-1"]; reason != "in index of kept tag multi" {
+		t.Errorf("unexpected reason %q for build-1", reason)
+	}
+}
+
+func TestPlanCleanupNeedsPolicy(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	if _, err := newClient(t, r, "test/app").PlanCleanup(&scratchbuild.RetentionPolicy{}, time.Now()); err == nil {
+		t.Error("expected an error for a policy that keeps everything")
+	}
+}
+
+func TestExecuteCleanupUnsupported(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{DisableDelete: true})
+	defer r.Close()
+	results := pushBuilds(t, r, 1, 2)
+
+	var plan scratchbuild.CleanupPlan
+	for tag, result := range results {
+		plan.Delete = append(plan.Delete, scratchbuild.TagInfo{Tag: tag, Digest: result.ManifestDigest})
+	}
+
+	err := newClient(t, r, "test/app").ExecuteCleanup(&plan)
+	if !errors.Is(err, scratchbuild.ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+	// We give up after the first failure
+	if n := countRequests(r, "DELETE "); n != 1 {
+		t.Errorf("expected 1 delete, got %d", n)
+	}
+}
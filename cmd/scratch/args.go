@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+// parseCommand parses an entrypoint or cmd given either as a JSON array or as
+// words separated by spaces, which may be quoted as in a shell
+func parseCommand(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(s), &args); err != nil {
+			return nil, fmt.Errorf("could not parse JSON array: %w", err)
+		}
+		return args, nil
+	}
+	return shellWords(s)
+}
+
+// shellWords splits s into words as a shell would, handling single and double
+// quotes and backslash escapes. It does not expand variables.
+func shellWords(s string) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case ' ', '\t', '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case '\\':
+			inWord = true
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+		case '\'':
+			inWord = true
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			inWord = true
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, errors.New("unterminated double quote")
+				}
+				if s[i] == '"' {
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+		default:
+			inWord = true
+			word.WriteByte(ch)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// readKeyValueFile reads a file of key=value lines, as used by docker's
+// --env-file and --label-file. Blank lines and lines starting with # are
+// ignored. If fromEnv is set, a line with just a key takes the value from the
+// environment, and is skipped if the variable is not set.
+func readKeyValueFile(filename string, fromEnv bool) ([]pair, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pairs []pair
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			if !fromEnv {
+				return nil, fmt.Errorf("%s line %d: expected key=value", filename, n)
+			}
+			if v, ok = os.LookupEnv(k); !ok {
+				continue
+			}
+		}
+		if k == "" {
+			return nil, fmt.Errorf("%s line %d: missing key", filename, n)
+		}
+		pairs = append(pairs, pair{k, v})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", filename, err)
+	}
+	return pairs, nil
+}
+
+// readLabelFiles reads labels from each file in turn, so labels in later files
+// replace those in earlier ones
+func readLabelFiles(filenames []string) ([]pair, error) {
+	var labels []pair
+	for _, filename := range filenames {
+		pairs, err := readKeyValueFile(filename, false)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, pairs...)
+	}
+	return labels, nil
+}
+
+// exposedPort converts a port given as port[/protocol] to the form used in
+// ExposedPorts, e.g. 8080/tcp. The protocol defaults to tcp.
+func exposedPort(p string) string {
+	port, protocol, ok := strings.Cut(p, "/")
+	if !ok {
+		protocol = "tcp"
+	}
+	return port + "/" + strings.ToLower(protocol)
+}
+
+// healthFlags applies the healthcheck flags to the image's healthcheck, if
+// any. noHealthcheck disables it. Otherwise cmd, if set, replaces the test,
+// and the durations and retries in flags replace those that are set.
+func healthFlags(current *scratchbuild.HealthConfig, cmd string, noHealthcheck bool, flags scratchbuild.HealthConfig) (*scratchbuild.HealthConfig, error) {
+	if noHealthcheck {
+		return &scratchbuild.HealthConfig{Test: []string{"NONE"}}, nil
+	}
+	if cmd == "" && flags.Interval == 0 && flags.Timeout == 0 && flags.StartPeriod == 0 && flags.Retries == 0 {
+		return current, nil
+	}
+
+	var h scratchbuild.HealthConfig
+	if current != nil {
+		h = *current
+	}
+	if cmd != "" {
+		// There's no shell in the image, so the command is always run directly
+		args, err := parseCommand(cmd)
+		if err != nil {
+			return nil, err
+		}
+		h.Test = append([]string{"CMD"}, args...)
+	}
+	if flags.Interval != 0 {
+		h.Interval = flags.Interval
+	}
+	if flags.Timeout != 0 {
+		h.Timeout = flags.Timeout
+	}
+	if flags.StartPeriod != 0 {
+		h.StartPeriod = flags.StartPeriod
+	}
+	if flags.Retries != 0 {
+		h.Retries = flags.Retries
+	}
+	return &h, nil
+}
+
+// parseBaseUser parses a user for the base files layer given as
+// name:uid[:gid[:home]]. The group ID defaults to the user ID.
+func parseBaseUser(s string) (scratchbuild.BaseUser, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 4 {
+		return scratchbuild.BaseUser{}, fmt.Errorf("user %q should be name:uid[:gid[:home]]", s)
+	}
+	u := scratchbuild.BaseUser{Name: parts[0]}
+	var err error
+	if u.UID, err = strconv.Atoi(parts[1]); err != nil {
+		return u, fmt.Errorf("user %q: bad uid: %w", s, err)
+	}
+	u.GID = u.UID
+	if len(parts) > 2 && parts[2] != "" {
+		if u.GID, err = strconv.Atoi(parts[2]); err != nil {
+			return u, fmt.Errorf("user %q: bad gid: %w", s, err)
+		}
+	}
+	if len(parts) > 3 {
+		u.Home = parts[3]
+	}
+	return u, nil
+}
+
+// parseBaseGroup parses a group for the base files layer given as
+// name:gid[:member,member...]
+func parseBaseGroup(s string) (scratchbuild.BaseGroup, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return scratchbuild.BaseGroup{}, fmt.Errorf("group %q should be name:gid[:members]", s)
+	}
+	g := scratchbuild.BaseGroup{Name: parts[0]}
+	var err error
+	if g.GID, err = strconv.Atoi(parts[1]); err != nil {
+		return g, fmt.Errorf("group %q: bad gid: %w", s, err)
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		g.Members = strings.Split(parts[2], ",")
+	}
+	return g, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+func TestReadLabelFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	if err := os.WriteFile(first, []byte("# defaults\nteam=core\ntier=backend\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte("tier=frontend\n\nowner=alice\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	labels, err := readLabelFiles([]string{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Applied in order, the second file's tier wins
+	got := make(map[string]string)
+	for _, l := range labels {
+		got[l[0]] = l[1]
+	}
+	if want := map[string]string{"team": "core", "tier": "frontend", "owner": "alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if _, err := readLabelFiles([]string{first, filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestExposedPort(t *testing.T) {
+	for in, want := range map[string]string{
+		"8080":      "8080/tcp",
+		"53/udp":    "53/udp",
+		"53/UDP":    "53/udp",
+		"443/Tcp":   "443/tcp",
+		"9000/sctp": "9000/sctp",
+	} {
+		if got := exposedPort(in); got != want {
+			t.Errorf("%s: expected %s, got %s", in, want, got)
+		}
+	}
+}
+
+func TestHealthFlags(t *testing.T) {
+	fromDockerfile := &scratchbuild.HealthConfig{Test: []string{"CMD", "/app", "-health"}, Interval: time.Minute, Retries: 2}
+	tests := []struct {
+		name    string
+		current *scratchbuild.HealthConfig
+		cmd     string
+		none    bool
+		flags   scratchbuild.HealthConfig
+		want    *scratchbuild.HealthConfig
+	}{
+		{name: "no flags", current: fromDockerfile, want: fromDockerfile},
+		{name: "no flags or healthcheck"},
+		{
+			name: "shell-quoted command",
+			cmd:  `/app -check "ready or not"`,
+			want: &scratchbuild.HealthConfig{Test: []string{"CMD", "/app", "-check", "ready or not"}},
+		},
+		{
+			name: "JSON command",
+			cmd:  `["/app", "-check"]`,
+			want: &scratchbuild.HealthConfig{Test: []string{"CMD", "/app", "-check"}},
+		},
+		{
+			name:    "flags adjust the current healthcheck",
+			current: fromDockerfile,
+			flags:   scratchbuild.HealthConfig{Timeout: time.Second, StartPeriod: 5 * time.Second, Retries: 5},
+			want:    &scratchbuild.HealthConfig{Test: []string{"CMD", "/app", "-health"}, Interval: time.Minute, Timeout: time.Second, StartPeriod: 5 * time.Second, Retries: 5},
+		},
+		{
+			name:    "command replaces the current test",
+			current: fromDockerfile,
+			cmd:     "/app -live",
+			flags:   scratchbuild.HealthConfig{Interval: 10 * time.Second},
+			want:    &scratchbuild.HealthConfig{Test: []string{"CMD", "/app", "-live"}, Interval: 10 * time.Second, Retries: 2},
+		},
+		{
+			name:    "disabled",
+			current: fromDockerfile,
+			cmd:     "/app",
+			none:    true,
+			want:    &scratchbuild.HealthConfig{Test: []string{"NONE"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := healthFlags(test.current, test.cmd, test.none, test.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+
+	// The current healthcheck is not changed
+	if fromDockerfile.Retries != 2 || fromDockerfile.Test[2] != "-health" {
+		t.Errorf("current healthcheck changed to %+v", fromDockerfile)
+	}
+	if _, err := healthFlags(nil, `["/app"`, false, scratchbuild.HealthConfig{}); err == nil {
+		t.Error("expected an error for a bad JSON command")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		err  string
+	}{
+		{in: "", want: nil},
+		{in: "   ", want: nil},
+		{in: "/app", want: []string{"/app"}},
+		{in: "  /app   -v\tserve\n", want: []string{"/app", "-v", "serve"}},
+		{in: `/app 'hello world' '' x`, want: []string{"/app", "hello world", "", "x"}},
+		{in: `/app 'it''s' 'a "quote"'`, want: []string{"/app", "its", `a "quote"`}},
+		{in: `'a\b'`, want: []string{`a\b`}},
+		{in: `/app "hello world" ""`, want: []string{"/app", "hello world", ""}},
+		{in: `"a \"b\" \\ \$HOME \x"`, want: []string{`a "b" \ $HOME \x`}},
+		{in: `-flag="a b"c`, want: []string{"-flag=a bc"}},
+		{in: `a\ b \'c\' \\`, want: []string{"a b", "'c'", `\`}},
+		{in: `trailing\`, want: []string{"trailing"}},
+		{in: `$HOME`, want: []string{"$HOME"}},
+		{in: `/app 'unterminated`, err: "unterminated single quote"},
+		{in: `/app "unterminated`, err: "unterminated double quote"},
+		{in: `"ends with escape\"`, err: "unterminated double quote"},
+		{in: `["/app", "-v", "two words"]`, want: []string{"/app", "-v", "two words"}},
+		{in: `  ["/app"]  `, want: []string{"/app"}},
+		{in: `[]`, want: []string{}},
+		{in: `["/app", 1]`, err: "could not parse JSON array"},
+		{in: `["/app"`, err: "could not parse JSON array"},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := parseCommand(test.in)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %q, %v", test.err, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
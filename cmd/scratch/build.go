@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+func validate(o *scratchbuild.Options) error {
+	if o.Name == "" {
+		return fmt.Errorf("you must specify a name for the image")
+	}
+	return nil
+}
+
+// build builds an image from a directory and pushes it to a registry
+func build(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	var o scratchbuild.Options
+
+	fs.StringVar(&o.Dir, "dir", "./", "Directory containing container content. With -f this is the build context")
+	var specFile string
+	fs.StringVar(&specFile, "c", "", "Build all the images described in this build spec file, JSON or YAML if it ends in .yaml. Only -created, -verify, -no-overwrite, -no-layer-checks, -q, -result and -parallel are used with it")
+	var parallel int
+	fs.IntVar(&parallel, "parallel", 4, "With -c, how many images to build at once")
+	var dockerfile string
+	fs.StringVar(&dockerfile, "f", "", "Build from this Dockerfile. Only FROM scratch and instructions that don't run commands are supported. Other flags add to the image configuration it describes")
+	var image string
+	fs.StringVar(&image, "image", "", "Full image reference, e.g. eu.gcr.io/proj/app:v1.2. Replaces -regurl, -name and -tag")
+	fs.StringVar(&o.Name, "name", "", "Image name")
+	// THe docker repository is https://index.docker.io
+	fs.StringVar(&o.BaseURL, "regurl", "https://eu.gcr.io", "Registry URL")
+	// If you don't have a token, pass in a user name and password and we'll go and
+	// get one. For the docker repository this is your Docker Hub username & password.
+	// Don't use these for the GCP repository
+	fs.StringVar(&o.User, "user", "", "Registry user name")
+	fs.StringVar(&o.Password, "password", "", "Registry password")
+	var token string
+	fs.StringVar(&token, "token", "", "Repository bearer token. For the GCP repository use this with $(gcloud auth print-access-token)")
+	var tags multiString
+	fs.Var(&tags, "tag", "Image tag")
+
+	var env multiString
+	fs.Var(&env, "env", "Environment variables. Repeat to add more definitions, e.g. '-env PATH=/hat -env USER=postgras'")
+	var volumes multiString
+	fs.Var(&volumes, "vol", "Volumes. Repeat to add more definitions, e.g. '-vol /etc/myapp -env /var/myapp'")
+	var envFiles multiString
+	fs.Var(&envFiles, "env-file", "Read environment variables from this file, one KEY=value per line. A line with just KEY takes the value from the environment. Repeat to read more files")
+	var entrypoint string
+	fs.StringVar(&entrypoint, "entrypoint", "", `Entrypoint, as a JSON array such as '["/app", "-v"]' or as shell-quoted words`)
+	var cmd string
+	fs.StringVar(&cmd, "cmd", "", "Default arguments for the entrypoint, or the command to run if there is no entrypoint. A JSON array or shell-quoted words")
+	var labels multiPair
+	fs.Var(&labels, "label", "Labels. Repeat to add more definitions, e.g. '-label label1=green -label label2=red'")
+	var labelFiles multiString
+	fs.Var(&labelFiles, "label-file", "Read labels from this file, one key=value per line. Repeat to read more files")
+	var runAs string
+	fs.StringVar(&runAs, "run-as", "", "User the container runs as, as a name or UID, optionally with :group. (-user is the registry user name)")
+	var workdir string
+	fs.StringVar(&workdir, "workdir", "", "Working directory of the entrypoint")
+	var ports multiString
+	fs.Var(&ports, "expose", "Port to expose, as port[/protocol]. The protocol defaults to tcp. Repeat to expose more ports")
+	var stopSignal string
+	fs.StringVar(&stopSignal, "stop-signal", "", "Signal sent to stop the container, e.g. SIGTERM")
+	var platform, arch, osName string
+	fs.StringVar(&platform, "platform", "", "Platform of the image, as os/arch[/variant]. Defaults to linux and the architecture of the entrypoint binary")
+	fs.StringVar(&arch, "arch", "", "CPU architecture of the image, e.g. arm64. Overrides -platform")
+	fs.StringVar(&osName, "os", "", "Operating system of the image. Overrides -platform")
+	var variant, osVersion string
+	var osFeatures multiString
+	fs.StringVar(&variant, "variant", "", "CPU variant of the image, e.g. v7. Overrides -platform")
+	fs.StringVar(&osVersion, "os-version", "", "Operating system version the image needs")
+	fs.Var(&osFeatures, "os-feature", "Operating system feature the image needs. Repeat for more features")
+	fs.StringVar(&o.Author, "author", "", "Author of the image")
+	var healthCmd string
+	fs.StringVar(&healthCmd, "health-cmd", "", "Command to check the container is healthy, as a JSON array or shell-quoted words. It is run directly, as the image has no shell")
+	var noHealthcheck bool
+	fs.BoolVar(&noHealthcheck, "no-healthcheck", false, "Disable any healthcheck")
+	var health scratchbuild.HealthConfig
+	fs.DurationVar(&health.Interval, "health-interval", 0, "Time between healthchecks, e.g. 30s")
+	fs.DurationVar(&health.Timeout, "health-timeout", 0, "Time to wait for a healthcheck before it is considered to have hung")
+	fs.DurationVar(&health.StartPeriod, "health-start-period", 0, "Time the container has to start before failed healthchecks count")
+	fs.IntVar(&health.Retries, "health-retries", 0, "Consecutive healthcheck failures needed to report the container unhealthy")
+	var shell string
+	fs.StringVar(&shell, "shell", "", "Shell for the shell form of commands, as a JSON array or shell-quoted words")
+	var argsEscaped bool
+	fs.BoolVar(&argsEscaped, "args-escaped", false, "Mark the command as already escaped. Only used on Windows")
+	var onBuild multiString
+	fs.Var(&onBuild, "onbuild", "Dockerfile instruction to run when the image is used as a base. Repeat for more instructions")
+	var dests, destUsers, destPasswords, destTokens multiString
+	fs.Var(&dests, "dest", "Also push the image to this full image reference. Repeat to push to more registries")
+	fs.Var(&destUsers, "dest-user", "User name for the registry of the -dest with the same position. If given, repeat it for each -dest, using '' where none is needed")
+	fs.Var(&destPasswords, "dest-password", "Password for the registry of the -dest with the same position. If given, repeat it for each -dest")
+	fs.Var(&destTokens, "dest-token", "Bearer token for the registry of the -dest with the same position. If given, repeat it for each -dest")
+	var resultFile string
+	fs.StringVar(&resultFile, "result", "", "Write the build result as JSON to this file. Use - for stdout")
+	var created string
+	fs.StringVar(&created, "created", os.Getenv("SOURCE_DATE_EPOCH"), "Creation time of the image, as RFC3339 or seconds since the epoch. Defaults to $SOURCE_DATE_EPOCH, or the current time. Set this for reproducible builds")
+	fs.BoolVar(&o.Verify, "verify", false, "After pushing, read the image back and check the registry holds what we sent")
+	var baseFiles bool
+	fs.BoolVar(&baseFiles, "base-files", false, "Add a bottom layer with /etc/passwd, /etc/group, /etc/nsswitch.conf, home directories and /tmp. The users are root and nonroot (65532) unless -base-user is given")
+	var baseUsers, baseGroups multiString
+	fs.Var(&baseUsers, "base-user", "Add a user to the base files layer, as name:uid[:gid[:home]]. root is always included. Implies -base-files. Repeat for more users")
+	fs.Var(&baseGroups, "base-group", "Add a group to the base files layer, as name:gid[:member,member]. Implies -base-files. Repeat for more groups")
+	var bundleLibs bool
+	fs.BoolVar(&bundleLibs, "bundle-libs", false, "If the entrypoint is dynamically linked, add the loader and shared libraries it needs from this machine in an extra layer")
+	fs.BoolVar(&o.NoLayerChecks, "no-layer-checks", false, "Don't check the layers contain the entrypoint, working directory and user")
+	fs.BoolVar(&o.NoOverwrite, "no-overwrite", false, "Fail rather than replace a tag that already points to a different image")
+	var quiet bool
+	fs.BoolVar(&quiet, "q", false, "Do not show progress")
+
+	fs.Parse(args)
+	o.Tags = tags
+	if image != "" {
+		if err := o.SetReference(image); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			fs.Usage()
+			os.Exit(1)
+		}
+	}
+	if len(o.Tags) == 0 {
+		o.Tags = []string{"latest"}
+	}
+
+	if created != "" {
+		t, err := parseTime(created)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid creation time. %s\n", err)
+			fs.Usage()
+			os.Exit(1)
+		}
+		o.Created = t
+	}
+
+	if platform != "" {
+		p, err := scratchbuild.ParsePlatform(platform)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			fs.Usage()
+			os.Exit(1)
+		}
+		o.Platform = p
+	}
+	if arch != "" {
+		o.Platform.Architecture = arch
+	}
+	if osName != "" {
+		o.Platform.OS = osName
+	}
+	if variant != "" {
+		o.Platform.Variant = variant
+	}
+	o.Platform.OSVersion = osVersion
+	o.Platform.OSFeatures = osFeatures
+
+	if specFile != "" {
+		b := &specBuilder{
+			created:       o.Created,
+			verify:        o.Verify,
+			noOverwrite:   o.NoOverwrite,
+			noLayerChecks: o.NoLayerChecks,
+		}
+		if !quiet {
+			b.onEvent = newProgress(os.Stderr).event
+		}
+		buildFromSpec(specFile, b, parallel, resultFile)
+		return
+	}
+
+	if err := validate(&o); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	destinations, err := destinationOptions(&o, dests, destUsers, destPasswords, destTokens)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		os.Exit(1)
+	}
+	o.Destinations = destinations
+
+	o.Token = func() string { return token }
+	if !quiet {
+		o.OnEvent = newProgress(os.Stderr).event
+	}
+	c := scratchbuild.New(&o)
+
+	if token == "" {
+		var err error
+		token, err = c.Auth()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to authenticate. %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var (
+		imageConfig scratchbuild.ImageConfig
+		layers      [][]byte
+	)
+	if dockerfile != "" {
+		df, err := readDockerfile(dockerfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read Dockerfile. %s\n", err)
+			os.Exit(1)
+		}
+		imageConfig = df.Config
+		layers, err = df.Layers(c.Dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to build layers from Dockerfile. %s\n", err)
+			os.Exit(1)
+		}
+	} else {
+		b := &bytes.Buffer{}
+		if err := scratchbuild.TarDirectory(c.Dir, b); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to build tar file. %s\n", err)
+			os.Exit(1)
+		}
+		layers = [][]byte{b.Bytes()}
+	}
+
+	for _, filename := range envFiles {
+		vars, err := readKeyValueFile(filename, true)
+		if err != nil {
+			exitf("Failed to read env file. %s", err)
+		}
+		for _, kv := range vars {
+			imageConfig.Env = append(imageConfig.Env, kv[0]+"="+kv[1])
+		}
+	}
+	imageConfig.Env = append(imageConfig.Env, env...)
+
+	if entrypoint != "" {
+		args, err := parseCommand(entrypoint)
+		if err != nil {
+			exitf("Invalid entrypoint. %s", err)
+		}
+		imageConfig.Entrypoint = args
+	}
+	if cmd != "" {
+		args, err := parseCommand(cmd)
+		if err != nil {
+			exitf("Invalid cmd. %s", err)
+		}
+		imageConfig.Cmd = args
+	}
+	if runAs != "" {
+		imageConfig.User = runAs
+	}
+	if workdir != "" {
+		imageConfig.WorkingDir = workdir
+	}
+	if stopSignal != "" {
+		imageConfig.StopSignal = stopSignal
+	}
+	if shell != "" {
+		args, err := parseCommand(shell)
+		if err != nil {
+			exitf("Invalid shell. %s", err)
+		}
+		imageConfig.Shell = args
+	}
+	if argsEscaped {
+		imageConfig.ArgsEscaped = true
+	}
+	imageConfig.OnBuild = append(imageConfig.OnBuild, onBuild...)
+
+	healthcheck, err := healthFlags(imageConfig.Healthcheck, healthCmd, noHealthcheck, health)
+	if err != nil {
+		exitf("Invalid health command. %s", err)
+	}
+	imageConfig.Healthcheck = healthcheck
+
+	if len(ports) > 0 && imageConfig.ExposedPorts == nil {
+		imageConfig.ExposedPorts = make(map[string]struct{}, len(ports))
+	}
+	for _, p := range ports {
+		imageConfig.ExposedPorts[exposedPort(p)] = struct{}{}
+	}
+
+	// Labels given as flags replace those from files
+	fileLabels, err := readLabelFiles(labelFiles)
+	if err != nil {
+		exitf("Failed to read label file. %s", err)
+	}
+	labels = append(fileLabels, labels...)
+
+	if len(labels) > 0 && imageConfig.Labels == nil {
+		imageConfig.Labels = make(map[string]string, len(labels))
+	}
+	if len(labels) > 0 {
+		for _, l := range labels {
+			imageConfig.Labels[l[0]] = l[1]
+		}
+	}
+
+	if len(volumes) > 0 && imageConfig.Volumes == nil {
+		imageConfig.Volumes = make(map[string]struct{}, len(volumes))
+	}
+	if len(volumes) > 0 {
+		for _, v := range volumes {
+			imageConfig.Volumes[v] = struct{}{}
+		}
+	}
+
+	if baseFiles || len(baseUsers) > 0 || len(baseGroups) > 0 {
+		var bf scratchbuild.BaseFiles
+		hasRoot := false
+		for _, s := range baseUsers {
+			u, err := parseBaseUser(s)
+			if err != nil {
+				exitf("Invalid base user. %s", err)
+			}
+			hasRoot = hasRoot || u.Name == "root"
+			bf.Users = append(bf.Users, u)
+		}
+		if len(bf.Users) > 0 && !hasRoot {
+			bf.Users = append([]scratchbuild.BaseUser{scratchbuild.DefaultBaseUsers[0]}, bf.Users...)
+		}
+		for _, s := range baseGroups {
+			g, err := parseBaseGroup(s)
+			if err != nil {
+				exitf("Invalid base group. %s", err)
+			}
+			bf.Groups = append(bf.Groups, g)
+		}
+		base, err := scratchbuild.BaseFilesLayer(&bf)
+		if err != nil {
+			exitf("Failed to build base files layer. %s", err)
+		}
+		layers = append([][]byte{base}, layers...)
+	}
+
+	if bundleLibs {
+		libs, err := scratchbuild.LibraryLayer(&imageConfig, layers...)
+		if err != nil {
+			exitf("Failed to bundle shared libraries. %s", err)
+		}
+		if libs != nil {
+			layers = append(layers, libs)
+		}
+	}
+
+	result, buildErr := c.BuildImage(&imageConfig, layers...)
+	if resultFile != "" && result != nil {
+		// With several destinations there may be a result even if some
+		// failed
+		if err := writeResult(resultFile, result); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write build result. %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if buildErr != nil {
+		exitf("Failed to build image. %s", buildErr)
+	}
+}
+
+func writeResult(filename string, result interface{}) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if filename == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(filename, data, 0o644)
+}
+
+func readDockerfile(filename string) (*scratchbuild.Dockerfile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return scratchbuild.ParseDockerfile(f)
+}
+
+// destinationOptions builds the options for each -dest. The credential flags
+// are matched to -dest by position, so each must be given once per -dest, if
+// at all, with empty values for destinations that don't need them.
+func destinationOptions(o *scratchbuild.Options, dests, users, passwords, tokens []string) ([]scratchbuild.Options, error) {
+	for _, f := range []struct {
+		name   string
+		values []string
+	}{
+		{"-dest-user", users},
+		{"-dest-password", passwords},
+		{"-dest-token", tokens},
+	} {
+		if len(f.values) != 0 && len(f.values) != len(dests) {
+			return nil, fmt.Errorf("%s is matched to -dest by position, so give it once for each of the %d -dest flags, using '' where none is needed (got %d)", f.name, len(dests), len(f.values))
+		}
+	}
+
+	var destinations []scratchbuild.Options
+	for i, dest := range dests {
+		d := scratchbuild.Options{
+			NoOverwrite: o.NoOverwrite,
+			Verify:      o.Verify,
+		}
+		if len(users) > 0 {
+			d.User = users[i]
+		}
+		if len(passwords) > 0 {
+			d.Password = passwords[i]
+		}
+		if len(tokens) > 0 && tokens[i] != "" {
+			token := tokens[i]
+			d.Token = func() string { return token }
+		}
+		if err := d.SetReference(dest); err != nil {
+			return nil, err
+		}
+		if len(d.Tags) == 0 {
+			d.Tags = o.Tags
+		}
+		destinations = append(destinations, d)
+	}
+	return destinations, nil
+}
+
+// parseTime parses a time given either as RFC3339 or as seconds since the epoch
+func parseTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+func TestDestinationOptions(t *testing.T) {
+	o := &scratchbuild.Options{Tags: []string{"v1"}, Verify: true}
+	dests := []string{"eu.gcr.io/proj/app", "docker.io/org/app:stable", "quay.io/org/app"}
+
+	ds, err := destinationOptions(o, dests, []string{"", "hubuser", "quayuser"}, []string{"", "hubpass", "quaypass"}, []string{"gcrtoken", "", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type creds struct {
+		user, password, token string
+		tags                  []string
+	}
+	var got []creds
+	for _, d := range ds {
+		c := creds{user: d.User, password: d.Password, tags: d.Tags}
+		if d.Token != nil {
+			c.token = d.Token()
+		}
+		if !d.Verify {
+			t.Errorf("%s: expected Verify to be passed on", d.Name)
+		}
+		got = append(got, c)
+	}
+	want := []creds{
+		{token: "gcrtoken", tags: []string{"v1"}},
+		{user: "hubuser", password: "hubpass", tags: []string{"stable"}},
+		{user: "quayuser", password: "quaypass", tags: []string{"v1"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// Without credential flags, none are set
+	if ds, err = destinationOptions(o, dests, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range ds {
+		if d.User != "" || d.Password != "" || d.Token != nil {
+			t.Errorf("%s: unexpected credentials", d.Name)
+		}
+	}
+
+	// Credentials that can't be matched to destinations are an error
+	for _, test := range []struct {
+		users, passwords, tokens []string
+		err                      string
+	}{
+		{users: []string{"hubuser"}, passwords: []string{"hubpass"}, err: "-dest-user is matched to -dest by position, so give it once for each of the 3 -dest flags, using '' where none is needed (got 1)"},
+		{users: []string{"a", "b", "c"}, passwords: []string{"a", "b"}, err: "-dest-password is matched to -dest by position"},
+		{tokens: []string{"a", "b", "c", "d"}, err: "-dest-token is matched to -dest by position"},
+	} {
+		if _, err := destinationOptions(o, dests, test.users, test.passwords, test.tokens); err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("expected error %q, got %v", test.err, err)
+		}
+	}
+}
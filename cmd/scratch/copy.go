@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+// copyImage copies an image from one repository to another
+func copyImage(args []string) {
+	fs := flag.NewFlagSet("copy", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: scratch copy [flags] <source image> <destination image>\n\nCopies an image, or every image in an index, between repositories without changing its digest.\n\n")
+		fs.PrintDefaults()
+	}
+	var src, dst registryFlags
+	dst.register(fs)
+	src.registerCredentials(fs, "src-", "Source registry")
+	var noOverwrite, verify bool
+	fs.BoolVar(&noOverwrite, "no-overwrite", false, "Fail rather than replace a tag that already points to a different image")
+	fs.BoolVar(&verify, "verify", false, "After pushing, read the image back and check the registry holds what we sent")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	src.quiet = dst.quiet
+
+	srcClient, reference, err := src.client(fs.Arg(0))
+	if err != nil {
+		exitf("Failed to connect to source registry. %s", err)
+	}
+
+	var o scratchbuild.Options
+	if err := o.SetReference(fs.Arg(1)); err != nil {
+		exitf("Invalid destination. %s", err)
+	}
+	if len(o.Tags) == 0 {
+		// Keep the source tag (or digest) if the destination doesn't have one
+		o.Tags = []string{reference}
+	}
+	o.NoOverwrite = noOverwrite
+	o.Verify = verify
+	if o.BaseURL == srcClient.BaseURL {
+		o.MountFrom = []string{srcClient.Name}
+	}
+	dstClient, _, err := dst.clientFor(o)
+	if err != nil {
+		exitf("Failed to connect to destination registry. %s", err)
+	}
+
+	desc, err := scratchbuild.Copy(srcClient, reference, dstClient)
+	if err != nil {
+		exitf("Failed to copy %s to %s. %s", fs.Arg(0), fs.Arg(1), err)
+	}
+	fmt.Println(desc.Digest)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/philpearl/scratchbuild"
+)
+
+// deleteImages deletes tags or manifests from a registry
+func deleteImages(args []string) {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: scratch delete [flags] <image>...\n\nDeletes images by tag or digest, which must be given. Deleting a tag deletes the manifest it points\nto, which removes any other tags on the same manifest.\n\n")
+		fs.PrintDefaults()
+	}
+	var r registryFlags
+	r.registerCredentials(fs, "", "Registry")
+	var dryRun bool
+	fs.BoolVar(&dryRun, "dry-run", false, "Show what would be deleted without deleting anything")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	r.quiet = true
+
+	var failed bool
+	for _, ref := range fs.Args() {
+		if err := deleteImage(&r, ref, dryRun); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to delete %s. %s\n", ref, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func deleteImage(r *registryFlags, ref string, dryRun bool) error {
+	// Deleting whatever "latest" happens to be is too easy a mistake to make
+	var o scratchbuild.Options
+	if err := o.SetReference(ref); err != nil {
+		return err
+	}
+	if len(o.Tags) == 0 {
+		return fmt.Errorf("%s has no tag or digest. Give the tag or digest to delete, e.g. %s:latest", ref, ref)
+	}
+	c, reference, err := r.clientFor(o)
+	if err != nil {
+		return err
+	}
+
+	dgst, parseErr := digest.Parse(reference)
+	byDigest := parseErr == nil
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	switch {
+	case dryRun && !byDigest:
+		// Resolve the tag so we can say what we would delete
+		var desc scratchbuild.Descriptor
+		var exists bool
+		desc, exists, err = c.HeadManifest(reference)
+		if err == nil && !exists {
+			err = fmt.Errorf("tag %s not found", reference)
+		}
+		dgst = desc.Digest
+	case dryRun:
+	case byDigest:
+		err = c.DeleteManifest(dgst)
+	default:
+		dgst, err = c.DeleteTag(reference)
+	}
+	if err != nil {
+		if errors.Is(err, scratchbuild.ErrUnsupported) {
+			return fmt.Errorf("the registry does not support deleting images: %w", err)
+		}
+		return err
+	}
+
+	name := strings.TrimSuffix(ref, "@"+dgst.String())
+	fmt.Printf("%s %s (%s)\n", verb, name, dgst)
+	return nil
+}
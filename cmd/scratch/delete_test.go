@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+// pushTestImage pushes an image with no layers to a test registry and returns its
+// manifest digest
+func pushTestImage(t *testing.T, r *scratchbuildtest.Registry, name string, tags ...string) string {
+	t.Helper()
+	o := r.ClientOptions(name, tags...)
+	o.NoLayerChecks = true
+	result, err := scratchbuild.New(&o).BuildImage(&scratchbuild.ImageConfig{Cmd: []string{"/app"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.ManifestDigest.String()
+}
+
+func TestDeleteNeedsTagOrDigest(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	pushTestImage(t, r, "test/app", "latest")
+
+	ref := strings.TrimPrefix(r.URL, "http://") + "/test/app"
+	requests := len(r.Requests())
+	err := deleteImage(&registryFlags{quiet: true}, ref, false)
+	if err == nil || !strings.Contains(err.Error(), "no tag or digest") {
+		t.Errorf("expected an error for a reference without a tag, got %v", err)
+	}
+	if len(r.Tags("test/app")) != 1 {
+		t.Error("latest was deleted")
+	}
+	if n := len(r.Requests()) - requests; n != 0 {
+		t.Errorf("expected no requests to the registry, got %d", n)
+	}
+}
+
+func TestDeleteByTagAndDigest(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	host := strings.TrimPrefix(r.URL, "http://")
+	pushTestImage(t, r, "test/app", "v1")
+	dgst := pushTestImage(t, r, "test/other", "v1")
+	flags := &registryFlags{quiet: true}
+
+	// A dry run deletes nothing
+	if err := deleteImage(flags, host+"/test/app:v1", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Tags("test/app")) != 1 {
+		t.Fatal("dry run deleted the tag")
+	}
+
+	if err := deleteImage(flags, host+"/test/app:v1", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Tags("test/app")) != 0 {
+		t.Error("tag not deleted")
+	}
+	if err := deleteImage(flags, host+"/test/app:v1", false); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	if err := deleteImage(flags, host+"/test/other@"+dgst, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := r.Manifest("test/other", dgst); ok {
+		t.Error("manifest not deleted")
+	}
+}
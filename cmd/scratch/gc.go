@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+// gc deletes old tags from a repository according to a retention policy
+func gc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: scratch gc [flags] <repository>\n\nShows which tags a retention policy would delete, and deletes them if -yes is given.\nlatest and semantic version tags such as v1.4.2 are always protected unless\n-no-default-protect is given.\n\n")
+		fs.PrintDefaults()
+	}
+	var r registryFlags
+	r.registerCredentials(fs, "", "Registry")
+	var match string
+	fs.StringVar(&match, "match", "", "Only consider tags matching this regular expression, e.g. '^pr-'")
+	var policy scratchbuild.RetentionPolicy
+	fs.IntVar(&policy.KeepLast, "keep", 0, "Keep this many of the newest matching tags")
+	var olderThan string
+	fs.StringVar(&olderThan, "older-than", "", "Only delete tags older than this, e.g. 720h or 30d")
+	var protect multiString
+	fs.Var(&protect, "protect", "Never delete tags matching this regular expression. Repeat to add more")
+	var noDefaultProtect bool
+	fs.BoolVar(&noDefaultProtect, "no-default-protect", false, "Don't protect latest and semantic version tags")
+	var yes bool
+	fs.BoolVar(&yes, "yes", false, "Delete the tags. Without this the plan is only shown")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	r.quiet = true
+
+	var err error
+	if match != "" {
+		if policy.Match, err = regexp.Compile(match); err != nil {
+			exitf("Invalid -match. %s", err)
+		}
+	}
+	if olderThan != "" {
+		if policy.OlderThan, err = parseAge(olderThan); err != nil {
+			exitf("Invalid -older-than. %s", err)
+		}
+	}
+	// A nil Protect would mean the defaults, so start from an empty list
+	policy.Protect = []*regexp.Regexp{}
+	if !noDefaultProtect {
+		policy.Protect = append(policy.Protect, scratchbuild.DefaultProtectedTags...)
+	}
+	for _, p := range protect {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			exitf("Invalid -protect. %s", err)
+		}
+		policy.Protect = append(policy.Protect, re)
+	}
+	if policy.KeepLast <= 0 && policy.OlderThan <= 0 {
+		exitf("You must give -keep or -older-than")
+	}
+
+	c, _, err := r.client(fs.Arg(0))
+	if err != nil {
+		exitf("Failed to connect to registry. %s", err)
+	}
+
+	plan, err := c.PlanCleanup(&policy, time.Now())
+	if err != nil {
+		exitf("Failed to plan cleanup. %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ACTION\tTAG\tCREATED\tDIGEST\tREASON\n")
+	printPlan(w, "keep", plan.Keep)
+	printPlan(w, "delete", plan.Delete)
+	w.Flush()
+
+	if len(plan.Delete) == 0 {
+		fmt.Println("Nothing to delete")
+		return
+	}
+	if !yes {
+		fmt.Printf("Would delete %d tags. Run again with -yes to delete them\n", len(plan.Delete))
+		return
+	}
+
+	if err := c.ExecuteCleanup(plan); err != nil {
+		if errors.Is(err, scratchbuild.ErrUnsupported) {
+			exitf("The registry does not support deleting images. %s", err)
+		}
+		exitf("Cleanup failed. %s", err)
+	}
+	fmt.Printf("Deleted %d tags\n", len(plan.Delete))
+}
+
+func printPlan(w *tabwriter.Writer, action string, tags []scratchbuild.TagInfo) {
+	for _, info := range tags {
+		created := "-"
+		if !info.Created.IsZero() {
+			created = info.Created.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", action, info.Tag, created, shortDigest(info.Digest.String()), info.Reason)
+	}
+}
+
+// parseAge parses a duration, also allowing a number of days such as 30d
+func parseAge(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
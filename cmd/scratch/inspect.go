@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+// inspectOutput is what inspect prints in JSON mode
+type inspectOutput struct {
+	Reference string                    `json:"reference"`
+	Digest    string                    `json:"digest"`
+	MediaType string                    `json:"mediaType"`
+	Size      int64                     `json:"size"`
+	Manifests []scratchbuild.Descriptor `json:"manifests,omitempty"`
+	Platform  string                    `json:"platform,omitempty"`
+	Image     *scratchbuild.Image       `json:"image,omitempty"`
+	Layers    []scratchbuild.Descriptor `json:"layers,omitempty"`
+	TotalSize int64                     `json:"totalSize,omitempty"`
+}
+
+// inspect shows the details of an image in a registry
+func inspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: scratch inspect [flags] <image>\n\nShows the manifest and configuration of an image in a registry.\n\n")
+		fs.PrintDefaults()
+	}
+	var r registryFlags
+	r.registerCredentials(fs, "", "Registry")
+	var raw, asJSON bool
+	fs.BoolVar(&raw, "raw", false, "Print the manifest exactly as the registry sends it")
+	fs.BoolVar(&asJSON, "json", false, "Print the details as JSON")
+	var platform string
+	fs.StringVar(&platform, "platform", "", "For an index, show the image for this platform, e.g. linux/arm64")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	r.quiet = true
+
+	c, reference, err := r.client(fs.Arg(0))
+	if err != nil {
+		exitf("Failed to connect to registry. %s", err)
+	}
+
+	data, desc, err := c.GetManifest(reference)
+	if err != nil {
+		exitf("Failed to fetch manifest. %s", err)
+	}
+	if raw {
+		os.Stdout.Write(data)
+		return
+	}
+
+	out := inspectOutput{
+		Reference: fs.Arg(0),
+		Digest:    desc.Digest.String(),
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+	}
+
+	if desc.MediaType == scratchbuild.MediaTypeOCIIndex || desc.MediaType == scratchbuild.MediaTypeManifestList {
+		var index scratchbuild.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			exitf("Failed to parse index. %s", err)
+		}
+		if platform == "" {
+			out.Manifests = index.Manifests
+			printInspect(&out, asJSON)
+			return
+		}
+
+		want, err := scratchbuild.ParsePlatform(platform)
+		if err != nil {
+			exitf("%s", err)
+		}
+		var found bool
+		for _, m := range index.Manifests {
+			if m.Platform != nil && m.Platform.String() == want.String() {
+				data, desc, err = c.GetManifest(m.Digest.String())
+				if err != nil {
+					exitf("Failed to fetch manifest for %s. %s", platform, err)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			exitf("The index has no manifest for %s", platform)
+		}
+		out.Digest = desc.Digest.String()
+		out.MediaType = desc.MediaType
+		out.Size = desc.Size
+	}
+
+	var manifest scratchbuild.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		exitf("Failed to parse manifest. %s", err)
+	}
+	image, err := c.GetImage(&manifest)
+	if err != nil {
+		exitf("Failed to fetch image configuration. %s", err)
+	}
+
+	out.Image = image
+	out.Platform = scratchbuild.Platform{OS: image.OS, Architecture: image.Architecture, Variant: image.Variant}.String()
+	out.Layers = manifest.Layers
+	for _, l := range manifest.Layers {
+		out.TotalSize += l.Size
+	}
+	out.TotalSize += manifest.Config.Size
+
+	printInspect(&out, asJSON)
+}
+
+func printInspect(out *inspectOutput, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			exitf("Failed to write output. %s", err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Reference:\t%s\n", out.Reference)
+	fmt.Fprintf(w, "Digest:\t%s\n", out.Digest)
+	fmt.Fprintf(w, "Media type:\t%s\n", out.MediaType)
+
+	if len(out.Manifests) > 0 {
+		fmt.Fprintf(w, "Manifests:\n")
+		for _, m := range out.Manifests {
+			platform := "unknown"
+			if m.Platform != nil {
+				platform = m.Platform.String()
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", platform, m.Digest, byteSize(m.Size))
+		}
+		return
+	}
+
+	image := out.Image
+	config := &image.Config
+	fmt.Fprintf(w, "Platform:\t%s\n", out.Platform)
+	if image.Created != nil {
+		fmt.Fprintf(w, "Created:\t%s\n", image.Created.Format(time.RFC3339))
+	}
+	printField(w, "Author", image.Author)
+	printField(w, "Entrypoint", jsonArray(config.Entrypoint))
+	printField(w, "Cmd", jsonArray(config.Cmd))
+	printField(w, "User", config.User)
+	printField(w, "Working dir", config.WorkingDir)
+	printField(w, "Stop signal", config.StopSignal)
+	printField(w, "Shell", jsonArray(config.Shell))
+	if h := config.Healthcheck; h != nil {
+		printField(w, "Healthcheck", jsonArray(h.Test))
+		if h.Interval != 0 || h.Timeout != 0 || h.StartPeriod != 0 || h.Retries != 0 {
+			fmt.Fprintf(w, "  \tinterval %s, timeout %s, start period %s, retries %d\n", h.Interval, h.Timeout, h.StartPeriod, h.Retries)
+		}
+	}
+	printList(w, "On build", config.OnBuild)
+	printList(w, "Env", config.Env)
+	printList(w, "Exposed ports", setKeys(config.ExposedPorts))
+	printList(w, "Volumes", setKeys(config.Volumes))
+	labels := make([]string, 0, len(config.Labels))
+	for k, v := range config.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	printList(w, "Labels", labels)
+
+	fmt.Fprintf(w, "Layers:\n")
+	for _, l := range out.Layers {
+		fmt.Fprintf(w, "  %s  %s\n", l.Digest, byteSize(l.Size))
+	}
+	fmt.Fprintf(w, "Total size:\t%s\n", byteSize(out.TotalSize))
+
+	if len(image.History) > 0 {
+		fmt.Fprintf(w, "History:\n")
+		for _, h := range image.History {
+			var created string
+			if h.Created != nil {
+				created = h.Created.Format(time.RFC3339)
+			}
+			comment := h.CreatedBy
+			if h.Comment != "" {
+				comment += " (" + h.Comment + ")"
+			}
+			if h.EmptyLayer {
+				comment += " [empty]"
+			}
+			fmt.Fprintf(w, "  %s\t%s\n", created, comment)
+		}
+	}
+}
+
+func printField(w io.Writer, name, value string) {
+	if value != "" {
+		fmt.Fprintf(w, "%s:\t%s\n", name, value)
+	}
+}
+
+func printList(w io.Writer, name string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", name)
+	for _, v := range values {
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+}
+
+func jsonArray(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+func setKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
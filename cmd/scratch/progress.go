@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+// progress renders client events as a simple progress display. While a single
+// blob is being transferred its progress is redrawn on one line. When several
+// are in flight at once, as when pushing to several destinations or building
+// several images, redrawing would mix them up, so progress is printed as a
+// line for each step instead.
+type progress struct {
+	mu sync.Mutex
+	w  io.Writer
+	// last is the percentage last shown for each blob being transferred, so
+	// we only draw when something visible changes
+	last map[string]int64
+	// lines is set while more than one transfer is in flight
+	lines bool
+	// partial is set if the cursor is at the end of a line we redraw
+	partial bool
+}
+
+// lineStep is the percentage between progress lines when several transfers
+// are in flight
+const lineStep = 25
+
+func newProgress(w io.Writer) *progress {
+	return &progress{w: w, last: make(map[string]int64)}
+}
+
+func (p *progress) event(e scratchbuild.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch e.Kind {
+	case scratchbuild.EventAuth:
+		p.printf("Authenticating with %s\n", e.URL)
+	case scratchbuild.EventBlobCheck:
+		if e.Exists {
+			p.printf("%s: already exists\n", shortDigest(e.Digest.String()))
+		}
+	case scratchbuild.EventBlobUpload, scratchbuild.EventBlobDownload:
+		p.transfer(e)
+	case scratchbuild.EventManifestPush:
+		if e.Exists {
+			p.printf("Unchanged %s:%s (%s)\n", e.Repository, e.Tag, e.Digest)
+			return
+		}
+		if e.Tag == e.Digest.String() {
+			p.printf("Pushed %s@%s\n", e.Repository, e.Digest)
+			return
+		}
+		p.printf("Pushed %s:%s (%s)\n", e.Repository, e.Tag, e.Digest)
+	}
+}
+
+func (p *progress) transfer(e scratchbuild.Event) {
+	key := e.Kind.String() + e.Repository + "@" + e.Digest.String()
+	verb := "upload"
+	if e.Kind == scratchbuild.EventBlobDownload {
+		verb = "download"
+	}
+	if e.Err != nil {
+		// The error itself is reported by whoever started the transfer
+		delete(p.last, key)
+		msg := fmt.Sprintf("%s: %s failed", shortDigest(e.Digest.String()), verb)
+		if p.lines && e.Repository != "" {
+			msg = e.Repository + " " + msg
+		}
+		p.printf("%s\n", msg)
+		if len(p.last) == 0 {
+			p.lines = false
+		}
+		return
+	}
+	var pct int64 = 100
+	if e.Total > 0 {
+		pct = e.Sent * 100 / e.Total
+	}
+	done := e.Sent == e.Total
+	last, ok := p.last[key]
+	if !ok {
+		last = -1
+	}
+	p.last[key] = pct
+	if len(p.last) > 1 {
+		p.lines = true
+	}
+	if done {
+		delete(p.last, key)
+	}
+
+	msg := fmt.Sprintf("%s: %sing %s / %s (%d%%)", shortDigest(e.Digest.String()), verb, byteSize(e.Sent), byteSize(e.Total), pct)
+
+	if p.lines {
+		if !ok || done || pct/lineStep != last/lineStep {
+			if e.Repository != "" {
+				msg = e.Repository + " " + msg
+			}
+			p.printf("%s\n", msg)
+		}
+	} else if last != pct || done {
+		fmt.Fprintf(p.w, "\r%s", msg)
+		p.partial = true
+		if done {
+			fmt.Fprintln(p.w)
+			p.partial = false
+		}
+	}
+
+	if len(p.last) == 0 {
+		p.lines = false
+	}
+}
+
+// printf prints whole lines, finishing any line being redrawn first
+func (p *progress) printf(format string, args ...interface{}) {
+	if p.partial {
+		fmt.Fprintln(p.w)
+		p.partial = false
+	}
+	fmt.Fprintf(p.w, format, args...)
+}
+
+func shortDigest(d string) string {
+	if len(d) > 19 {
+		return d[:19]
+	}
+	return d
+}
+
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
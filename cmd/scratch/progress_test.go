@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/philpearl/scratchbuild"
+)
+
+func uploadEvent(repo string, dgst digest.Digest, sent, total int64) scratchbuild.Event {
+	return scratchbuild.Event{Kind: scratchbuild.EventBlobUpload, Repository: repo, Digest: dgst, Sent: sent, Total: total}
+}
+
+func TestProgressSingleTransfer(t *testing.T) {
+	var b strings.Builder
+	p := newProgress(&b)
+	d := digest.FromString("a")
+	for _, sent := range []int64{0, 50, 100} {
+		p.event(uploadEvent("r/a", d, sent, 100))
+	}
+	p.event(scratchbuild.Event{Kind: scratchbuild.EventManifestPush, Repository: "r/a", Tag: "latest", Digest: d})
+
+	out := b.String()
+	if strings.Count(out, "\r") != 3 {
+		t.Errorf("expected a single transfer to be redrawn in place, got %q", out)
+	}
+	if !strings.HasSuffix(out, "(100%)\nPushed r/a:latest ("+d.String()+")\n") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestProgressConcurrentTransfers(t *testing.T) {
+	var b strings.Builder
+	p := newProgress(&b)
+	d1, d2 := digest.FromString("a"), digest.FromString("b")
+
+	p.event(uploadEvent("r/a", d1, 0, 100))
+	p.event(uploadEvent("r/a", d1, 10, 100))
+	// A second upload starts, so we switch to a line per step
+	p.event(uploadEvent("r/b", d2, 0, 100))
+	for sent := int64(1); sent <= 100; sent++ {
+		p.event(uploadEvent("r/a", d1, 10+sent*90/100, 100))
+		p.event(uploadEvent("r/b", d2, sent, 100))
+	}
+
+	out := b.String()
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	// The line being redrawn for the first upload is finished before the
+	// second upload's lines start
+	if !strings.HasPrefix(lines[0], "\r") || strings.Contains(strings.Join(lines[1:], "\n"), "\r") {
+		t.Fatalf("expected no redrawing once two uploads are in flight, got %q", out)
+	}
+	var a, bl []string
+	for _, l := range lines[1:] {
+		switch {
+		case strings.HasPrefix(l, "r/a "):
+			a = append(a, l)
+		case strings.HasPrefix(l, "r/b "):
+			bl = append(bl, l)
+		default:
+			t.Errorf("unexpected line %q", l)
+		}
+	}
+	// r/b starts at 0% then shows 25%, 50%, 75% and 100%
+	if len(bl) != 5 || !strings.HasSuffix(bl[4], "(100%)") {
+		t.Errorf("unexpected lines for r/b: %q", bl)
+	}
+	if len(a) == 0 || !strings.HasSuffix(a[len(a)-1], "(100%)") {
+		t.Errorf("unexpected lines for r/a: %q", a)
+	}
+
+	// With nothing in flight we go back to redrawing
+	b.Reset()
+	p.event(uploadEvent("r/a", digest.FromString("c"), 0, 100))
+	if !strings.HasPrefix(b.String(), "\r") {
+		t.Errorf("expected redrawing once transfers finished, got %q", b.String())
+	}
+}
+
+func TestProgressFailedTransfer(t *testing.T) {
+	var b strings.Builder
+	p := newProgress(&b)
+	d1, d2 := digest.FromString("a"), digest.FromString("b")
+
+	p.event(uploadEvent("r/a", d1, 0, 100))
+	p.event(uploadEvent("r/b", d2, 0, 100))
+	failed := uploadEvent("r/a", d1, 0, 100)
+	failed.Err = errors.New("connection reset")
+	p.event(failed)
+	p.event(uploadEvent("r/b", d2, 100, 100))
+
+	if !strings.Contains(b.String(), "r/a "+shortDigest(d1.String())+": upload failed\n") {
+		t.Errorf("expected the failure to be shown, got %q", b.String())
+	}
+
+	// Neither transfer is still in flight, so we go back to redrawing
+	b.Reset()
+	p.event(uploadEvent("r/a", digest.FromString("c"), 0, 100))
+	if !strings.HasPrefix(b.String(), "\r") {
+		t.Errorf("expected redrawing once transfers finished or failed, got %q", b.String())
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// pull pulls an image from a registry into an OCI image layout directory
+func pull(args []string) {
+	fs := flag.NewFlagSet("pull", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: scratch pull [flags] <image> <directory>\n\nPulls an image, or every image in an index, into an OCI image layout directory.\n\n")
+		fs.PrintDefaults()
+	}
+	var r registryFlags
+	r.register(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, reference, err := r.client(fs.Arg(0))
+	if err != nil {
+		exitf("Failed to connect to registry. %s", err)
+	}
+
+	desc, err := c.Pull(reference, fs.Arg(1))
+	if err != nil {
+		exitf("Failed to pull %s. %s", fs.Arg(0), err)
+	}
+	fmt.Println(desc.Digest)
+}
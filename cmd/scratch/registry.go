@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+// registryFlags are the flags shared by the commands that talk to a registry
+// about an existing image
+type registryFlags struct {
+	user     string
+	password string
+	token    string
+	quiet    bool
+	progress *progress
+}
+
+func (r *registryFlags) register(fs *flag.FlagSet) {
+	r.registerCredentials(fs, "", "Registry")
+	fs.BoolVar(&r.quiet, "q", false, "Do not show progress")
+}
+
+// registerCredentials registers the credential flags with a prefix, for
+// commands that talk to more than one registry
+func (r *registryFlags) registerCredentials(fs *flag.FlagSet, prefix, what string) {
+	fs.StringVar(&r.user, prefix+"user", "", what+" user name")
+	fs.StringVar(&r.password, prefix+"password", "", what+" password")
+	fs.StringVar(&r.token, prefix+"token", "", what+" bearer token. For the GCP repository use this with $(gcloud auth print-access-token)")
+}
+
+// client returns an authenticated client for the repository in the image
+// reference ref, along with the tag or digest from the reference. If the
+// reference has neither the tag is "latest".
+func (r *registryFlags) client(ref string) (*scratchbuild.Client, string, error) {
+	var o scratchbuild.Options
+	if err := o.SetReference(ref); err != nil {
+		return nil, "", err
+	}
+	return r.clientFor(o)
+}
+
+// clientFor returns an authenticated client for the options, which must
+// already have the registry and repository set.
+func (r *registryFlags) clientFor(o scratchbuild.Options) (*scratchbuild.Client, string, error) {
+	reference := "latest"
+	if len(o.Tags) > 0 {
+		// If there's a tag and a digest, the digest is more specific
+		reference = o.Tags[len(o.Tags)-1]
+	}
+
+	o.User = r.user
+	o.Password = r.password
+	token := r.token
+	o.Token = func() string { return token }
+	if !r.quiet {
+		if r.progress == nil {
+			r.progress = newProgress(os.Stderr)
+		}
+		o.OnEvent = r.progress.event
+	}
+	c := scratchbuild.New(&o)
+
+	if token == "" {
+		var err error
+		token, err = c.Auth()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return c, reference, nil
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+	"gopkg.in/yaml.v3"
+)
+
+// buildSpec describes a set of images for scratch build -c to build. It is
+// JSON, or YAML if the file name ends in .yaml or .yml. The JSON field names
+// are used in both.
+type buildSpec struct {
+	// Registries holds the credentials for each registry, keyed by host, e.g.
+	// eu.gcr.io or docker.io
+	Registries map[string]specRegistry `json:"registries"`
+	Images     []specImage             `json:"images"`
+}
+
+// specRegistry holds the credentials for a registry. Secrets are read from
+// environment variables so they need not be in the file.
+type specRegistry struct {
+	User        string `json:"user"`
+	PasswordEnv string `json:"passwordEnv"`
+	TokenEnv    string `json:"tokenEnv"`
+}
+
+type specImage struct {
+	// Name identifies the image in output. It defaults to the first
+	// destination.
+	Name string `json:"name"`
+	// Destinations are the image references to push to, e.g.
+	// eu.gcr.io/proj/app:v1.2
+	Destinations []string `json:"destinations"`
+	// Platforms lists the platforms to build for, e.g. linux/arm64. With more
+	// than one, an image is built for each and the tags point to an index of
+	// them. With none, the platform is read from the entrypoint binary and
+	// {os} and {arch} in file sources are linux and amd64.
+	Platforms []string    `json:"platforms"`
+	Layers    []specLayer `json:"layers"`
+	Config    specConfig  `json:"config"`
+	// BaseFiles, if set, adds a bottom layer with /etc/passwd, /etc/group and
+	// so on. An empty object gives the default users.
+	BaseFiles *scratchbuild.BaseFiles `json:"baseFiles"`
+	// BundleLibs adds the loader and shared libraries a dynamically linked
+	// entrypoint needs, from this machine, in an extra layer
+	BundleLibs bool `json:"bundleLibs"`
+}
+
+// specLayer is a layer of an image. Identical layers in different images are
+// compressed and uploaded just once.
+type specLayer struct {
+	Files []specFile `json:"files"`
+	// UID and GID own the files in the layer
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// specFile copies a file or directory into a layer. Src is relative to the
+// spec file, and may contain {os}, {arch} and {variant}, which are replaced
+// for each platform. If Src is a directory its contents are copied into Dest.
+// If Src is a file and Dest ends in / the file is copied into Dest.
+type specFile struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
+	// Mode is the octal mode of a file, e.g. "0755". If not set the mode of
+	// the source file is used. In YAML it must be quoted.
+	Mode string `json:"mode"`
+}
+
+type specConfig struct {
+	Entrypoint []string          `json:"entrypoint"`
+	Cmd        []string          `json:"cmd"`
+	Env        []string          `json:"env"`
+	Ports      []string          `json:"ports"`
+	User       string            `json:"user"`
+	WorkingDir string            `json:"workdir"`
+	Labels     map[string]string `json:"labels"`
+	Volumes    []string          `json:"volumes"`
+	StopSignal string            `json:"stopSignal"`
+	Shell      []string          `json:"shell"`
+	OnBuild    []string          `json:"onBuild"`
+	// ArgsEscaped matters only for Windows images
+	ArgsEscaped bool `json:"argsEscaped"`
+	// Healthcheck durations are strings such as "30s"
+	Healthcheck *struct {
+		Test        []string `json:"test"`
+		Interval    string   `json:"interval"`
+		Timeout     string   `json:"timeout"`
+		StartPeriod string   `json:"startPeriod"`
+		Retries     int      `json:"retries"`
+	} `json:"healthcheck"`
+}
+
+// specResult is what scratch build -c reports for each image
+type specResult struct {
+	Name string `json:"name"`
+	// Images has a result for each platform
+	Images []*scratchbuild.BuildResult `json:"images,omitempty"`
+	// Index is set if there is more than one platform
+	Index *scratchbuild.BuildResult `json:"index,omitempty"`
+	Error string                    `json:"error,omitempty"`
+}
+
+// specBuilder builds the images in a build spec
+type specBuilder struct {
+	spec buildSpec
+	// dir is the directory containing the spec file
+	dir     string
+	cache   *scratchbuild.LayerCache
+	created time.Time
+	verify  bool
+	// noOverwrite is passed to Options.NoOverwrite
+	noOverwrite bool
+	// noLayerChecks is passed to Options.NoLayerChecks
+	noLayerChecks bool
+	onEvent       func(scratchbuild.Event)
+	// repositories lists the repositories in the spec for each registry, so
+	// that blobs can be mounted between them
+	repositories map[string][]string
+}
+
+func readBuildSpec(filename string) (*buildSpec, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, err
+		}
+	}
+	var spec buildSpec
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		return nil, err
+	}
+	for i, img := range spec.Images {
+		if len(img.Destinations) == 0 {
+			return nil, fmt.Errorf("image %d (%s) has no destinations", i, img.Name)
+		}
+		if img.Name == "" {
+			spec.Images[i].Name = img.Destinations[0]
+		}
+	}
+	return &spec, nil
+}
+
+// yamlToJSON converts a YAML build spec to JSON, so that the spec has just one
+// set of field names and is checked for unknown fields the same way
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert YAML: %w", err)
+	}
+	return data, nil
+}
+
+// buildAll builds the images in the spec, parallel at a time, and returns the
+// results in the same order
+func (b *specBuilder) buildAll(parallel int) []specResult {
+	b.repositories = make(map[string][]string)
+	for _, img := range b.spec.Images {
+		for _, dest := range img.Destinations {
+			if ref, err := scratchbuild.ParseReference(dest); err == nil {
+				b.repositories[ref.Registry] = append(b.repositories[ref.Registry], ref.Repository)
+			}
+		}
+	}
+
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]specResult, len(b.spec.Images))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range b.spec.Images {
+		wg.Add(1)
+		go func(img *specImage, result *specResult) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			result.Name = img.Name
+			if err := b.build(img, result); err != nil {
+				result.Error = err.Error()
+			}
+		}(&b.spec.Images[i], &results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+func (b *specBuilder) build(img *specImage, result *specResult) error {
+	var platforms []scratchbuild.Platform
+	for _, p := range img.Platforms {
+		platform, err := scratchbuild.ParsePlatform(p)
+		if err != nil {
+			return err
+		}
+		platforms = append(platforms, platform)
+	}
+	detect := len(platforms) == 0
+	if detect {
+		platforms = []scratchbuild.Platform{{OS: "linux", Architecture: "amd64"}}
+	}
+
+	o, err := b.options(img.Destinations[0])
+	if err != nil {
+		return err
+	}
+	for _, dest := range img.Destinations[1:] {
+		d, err := b.options(dest)
+		if err != nil {
+			return err
+		}
+		o.Destinations = append(o.Destinations, *d)
+	}
+	c := scratchbuild.New(o)
+
+	config, err := img.Config.imageConfig()
+	if err != nil {
+		return err
+	}
+	for _, platform := range platforms {
+		layers, err := b.layers(img, platform)
+		if err != nil {
+			return fmt.Errorf("%s: %w", platform, err)
+		}
+		if img.BundleLibs {
+			libs, err := scratchbuild.LibraryLayer(&config, layers...)
+			if err != nil {
+				return fmt.Errorf("%s: %w", platform, err)
+			}
+			if libs != nil {
+				layers = append(layers, libs)
+			}
+		}
+
+		pc := *c
+		pc.Platform = platform
+		if detect {
+			pc.Platform = scratchbuild.Platform{}
+		}
+		if len(platforms) > 1 {
+			// The tags go on the index, so the images are pushed by digest
+			pc.Tags = nil
+			pc.Destinations = make([]scratchbuild.Options, len(c.Destinations))
+			for i, d := range c.Destinations {
+				d.Tags = nil
+				pc.Destinations[i] = d
+			}
+		}
+		r, err := pc.BuildImage(&config, layers...)
+		if r != nil {
+			result.Images = append(result.Images, r)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", platform, err)
+		}
+	}
+
+	if len(platforms) > 1 {
+		manifests := make([]scratchbuild.Descriptor, len(result.Images))
+		for i, r := range result.Images {
+			manifests[i] = r.Descriptor()
+		}
+		result.Index, err = c.PushIndex(manifests)
+		if err != nil {
+			return fmt.Errorf("could not push index: %w", err)
+		}
+	}
+	return nil
+}
+
+// options returns authenticated client options for an image reference
+func (b *specBuilder) options(ref string) (*scratchbuild.Options, error) {
+	r, err := scratchbuild.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	o := &scratchbuild.Options{
+		Created:       b.created,
+		Verify:        b.verify,
+		NoOverwrite:   b.noOverwrite,
+		NoLayerChecks: b.noLayerChecks,
+		OnEvent:       b.onEvent,
+		LayerCache:    b.cache,
+	}
+	if err := o.SetReference(ref); err != nil {
+		return nil, err
+	}
+	if len(o.Tags) == 0 {
+		o.Tags = []string{"latest"}
+	}
+	for _, name := range b.repositories[r.Registry] {
+		if name != r.Repository {
+			o.MountFrom = append(o.MountFrom, name)
+		}
+	}
+
+	creds := b.spec.Registries[r.Registry]
+	o.User = creds.User
+	if creds.PasswordEnv != "" {
+		o.Password = os.Getenv(creds.PasswordEnv)
+	}
+	token := ""
+	if creds.TokenEnv != "" {
+		token = os.Getenv(creds.TokenEnv)
+	}
+	if token == "" {
+		if token, err = scratchbuild.New(o).Auth(); err != nil {
+			return nil, fmt.Errorf("failed to authenticate with %s: %w", r.Registry, err)
+		}
+	}
+	o.Token = func() string { return token }
+	return o, nil
+}
+
+// layers builds the layers of an image for a platform
+func (b *specBuilder) layers(img *specImage, platform scratchbuild.Platform) ([][]byte, error) {
+	replacer := strings.NewReplacer("{os}", platform.OS, "{arch}", platform.Architecture, "{variant}", platform.Variant)
+	layers := make([][]byte, 0, len(img.Layers)+1)
+	if img.BaseFiles != nil {
+		base, err := scratchbuild.BaseFilesLayer(img.BaseFiles)
+		if err != nil {
+			return nil, fmt.Errorf("base files: %w", err)
+		}
+		layers = append(layers, base)
+	}
+	for i, l := range img.Layers {
+		var buf bytes.Buffer
+		lw := scratchbuild.NewLayerWriter(&buf)
+		lw.SetOwner(l.UID, l.GID)
+		for _, f := range l.Files {
+			if err := b.addFile(lw, f, replacer); err != nil {
+				return nil, fmt.Errorf("layer %d: %w", i, err)
+			}
+		}
+		if err := lw.Close(); err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+		layers = append(layers, buf.Bytes())
+	}
+	return layers, nil
+}
+
+func (b *specBuilder) addFile(lw *scratchbuild.LayerWriter, f specFile, replacer *strings.Replacer) error {
+	if f.Src == "" || f.Dest == "" {
+		return fmt.Errorf("files need a src and a dest")
+	}
+	src := replacer.Replace(f.Src)
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(b.dir, src)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	dest := f.Dest
+	if !fi.IsDir() && strings.HasSuffix(dest, "/") {
+		dest = path.Join(dest, filepath.Base(src))
+	}
+	if f.Mode == "" {
+		return lw.AddFile(src, dest)
+	}
+
+	if fi.IsDir() {
+		return fmt.Errorf("%s: mode can only be set for files", f.Src)
+	}
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("%s: invalid mode %q", f.Src, f.Mode)
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	fm := os.FileMode(mode) & os.ModePerm
+	if mode&0o4000 != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		fm |= os.ModeSticky
+	}
+	return lw.AddBytes(dest, data, fm)
+}
+
+func (c *specConfig) imageConfig() (scratchbuild.ImageConfig, error) {
+	config := scratchbuild.ImageConfig{
+		Entrypoint:  c.Entrypoint,
+		Cmd:         c.Cmd,
+		Env:         c.Env,
+		User:        c.User,
+		WorkingDir:  c.WorkingDir,
+		Labels:      c.Labels,
+		StopSignal:  c.StopSignal,
+		Shell:       c.Shell,
+		OnBuild:     c.OnBuild,
+		ArgsEscaped: c.ArgsEscaped,
+	}
+	if h := c.Healthcheck; h != nil {
+		config.Healthcheck = &scratchbuild.HealthConfig{Test: h.Test, Retries: h.Retries}
+		for _, d := range []struct {
+			name  string
+			value string
+			to    *time.Duration
+		}{
+			{"interval", h.Interval, &config.Healthcheck.Interval},
+			{"timeout", h.Timeout, &config.Healthcheck.Timeout},
+			{"startPeriod", h.StartPeriod, &config.Healthcheck.StartPeriod},
+		} {
+			if d.value == "" {
+				continue
+			}
+			v, err := time.ParseDuration(d.value)
+			if err != nil {
+				return config, fmt.Errorf("healthcheck %s: %w", d.name, err)
+			}
+			*d.to = v
+		}
+	}
+	if len(c.Ports) > 0 {
+		config.ExposedPorts = make(map[string]struct{}, len(c.Ports))
+		for _, p := range c.Ports {
+			config.ExposedPorts[exposedPort(p)] = struct{}{}
+		}
+	}
+	if len(c.Volumes) > 0 {
+		config.Volumes = make(map[string]struct{}, len(c.Volumes))
+		for _, v := range c.Volumes {
+			config.Volumes[v] = struct{}{}
+		}
+	}
+	return config, nil
+}
+
+// buildFromSpec builds every image in a build spec file
+func buildFromSpec(filename string, b *specBuilder, parallel int, resultFile string) {
+	spec, err := readBuildSpec(filename)
+	if err != nil {
+		exitf("Failed to read build spec. %s", err)
+	}
+	b.spec = *spec
+	b.dir = filepath.Dir(filename)
+	b.cache = scratchbuild.NewLayerCache()
+
+	results := b.buildAll(parallel)
+
+	var failed int
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			fmt.Fprintf(os.Stderr, "Failed to build %s. %s\n", r.Name, r.Error)
+		}
+	}
+	if resultFile != "" {
+		if err := writeResult(resultFile, results); err != nil {
+			exitf("Failed to write build result. %s", err)
+		}
+	}
+	if failed > 0 {
+		exitf("%d of %d images failed", failed, len(results))
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+const jsonSpec = `{
+  "registries": {"eu.gcr.io": {"tokenEnv": "GCR_TOKEN"}},
+  "images": [
+    {
+      "destinations": ["eu.gcr.io/proj/app:v1.2"],
+      "platforms": ["linux/amd64", "linux/arm64"],
+      "layers": [
+        {"files": [{"src": "bin/{arch}/app", "dest": "/app", "mode": "0755"}], "uid": 65532}
+      ],
+      "config": {
+        "entrypoint": ["/app"],
+        "ports": ["8080/tcp"],
+        "onBuild": ["COPY . /src"],
+        "argsEscaped": true,
+        "healthcheck": {"test": ["CMD", "/app", "-health"], "interval": "30s"}
+      }
+    }
+  ]
+}`
+
+const yamlSpec = `
+registries:
+  eu.gcr.io:
+    tokenEnv: GCR_TOKEN
+images:
+  - destinations: [eu.gcr.io/proj/app:v1.2]
+    platforms: [linux/amd64, linux/arm64]
+    layers:
+      - files:
+          - src: "bin/{arch}/app"
+            dest: /app
+            mode: "0755"
+        uid: 65532
+    config:
+      entrypoint: [/app]
+      ports: [8080/tcp]
+      onBuild: [COPY . /src]
+      argsEscaped: true
+      healthcheck:
+        test: [CMD, /app, -health]
+        interval: 30s
+`
+
+func writeSpec(t *testing.T, name, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadBuildSpec(t *testing.T) {
+	fromJSON, err := readBuildSpec(writeSpec(t, "build.json", jsonSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML, err := readBuildSpec(writeSpec(t, "build.yaml", yamlSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Errorf("YAML spec differs from JSON spec:\n%+v\n%+v", fromYAML, fromJSON)
+	}
+
+	img := fromYAML.Images[0]
+	if img.Name != "eu.gcr.io/proj/app:v1.2" || img.Layers[0].UID != 65532 || img.Layers[0].Files[0].Mode != "0755" {
+		t.Errorf("unexpected image %+v", img)
+	}
+	config, err := img.Config.imageConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.ArgsEscaped || !reflect.DeepEqual(config.OnBuild, []string{"COPY . /src"}) {
+		t.Errorf("expected onBuild and argsEscaped to be set, got %+v", config)
+	}
+	if config.Healthcheck == nil || config.Healthcheck.Interval.String() != "30s" {
+		t.Errorf("unexpected healthcheck %+v", config.Healthcheck)
+	}
+}
+
+func TestReadBuildSpecErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "build.yml", content: "images:\n  - destinations: [a/b]\n    colour: blue\n", err: `unknown field "colour"`},
+		{name: "build.json", content: `{"images": [{"destinations": ["a/b"], "colour": "blue"}]}`, err: `unknown field "colour"`},
+		{name: "build.yaml", content: "images:\n  - name: nowhere\n", err: "image 0 (nowhere) has no destinations"},
+		{name: "build.yaml", content: "images: [\n", err: "yaml"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readBuildSpec(writeSpec(t, test.name, test.content))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestBuildAllSharesLayers(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	host := strings.TrimPrefix(r.URL, "http://")
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"ca.pem": "certificates", "one": "one", "two": "two"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spec := `
+images:
+  - destinations: [HOST/test/one:v1]
+    layers:
+      - files: [{src: ca.pem, dest: /etc/ssl/certs/ca-certificates.crt}]
+      - files: [{src: one, dest: /app}]
+    config: {entrypoint: [/app]}
+  - destinations: [HOST/test/two:v1]
+    layers:
+      - files: [{src: ca.pem, dest: /etc/ssl/certs/ca-certificates.crt}]
+      - files: [{src: two, dest: /app}]
+    config: {entrypoint: [/app]}
+`
+	filename := filepath.Join(dir, "build.yaml")
+	if err := os.WriteFile(filename, []byte(strings.ReplaceAll(spec, "HOST", host)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := readBuildSpec(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &specBuilder{spec: *s, dir: dir, cache: scratchbuild.NewLayerCache(), noLayerChecks: true}
+	results := b.buildAll(2)
+	for _, result := range results {
+		if result.Error != "" {
+			t.Fatalf("%s: %s", result.Name, result.Error)
+		}
+	}
+
+	one, two := results[0].Images[0], results[1].Images[0]
+	if one.Layers[0].Digest != two.Layers[0].Digest {
+		t.Fatal("expected the certificate layers to be the same")
+	}
+	// Two configs, two app layers and one certificate layer
+	var uploads int
+	for _, req := range r.Requests() {
+		if strings.HasPrefix(req, "PUT ") && strings.Contains(req, "/blobs/uploads/") {
+			uploads++
+		}
+	}
+	if uploads != 5 {
+		t.Errorf("expected 5 uploads, got %d", uploads)
+	}
+	for _, repo := range []string{"test/one", "test/two"} {
+		if _, ok := r.Blob(repo, one.Layers[0].Digest); !ok {
+			t.Errorf("%s is missing the certificate layer", repo)
+		}
+	}
+}
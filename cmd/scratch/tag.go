@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// tag adds tags to an existing image
+func tag(args []string) {
+	fs := flag.NewFlagSet("tag", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: scratch tag [flags] <image> <new tag>...\n\nAdds tags to an image already in a registry, without changing its digest.\n\n")
+		fs.PrintDefaults()
+	}
+	var r registryFlags
+	r.register(fs)
+	var noOverwrite, verify bool
+	fs.BoolVar(&noOverwrite, "no-overwrite", false, "Fail rather than replace a tag that already points to a different image")
+	fs.BoolVar(&verify, "verify", false, "After pushing, read the image back and check the registry holds what we sent")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, reference, err := r.client(fs.Arg(0))
+	if err != nil {
+		exitf("Failed to connect to registry. %s", err)
+	}
+
+	c.NoOverwrite = noOverwrite
+	c.Verify = verify
+
+	if _, err := c.Tag(reference, fs.Args()[1:]...); err != nil {
+		exitf("Failed to tag %s. %s", fs.Arg(0), err)
+	}
+}
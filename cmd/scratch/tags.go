@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// tags lists the tags in a repository
+func tags(args []string) {
+	fs := flag.NewFlagSet("tags", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: scratch tags [flags] <repository>\n\nLists the tags in a repository.\n\n")
+		fs.PrintDefaults()
+	}
+	var r registryFlags
+	r.registerCredentials(fs, "", "Registry")
+	var pageSize int
+	fs.IntVar(&pageSize, "n", 0, "Number of tags to fetch per request. 0 lets the registry decide")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	r.quiet = true
+
+	c, _, err := r.client(fs.Arg(0))
+	if err != nil {
+		exitf("Failed to connect to registry. %s", err)
+	}
+
+	list, err := c.ListTags(pageSize)
+	if err != nil {
+		exitf("Failed to list tags. %s", err)
+	}
+	for _, tag := range list {
+		fmt.Println(tag)
+	}
+}
@@ -0,0 +1,135 @@
+package scratchbuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+// Copy copies an image from the repository of src to the repository of dst,
+// streaming blobs from one registry to the other. reference is the tag or
+// digest of the source image. The image is pushed to each of dst's Tags, or by
+// digest if dst has no tags.
+//
+// The manifest bytes are copied exactly, so the image keeps its digest. If the
+// reference is to an index or manifest list, every manifest in it is copied
+// too. When src and dst are on the same registry, blobs are mounted from the
+// source repository rather than copied. Set dst's MountFrom to src's Name
+// before calling Auth on dst so the registry lets us do this.
+//
+// Copy returns the descriptor of the top-level manifest.
+func Copy(src *Client, reference string, dst *Client) (Descriptor, error) {
+	data, desc, err := src.GetManifest(reference)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("could not fetch manifest for %s: %w", reference, err)
+	}
+
+	tags := dst.Tags
+	if len(tags) == 0 {
+		tags = []string{desc.Digest.String()}
+	}
+	for _, tag := range tags {
+		if isDigest(tag) && tag != desc.Digest.String() {
+			return Descriptor{}, fmt.Errorf("cannot push by digest %s: the image has digest %s", tag, desc.Digest)
+		}
+	}
+	if err := dst.checkTags(tags, desc.Digest); err != nil {
+		return Descriptor{}, err
+	}
+
+	if err := dst.copyManifestContent(src, data, desc); err != nil {
+		return Descriptor{}, err
+	}
+
+	for _, tag := range tags {
+		if _, err := dst.pushManifest(desc.Digest, data, desc.MediaType, tag); err != nil {
+			return Descriptor{}, fmt.Errorf("could not send manifest for tag %s: %w", tag, err)
+		}
+	}
+
+	return desc, nil
+}
+
+// copyManifestContent copies everything a manifest refers to from src. For an
+// index this includes pushing each of the manifests it lists by digest.
+func (c *Client) copyManifestContent(src *Client, data []byte, desc Descriptor) error {
+	switch {
+	case isIndex(desc.MediaType):
+		var index Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("could not unmarshal index %s: %w", desc.Digest, err)
+		}
+		for _, m := range index.Manifests {
+			childData, childDesc, err := src.GetManifest(m.Digest.String())
+			if err != nil {
+				return fmt.Errorf("could not fetch manifest %s: %w", m.Digest, err)
+			}
+			if err := c.copyManifestContent(src, childData, childDesc); err != nil {
+				return err
+			}
+			if _, err := c.pushManifest(childDesc.Digest, childData, childDesc.MediaType, childDesc.Digest.String()); err != nil {
+				return fmt.Errorf("could not send manifest %s: %w", childDesc.Digest, err)
+			}
+		}
+
+	case isImageManifest(desc.MediaType):
+		var manifest Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("could not unmarshal manifest %s: %w", desc.Digest, err)
+		}
+		for _, blob := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+			if blob.MediaType == MediaTypeForeignLayer {
+				// Foreign layers are not held by the registry
+				continue
+			}
+			if err := c.copyBlob(src, blob); err != nil {
+				return fmt.Errorf("could not copy blob %s: %w", blob.Digest, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("manifest %s has unsupported media type %q", desc.Digest, desc.MediaType)
+	}
+	return nil
+}
+
+// copyBlob copies a blob from src, unless we already have it. If src is on the
+// same registry we try to mount the blob.
+func (c *Client) copyBlob(src *Client, desc Descriptor) error {
+	uploaded, err := c.isBlobUploaded(desc.Digest)
+	if err != nil {
+		return fmt.Errorf("could not check if blob is already uploaded: %w", err)
+	}
+	c.event(Event{Kind: EventBlobCheck, Digest: desc.Digest, Exists: uploaded})
+	if uploaded {
+		return nil
+	}
+
+	if registryFromURL(src.BaseURL) == registryFromURL(c.BaseURL) && src.Name != c.Name {
+		loc, mounted, err := c.mountBlob(desc.Digest, src.Name)
+		if err != nil {
+			return fmt.Errorf("could not mount blob: %w", err)
+		}
+		if mounted {
+			return nil
+		}
+		return c.streamBlob(src, desc, loc)
+	}
+
+	loc, err := c.getBlobUploadLocation()
+	if err != nil {
+		return fmt.Errorf("could not get location for blob upload: %w", err)
+	}
+	return c.streamBlob(src, desc, loc)
+}
+
+// streamBlob streams a blob from src to an upload location. If the upload is
+// redirected the blob is fetched from src again.
+func (c *Client) streamBlob(src *Client, desc Descriptor, loc *url.URL) error {
+	// The registry checks the digest of what we upload, so we don't need to
+	// verify it here.
+	return c.uploadBlobFrom(loc, desc.Digest, desc.Size, func() (io.ReadCloser, error) {
+		return src.getBlob(desc.Digest)
+	})
+}
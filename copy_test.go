@@ -0,0 +1,176 @@
+package scratchbuild_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestCopyBetweenRegistries(t *testing.T) {
+	from := scratchbuildtest.NewRegistry(nil)
+	defer from.Close()
+	to := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{User: "user", Password: "pass"})
+	defer to.Close()
+	result := pushApp(t, from, "test/app", "v1")
+
+	desc, err := scratchbuild.Copy(newClient(t, from, "test/app"), "v1", newClient(t, to, "copy/app", "v1", "latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != result.ManifestDigest {
+		t.Errorf("expected the copy to keep digest %s, got %s", result.ManifestDigest, desc.Digest)
+	}
+	orig, _, _ := from.Manifest("test/app", "v1")
+	for _, tag := range []string{"v1", "latest"} {
+		data, _, ok := to.Manifest("copy/app", tag)
+		if !ok || !bytes.Equal(data, orig) {
+			t.Errorf("tag %s does not have the original manifest", tag)
+		}
+	}
+	for _, l := range result.Layers {
+		if _, ok := to.Blob("copy/app", l.Digest); !ok {
+			t.Errorf("layer %s not copied", l.Digest)
+		}
+	}
+	if _, ok := to.Blob("copy/app", result.ConfigDigest); !ok {
+		t.Error("config not copied")
+	}
+}
+
+func TestCopyMountsOnSameRegistry(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	pushApp(t, r, "test/app", "v1")
+
+	if _, err := scratchbuild.Copy(newClient(t, r, "test/app"), "v1", newClient(t, r, "test/copy", "v1")); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(r, "POST /v2/test/copy/blobs/uploads/"); n != 2 {
+		t.Errorf("expected 2 mounts, got %d", n)
+	}
+	if n := countRequests(r, "PUT /v2/test/copy/blobs/uploads/"); n != 0 {
+		t.Errorf("expected blobs to be mounted rather than uploaded, got %d uploads", n)
+	}
+	if n := countRequests(r, "GET /v2/test/app/blobs/"); n != 0 {
+		t.Errorf("expected blobs not to be downloaded, got %d downloads", n)
+	}
+	if _, _, ok := r.Manifest("test/copy", "v1"); !ok {
+		t.Error("copy not tagged")
+	}
+}
+
+func TestCopyIndex(t *testing.T) {
+	from := scratchbuildtest.NewRegistry(nil)
+	defer from.Close()
+	to := scratchbuildtest.NewRegistry(nil)
+	defer to.Close()
+	result := pushApp(t, from, "test/app", "amd64")
+
+	index, err := json.Marshal(scratchbuild.Index{
+		Versioned: scratchbuild.Versioned{SchemaVersion: 2, MediaType: scratchbuild.MediaTypeOCIIndex},
+		Manifests: []scratchbuild.Descriptor{{
+			MediaType: result.MediaType,
+			Digest:    result.ManifestDigest,
+			Size:      result.ManifestSize,
+			Platform:  &scratchbuild.Platform{Architecture: "amd64", OS: "linux"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDigest := from.PutManifest("test/app", scratchbuild.MediaTypeOCIIndex, index, "v1")
+
+	// With no tags the image is pushed by digest
+	desc, err := scratchbuild.Copy(newClient(t, from, "test/app"), "v1", newClient(t, to, "test/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != indexDigest {
+		t.Errorf("unexpected digest %s", desc.Digest)
+	}
+	if _, mediaType, ok := to.Manifest("test/app", indexDigest.String()); !ok || mediaType != scratchbuild.MediaTypeOCIIndex {
+		t.Errorf("index not copied: %t %s", ok, mediaType)
+	}
+	if _, _, ok := to.Manifest("test/app", result.ManifestDigest.String()); !ok {
+		t.Error("child manifest not copied")
+	}
+	if tags := to.Tags("test/app"); len(tags) != 0 {
+		t.Errorf("expected no tags, got %v", tags)
+	}
+}
+
+func TestCopyWrongDigest(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	pushApp(t, r, "test/app", "v1")
+
+	wrong := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	if _, err := scratchbuild.Copy(newClient(t, r, "test/app"), "v1", newClient(t, r, "test/copy", wrong)); err == nil {
+		t.Error("expected an error pushing to a different digest")
+	}
+	if n := countRequests(r, "POST /v2/test/copy/"); n != 0 {
+		t.Errorf("expected nothing to be copied, got %d uploads", n)
+	}
+}
+
+func TestCopyMountsWithDifferentBaseURL(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	pushApp(t, r, "test/app", "v1")
+
+	// The base URLs differ as strings, but name the same registry
+	src := newClient(t, r, "test/app")
+	src.BaseURL = strings.Replace(src.BaseURL, "http://", "HTTP://", 1)
+	if _, err := scratchbuild.Copy(src, "v1", newClient(t, r, "test/copy", "v1")); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(r, "PUT /v2/test/copy/blobs/uploads/"); n != 0 {
+		t.Errorf("expected blobs to be mounted rather than uploaded, got %d uploads", n)
+	}
+}
+
+func TestCopyUploadFollowsRedirect(t *testing.T) {
+	from := scratchbuildtest.NewRegistry(nil)
+	defer from.Close()
+	to := scratchbuildtest.NewRegistry(nil)
+	defer to.Close()
+	result := pushApp(t, from, "test/app", "v1")
+
+	// Redirect each blob upload once. The blob can't be streamed again, so it
+	// is fetched from the source again.
+	var mu sync.Mutex
+	redirected := 0
+	to.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method != http.MethodPut || !strings.Contains(req.URL.Path, "/blobs/uploads/") || req.URL.Query().Get("redirected") != "" {
+			return false
+		}
+		mu.Lock()
+		redirected++
+		mu.Unlock()
+		u := *req.URL
+		q := u.Query()
+		q.Set("redirected", "1")
+		u.RawQuery = q.Encode()
+		http.Redirect(w, req, u.String(), http.StatusTemporaryRedirect)
+		return true
+	})
+
+	if _, err := scratchbuild.Copy(newClient(t, from, "test/app"), "v1", newClient(t, to, "copy/app", "v1")); err != nil {
+		t.Fatal(err)
+	}
+	if redirected != 2 {
+		t.Errorf("expected the layer and config uploads to be redirected, got %d redirects", redirected)
+	}
+	if n := countRequests(from, "GET /v2/test/app/blobs/"); n != 4 {
+		t.Errorf("expected each blob to be fetched twice, got %d fetches", n)
+	}
+	if _, ok := to.Blob("copy/app", result.Layers[0].Digest); !ok {
+		t.Error("layer not copied")
+	}
+}
@@ -0,0 +1,95 @@
+package scratchbuild
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// HeadManifest checks whether a manifest exists without fetching it. reference
+// is a tag or digest. If the manifest exists HeadManifest returns its
+// descriptor. If the registry does not give us the digest in a
+// Docker-Content-Digest header we fetch the manifest to find it.
+func (c *Client) HeadManifest(reference string) (desc Descriptor, exists bool, err error) {
+	u := strings.Join([]string{c.BaseURL, "v2", c.Name, "manifests", reference}, "/")
+	req, err := c.newRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return Descriptor{}, false, fmt.Errorf("could not build request: %w", err)
+	}
+	req.Header.Set("Accept", manifestAccept)
+
+	rsp, err := c.do(req)
+	if err != nil {
+		return Descriptor{}, false, fmt.Errorf("manifest check failed: %w", err)
+	}
+	defer rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		io.Copy(io.Discard, rsp.Body)
+	case http.StatusNotFound:
+		return Descriptor{}, false, nil
+	default:
+		return Descriptor{}, false, newRegistryError(rsp)
+	}
+
+	dgst, err := digest.Parse(rsp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		_, desc, err := c.GetManifest(reference)
+		if err != nil {
+			return Descriptor{}, false, err
+		}
+		return desc, true, nil
+	}
+
+	desc = Descriptor{
+		MediaType: rsp.Header.Get("Content-Type"),
+		Digest:    dgst,
+	}
+	desc.Size, _ = strconv.ParseInt(rsp.Header.Get("Content-Length"), 10, 64)
+	return desc, true, nil
+}
+
+// DeleteManifest deletes the manifest with the given digest from the
+// repository. This removes every tag that points to it. Registries that don't
+// allow deletion return an error that matches ErrUnsupported.
+func (c *Client) DeleteManifest(dgst digest.Digest) error {
+	u := strings.Join([]string{c.BaseURL, "v2", c.Name, "manifests", dgst.String()}, "/")
+	req, err := c.newRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return fmt.Errorf("could not build request: %w", err)
+	}
+
+	rsp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("manifest delete failed: %w", err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusAccepted && rsp.StatusCode != http.StatusOK {
+		return newRegistryError(rsp)
+	}
+	io.Copy(io.Discard, rsp.Body)
+	return nil
+}
+
+// DeleteTag resolves a tag to its manifest digest and deletes that manifest.
+// The registry API has no way to remove just the tag, so any other tags on the
+// same manifest are deleted too. DeleteTag returns the digest it deleted.
+func (c *Client) DeleteTag(tag string) (digest.Digest, error) {
+	desc, exists, err := c.HeadManifest(tag)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve tag %s: %w", tag, err)
+	}
+	if !exists {
+		return "", fmt.Errorf("tag %s not found", tag)
+	}
+	if err := c.DeleteManifest(desc.Digest); err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
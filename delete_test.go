@@ -0,0 +1,72 @@
+package scratchbuild_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestHeadManifest(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "v1")
+
+	c := newClient(t, r, "test/app")
+	desc, exists, err := c.HeadManifest("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || desc.Digest != result.ManifestDigest || desc.Size != result.ManifestSize {
+		t.Errorf("unexpected result %t %+v", exists, desc)
+	}
+
+	if _, exists, err := c.HeadManifest("v2"); err != nil || exists {
+		t.Errorf("expected v2 not to exist, got %t, %v", exists, err)
+	}
+}
+
+func TestDeleteTag(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "v1", "also-v1")
+	other := pushApp(t, r, "test/other", "v1")
+
+	dgst, err := newClient(t, r, "test/app").DeleteTag("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst != result.ManifestDigest {
+		t.Errorf("expected to delete %s, deleted %s", result.ManifestDigest, dgst)
+	}
+	// The other tag on the manifest goes too
+	if tags := r.Tags("test/app"); len(tags) != 0 {
+		t.Errorf("expected no tags left, got %v", tags)
+	}
+	if _, _, ok := r.Manifest("test/app", dgst.String()); ok {
+		t.Error("manifest not deleted")
+	}
+	// Other repositories are not affected
+	if _, _, ok := r.Manifest("test/other", other.ManifestDigest.String()); !ok {
+		t.Error("manifest in another repository deleted")
+	}
+
+	if _, err := newClient(t, r, "test/app").DeleteTag("v1"); err == nil {
+		t.Error("expected an error deleting a missing tag")
+	}
+}
+
+func TestDeleteManifestUnsupported(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{DisableDelete: true})
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "v1")
+
+	err := newClient(t, r, "test/app").DeleteManifest(result.ManifestDigest)
+	if !errors.Is(err, scratchbuild.ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+	if _, _, ok := r.Manifest("test/app", "v1"); !ok {
+		t.Error("manifest deleted")
+	}
+}
@@ -0,0 +1,128 @@
+package scratchbuild_test
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestDestinations(t *testing.T) {
+	main := scratchbuildtest.NewRegistry(nil)
+	defer main.Close()
+	mirror := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{User: "mirror", Password: "secret"})
+	defer mirror.Close()
+
+	// Each registry waits until the other has started, so the test only
+	// passes if the pushes happen at the same time
+	var started sync.WaitGroup
+	started.Add(2)
+	barrier := func() func(w http.ResponseWriter, req *http.Request) bool {
+		var once sync.Once
+		return func(w http.ResponseWriter, req *http.Request) bool {
+			if !strings.Contains(req.URL.Path, "/blobs/") {
+				return false
+			}
+			once.Do(func() {
+				started.Done()
+				done := make(chan struct{})
+				go func() { started.Wait(); close(done) }()
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Error("pushes did not run concurrently")
+				}
+			})
+			return false
+		}
+	}
+	main.SetHook(barrier())
+	mirror.SetHook(barrier())
+
+	c := newClient(t, main, "test/app", "v1")
+	c.Destinations = []scratchbuild.Options{mirror.ClientOptions("mirror/app", "v1", "latest")}
+	result, err := c.BuildImage(&appConfig, appLayer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Tags) != 1 || !result.Changed {
+		t.Errorf("unexpected result for the main repository %+v", result)
+	}
+	if len(result.Destinations) != 1 {
+		t.Fatalf("expected 1 destination, got %d", len(result.Destinations))
+	}
+	dest := result.Destinations[0]
+	if dest.Repository != mirror.URL[len("http://"):]+"/mirror/app" || dest.Err != nil || len(dest.Tags) != 2 {
+		t.Errorf("unexpected destination result %+v", dest)
+	}
+	for _, tag := range []string{"v1", "latest"} {
+		if _, _, ok := mirror.Manifest("mirror/app", tag); !ok {
+			t.Errorf("mirror is missing %s", tag)
+		}
+	}
+	if _, _, ok := main.Manifest("test/app", "v1"); !ok {
+		t.Error("main repository is missing v1")
+	}
+}
+
+func TestDestinationFailures(t *testing.T) {
+	main := scratchbuildtest.NewRegistry(nil)
+	defer main.Close()
+	denied := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{
+		Hook: func(w http.ResponseWriter, req *http.Request) bool {
+			if req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/manifests/") {
+				scratchbuildtest.WriteError(w, http.StatusForbidden, scratchbuild.ErrorCodeDenied, "read only")
+				return true
+			}
+			return false
+		},
+	})
+	defer denied.Close()
+	locked := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{User: "user", Password: "pass"})
+	defer locked.Close()
+	ok := scratchbuildtest.NewRegistry(nil)
+	defer ok.Close()
+
+	badLogin := locked.ClientOptions("test/app", "v1")
+	badLogin.Password = "wrong"
+	c := newClient(t, main, "test/app", "v1")
+	c.Destinations = []scratchbuild.Options{
+		denied.ClientOptions("test/app", "v1"),
+		badLogin,
+		ok.ClientOptions("test/app", "v1"),
+	}
+	result, err := c.BuildImage(&appConfig, appLayer(t))
+
+	var pushErr *scratchbuild.PushError
+	if !errors.As(err, &pushErr) {
+		t.Fatalf("expected a PushError, got %v", err)
+	}
+	if len(pushErr.Errors) != 2 {
+		t.Fatalf("expected 2 failures, got %v", pushErr)
+	}
+	if !scratchbuild.HasErrorCode(pushErr.Errors[0], scratchbuild.ErrorCodeDenied) || pushErr.Errors[0].Repository != denied.URL[len("http://"):]+"/test/app" {
+		t.Errorf("unexpected first error %v", pushErr.Errors[0])
+	}
+	if !scratchbuild.HasErrorCode(pushErr.Errors[1], scratchbuild.ErrorCodeUnauthorized) {
+		t.Errorf("unexpected second error %v", pushErr.Errors[1])
+	}
+
+	// The result still says what happened everywhere
+	if result == nil || len(result.Destinations) != 3 {
+		t.Fatalf("expected a result for each destination, got %+v", result)
+	}
+	if result.Destinations[0].Error == "" || result.Destinations[1].Error == "" || result.Destinations[2].Error != "" {
+		t.Errorf("unexpected destination results %+v", result.Destinations)
+	}
+	for _, r := range []*scratchbuildtest.Registry{main, ok} {
+		if _, _, found := r.Manifest("test/app", "v1"); !found {
+			t.Errorf("%s is missing the image", r.URL)
+		}
+	}
+}
@@ -0,0 +1,680 @@
+package scratchbuild
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dockerfile is an image described by a Dockerfile. Only images built FROM
+// scratch are supported, and only the instructions that don't need to run
+// anything: COPY, ENV, ENTRYPOINT, CMD, LABEL, EXPOSE, USER, WORKDIR, VOLUME,
+// STOPSIGNAL, HEALTHCHECK, SHELL and ONBUILD. ENTRYPOINT, CMD and HEALTHCHECK CMD
+// must use the JSON exec form, as a scratch image has no shell to run the shell
+// form.
+type Dockerfile struct {
+	// Config is the image configuration set by the Dockerfile
+	Config ImageConfig
+	// Copies lists the COPY instructions in order. Each becomes a layer.
+	Copies []DockerfileCopy
+}
+
+// DockerfileCopy is a COPY instruction from a Dockerfile
+type DockerfileCopy struct {
+	// Line is the line of the Dockerfile the instruction starts on
+	Line int
+	// Sources are the files and directories to copy, relative to the build
+	// context. They may contain wildcards.
+	Sources []string
+	// Dest is the absolute path to copy to in the image. If it ends with / the
+	// sources are copied into it.
+	Dest string
+	// UID and GID own the copied files. They are set by --chown.
+	UID, GID int
+}
+
+// ParseDockerfile parses a Dockerfile. It returns an error for instructions
+// that need a base image or need to run commands, such as RUN.
+func ParseDockerfile(r io.Reader) (*Dockerfile, error) {
+	p := dockerfileParser{env: make(map[string]string), workdir: "/"}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	var (
+		instruction strings.Builder
+		start       int
+	)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || trimmed[0] == '#' {
+			// Comments and blank lines are also skipped within continuations
+			continue
+		}
+		if instruction.Len() == 0 {
+			start = n
+		}
+		if strings.HasSuffix(trimmed, `\`) {
+			instruction.WriteString(strings.TrimSuffix(strings.TrimRight(text, " \t"), `\`))
+			continue
+		}
+		instruction.WriteString(text)
+		if err := p.instruction(start, instruction.String()); err != nil {
+			return nil, err
+		}
+		instruction.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read Dockerfile: %w", err)
+	}
+	if instruction.Len() > 0 {
+		if err := p.instruction(start, instruction.String()); err != nil {
+			return nil, err
+		}
+	}
+	if !p.from {
+		return nil, errors.New("the Dockerfile has no FROM scratch instruction")
+	}
+
+	return &p.df, nil
+}
+
+// Layers builds the uncompressed tar file for each COPY instruction. Sources are
+// relative to the build context directory. As in Docker, the working directory
+// is created if no COPY creates it; it is added in a final layer of its own.
+func (d *Dockerfile) Layers(context string) ([][]byte, error) {
+	layers := make([][]byte, 0, len(d.Copies)+1)
+	for _, cp := range d.Copies {
+		layer, err := cp.layer(context)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: COPY failed: %w", cp.Line, err)
+		}
+		layers = append(layers, layer)
+	}
+
+	if wd := d.Config.WorkingDir; wd != "" && path.Clean(wd) != "/" {
+		ix, err := indexLayers(layers)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := ix.lookup(wd); err != nil {
+			var b bytes.Buffer
+			lw := NewLayerWriter(&b)
+			if err := lw.Mkdir(wd, 0o755); err != nil {
+				return nil, err
+			}
+			if err := lw.Close(); err != nil {
+				return nil, err
+			}
+			layers = append(layers, b.Bytes())
+		}
+	}
+	return layers, nil
+}
+
+func (cp *DockerfileCopy) layer(context string) ([]byte, error) {
+	var matches []string
+	for _, src := range cp.Sources {
+		clean := filepath.Clean(filepath.FromSlash(src))
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is outside the build context", src)
+		}
+		m, err := filepath.Glob(filepath.Join(context, clean))
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", src, err)
+		}
+		if len(m) == 0 {
+			return nil, fmt.Errorf("no files match %s", src)
+		}
+		matches = append(matches, m...)
+	}
+	intoDir := strings.HasSuffix(cp.Dest, "/")
+	if len(matches) > 1 && !intoDir {
+		return nil, fmt.Errorf("when copying more than one file the destination %s must end with /", cp.Dest)
+	}
+
+	var b bytes.Buffer
+	lw := NewLayerWriter(&b)
+	lw.SetOwner(cp.UID, cp.GID)
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			return nil, err
+		}
+		dst := cp.Dest
+		if !fi.IsDir() && intoDir {
+			dst = path.Join(dst, filepath.Base(m))
+		}
+		if err := lw.AddFile(m, dst); err != nil {
+			return nil, err
+		}
+	}
+	if err := lw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// dockerfileParser holds the state built up while parsing a Dockerfile
+type dockerfileParser struct {
+	df      Dockerfile
+	from    bool
+	env     map[string]string
+	workdir string
+}
+
+// unsupportedInstructions explains why we can't handle instructions that are
+// valid in a Dockerfile
+var unsupportedInstructions = map[string]string{
+	"RUN":        "scratch images are built without running commands",
+	"ADD":        "use COPY instead",
+	"ARG":        "build arguments are not supported",
+	"MAINTAINER": "use LABEL instead",
+}
+
+func (p *dockerfileParser) instruction(line int, text string) error {
+	text = strings.TrimSpace(text)
+	name, args := text, ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		name, args = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	name = strings.ToUpper(name)
+
+	if reason, ok := unsupportedInstructions[name]; ok {
+		return fmt.Errorf("line %d: %s is not supported: %s", line, name, reason)
+	}
+	if !p.from && name != "FROM" {
+		return fmt.Errorf("line %d: the Dockerfile must start with FROM scratch", line)
+	}
+
+	var err error
+	switch name {
+	case "FROM":
+		err = p.fromInstruction(args)
+	case "COPY":
+		err = p.copyInstruction(line, args)
+	case "ENV":
+		err = p.envInstruction(args)
+	case "LABEL":
+		err = p.labelInstruction(args)
+	case "EXPOSE":
+		err = p.exposeInstruction(args)
+	case "ENTRYPOINT":
+		p.df.Config.Entrypoint, err = commandArgs(args)
+	case "CMD":
+		p.df.Config.Cmd, err = commandArgs(args)
+	case "HEALTHCHECK":
+		err = p.healthcheckInstruction(args)
+	case "SHELL":
+		shell, ok := jsonArgs(args)
+		if !ok || len(shell) == 0 {
+			err = errors.New(`expected a JSON array, e.g. ["/bin/sh", "-c"]`)
+		}
+		p.df.Config.Shell = shell
+	case "ONBUILD":
+		err = p.onbuildInstruction(args)
+	case "USER":
+		p.df.Config.User, err = p.singleWord(args)
+	case "WORKDIR":
+		var dir string
+		if dir, err = p.singleWord(args); err == nil {
+			if !path.IsAbs(dir) {
+				dir = path.Join(p.workdir, dir)
+			}
+			p.workdir = path.Clean(dir)
+			p.df.Config.WorkingDir = p.workdir
+		}
+	case "VOLUME":
+		err = p.volumeInstruction(args)
+	case "STOPSIGNAL":
+		p.df.Config.StopSignal, err = p.singleWord(args)
+	default:
+		err = errors.New("unknown instruction")
+	}
+	if err != nil {
+		return fmt.Errorf("line %d: %s: %w", line, name, err)
+	}
+	return nil
+}
+
+func (p *dockerfileParser) fromInstruction(args string) error {
+	if p.from {
+		return errors.New("multi-stage builds are not supported")
+	}
+	words, err := lexWords(args, p.env)
+	if err != nil {
+		return err
+	}
+	if len(words) > 0 && strings.HasPrefix(words[0], "--") {
+		return fmt.Errorf("flag %s is not supported", words[0])
+	}
+	if len(words) == 0 || words[0] != "scratch" {
+		return errors.New("only FROM scratch is supported")
+	}
+	if len(words) != 1 && !(len(words) == 3 && strings.EqualFold(words[1], "AS")) {
+		return errors.New("expected FROM scratch [AS name]")
+	}
+	p.from = true
+	return nil
+}
+
+func (p *dockerfileParser) copyInstruction(line int, args string) error {
+	cp := DockerfileCopy{Line: line}
+	for strings.HasPrefix(args, "--") {
+		var flag string
+		flag, args = args, ""
+		if i := strings.IndexAny(flag, " \t"); i >= 0 {
+			flag, args = flag[:i], strings.TrimSpace(flag[i+1:])
+		}
+		if !strings.HasPrefix(flag, "--chown=") {
+			return fmt.Errorf("flag %s is not supported", flag)
+		}
+		var err error
+		if cp.UID, cp.GID, err = parseChown(strings.TrimPrefix(flag, "--chown=")); err != nil {
+			return err
+		}
+	}
+
+	words, err := p.arrayOrWords(args)
+	if err != nil {
+		return err
+	}
+	if len(words) < 2 {
+		return errors.New("expected at least one source and a destination")
+	}
+	cp.Sources = words[:len(words)-1]
+	dest := words[len(words)-1]
+	if !path.IsAbs(dest) {
+		dest = path.Join(p.workdir, dest)
+		if strings.HasSuffix(words[len(words)-1], "/") || words[len(words)-1] == "." {
+			dest += "/"
+		}
+	}
+	if len(cp.Sources) > 1 && !strings.HasSuffix(dest, "/") {
+		return errors.New("when copying more than one source the destination must end with /")
+	}
+	cp.Dest = dest
+	p.df.Copies = append(p.df.Copies, cp)
+	return nil
+}
+
+// parseChown parses the value of COPY --chown. Only numeric IDs are supported
+// as there is no /etc/passwd to look names up in.
+func parseChown(s string) (uid, gid int, err error) {
+	u, g := s, s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		u, g = s[:i], s[i+1:]
+	}
+	if uid, err = strconv.Atoi(u); err != nil {
+		return 0, 0, fmt.Errorf("--chown=%s: only numeric user and group IDs are supported", s)
+	}
+	if gid, err = strconv.Atoi(g); err != nil {
+		return 0, 0, fmt.Errorf("--chown=%s: only numeric user and group IDs are supported", s)
+	}
+	return uid, gid, nil
+}
+
+func (p *dockerfileParser) envInstruction(args string) error {
+	words, err := lexWords(args, p.env)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return errors.New("expected a variable")
+	}
+	if !strings.Contains(words[0], "=") {
+		// The old ENV key value form
+		p.setEnv(words[0], strings.Join(words[1:], " "))
+		return nil
+	}
+	for _, w := range words {
+		k, v, ok := strings.Cut(w, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("expected key=value, got %q", w)
+		}
+		p.setEnv(k, v)
+	}
+	return nil
+}
+
+func (p *dockerfileParser) setEnv(k, v string) {
+	p.env[k] = v
+	kv := k + "=" + v
+	for i, e := range p.df.Config.Env {
+		if strings.HasPrefix(e, k+"=") {
+			p.df.Config.Env[i] = kv
+			return
+		}
+	}
+	p.df.Config.Env = append(p.df.Config.Env, kv)
+}
+
+func (p *dockerfileParser) labelInstruction(args string) error {
+	words, err := lexWords(args, p.env)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return errors.New("expected key=value")
+	}
+	for _, w := range words {
+		k, v, ok := strings.Cut(w, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("expected key=value, got %q", w)
+		}
+		if p.df.Config.Labels == nil {
+			p.df.Config.Labels = make(map[string]string)
+		}
+		p.df.Config.Labels[k] = v
+	}
+	return nil
+}
+
+var exposeRE = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(/(tcp|udp|sctp))?$`)
+
+func (p *dockerfileParser) exposeInstruction(args string) error {
+	words, err := lexWords(args, p.env)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return errors.New("expected a port")
+	}
+	for _, w := range words {
+		w = strings.ToLower(w)
+		if !exposeRE.MatchString(w) {
+			return fmt.Errorf("invalid port %q", w)
+		}
+		if !strings.Contains(w, "/") {
+			w += "/tcp"
+		}
+		if p.df.Config.ExposedPorts == nil {
+			p.df.Config.ExposedPorts = make(map[string]struct{})
+		}
+		p.df.Config.ExposedPorts[w] = struct{}{}
+	}
+	return nil
+}
+
+func (p *dockerfileParser) volumeInstruction(args string) error {
+	words, err := p.arrayOrWords(args)
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return errors.New("expected a path")
+	}
+	for _, w := range words {
+		if p.df.Config.Volumes == nil {
+			p.df.Config.Volumes = make(map[string]struct{})
+		}
+		p.df.Config.Volumes[w] = struct{}{}
+	}
+	return nil
+}
+
+func (p *dockerfileParser) singleWord(args string) (string, error) {
+	words, err := lexWords(args, p.env)
+	if err != nil {
+		return "", err
+	}
+	if len(words) != 1 {
+		return "", errors.New("expected a single value")
+	}
+	return words[0], nil
+}
+
+// arrayOrWords parses arguments given either as a JSON array or as words, and
+// expands variables in them
+func (p *dockerfileParser) arrayOrWords(args string) ([]string, error) {
+	if array, ok := jsonArgs(args); ok {
+		for i, a := range array {
+			var b strings.Builder
+			if err := expandVars(a, p.env, &b); err != nil {
+				return nil, err
+			}
+			array[i] = b.String()
+		}
+		return array, nil
+	}
+	return lexWords(args, p.env)
+}
+
+// commandArgs parses ENTRYPOINT, CMD and HEALTHCHECK CMD arguments, which must
+// be in the exec form, a JSON array. Docker runs the shell form with /bin/sh,
+// which an image built from scratch doesn't have.
+func commandArgs(args string) ([]string, error) {
+	if array, ok := jsonArgs(args); ok {
+		return array, nil
+	}
+	example, _ := json.Marshal(strings.Fields(args))
+	return nil, fmt.Errorf("the shell form needs a shell, which a scratch image doesn't have. Use the exec form, e.g. %s", example)
+}
+
+func (p *dockerfileParser) healthcheckInstruction(args string) error {
+	var (
+		h        HealthConfig
+		hasFlags bool
+	)
+	for strings.HasPrefix(args, "--") {
+		hasFlags = true
+		var flag string
+		flag, args = args, ""
+		if i := strings.IndexAny(flag, " \t"); i >= 0 {
+			flag, args = flag[:i], strings.TrimSpace(flag[i+1:])
+		}
+		name, value, _ := strings.Cut(flag, "=")
+		var err error
+		switch name {
+		case "--interval":
+			h.Interval, err = time.ParseDuration(value)
+		case "--timeout":
+			h.Timeout, err = time.ParseDuration(value)
+		case "--start-period":
+			h.StartPeriod, err = time.ParseDuration(value)
+		case "--retries":
+			h.Retries, err = strconv.Atoi(value)
+		default:
+			return fmt.Errorf("flag %s is not supported", name)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	kind, command := args, ""
+	if i := strings.IndexAny(args, " \t"); i >= 0 {
+		kind, command = args[:i], strings.TrimSpace(args[i+1:])
+	}
+	switch strings.ToUpper(kind) {
+	case "NONE":
+		if command != "" || hasFlags {
+			return errors.New("NONE takes no arguments or flags")
+		}
+		h.Test = []string{"NONE"}
+	case "CMD":
+		array, err := commandArgs(command)
+		if err != nil {
+			return err
+		}
+		h.Test = append([]string{"CMD"}, array...)
+	default:
+		return errors.New("expected CMD or NONE")
+	}
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	p.df.Config.Healthcheck = &h
+	return nil
+}
+
+func (p *dockerfileParser) onbuildInstruction(args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return errors.New("expected an instruction")
+	}
+	switch trigger := strings.ToUpper(fields[0]); trigger {
+	case "ONBUILD", "FROM", "MAINTAINER":
+		return fmt.Errorf("%s is not allowed as an ONBUILD trigger", trigger)
+	}
+	p.df.Config.OnBuild = append(p.df.Config.OnBuild, args)
+	return nil
+}
+
+func jsonArgs(args string) ([]string, bool) {
+	if !strings.HasPrefix(args, "[") {
+		return nil, false
+	}
+	var array []string
+	if err := json.Unmarshal([]byte(args), &array); err != nil {
+		return nil, false
+	}
+	if array == nil {
+		array = []string{}
+	}
+	return array, true
+}
+
+// lexWords splits Dockerfile arguments into words, removing quotes and
+// backslash escapes and expanding variables from env, except within single
+// quotes.
+func lexWords(s string, env map[string]string) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case ' ', '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case '\\':
+			inWord = true
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+		case '\'':
+			inWord = true
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			inWord = true
+			end := i + 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+			if err := expandVars(s[i+1:end], env, &word); err != nil {
+				return nil, err
+			}
+			i = end
+		case '$':
+			inWord = true
+			n, err := expandVar(s[i:], env, &word)
+			if err != nil {
+				return nil, err
+			}
+			i += n - 1
+		default:
+			inWord = true
+			word.WriteByte(ch)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expandVars expands the variables in a double-quoted string, also removing
+// the backslashes that escape ", \ and $
+func expandVars(s string, env map[string]string, w *strings.Builder) error {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && strings.IndexByte(`"\$`, s[i+1]) >= 0 {
+				i++
+			}
+			w.WriteByte(s[i])
+		case '$':
+			n, err := expandVar(s[i:], env, w)
+			if err != nil {
+				return err
+			}
+			i += n - 1
+		default:
+			w.WriteByte(s[i])
+		}
+	}
+	return nil
+}
+
+// expandVar expands the variable reference at the start of s, which is $NAME,
+// ${NAME}, ${NAME:-default} or ${NAME:+alternative}. It returns the number of
+// bytes of s it used.
+func expandVar(s string, env map[string]string, w *strings.Builder) (int, error) {
+	if len(s) > 1 && s[1] == '{' {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return 0, errors.New("missing } in variable reference")
+		}
+		name, word := s[2:end], ""
+		op := ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, op = name[:i], name[i:]
+			if len(op) >= 2 {
+				op, word = op[:2], op[2:]
+			}
+		}
+		v, ok := env[name]
+		switch op {
+		case "":
+		case ":-":
+			if !ok || v == "" {
+				v = word
+			}
+		case ":+":
+			if ok && v != "" {
+				v = word
+			}
+		default:
+			return 0, fmt.Errorf("unsupported variable reference %s", s[:end+1])
+		}
+		w.WriteString(v)
+		return end + 1, nil
+	}
+
+	end := 1
+	for end < len(s) && (s[end] == '_' || ('a' <= s[end] && s[end] <= 'z') || ('A' <= s[end] && s[end] <= 'Z') || ('0' <= s[end] && s[end] <= '9')) {
+		end++
+	}
+	if end == 1 {
+		w.WriteByte('$')
+		return 1, nil
+	}
+	w.WriteString(env[s[1:end]])
+	return end, nil
+}
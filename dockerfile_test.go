@@ -0,0 +1,186 @@
+package scratchbuild_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+func TestDockerfileCommands(t *testing.T) {
+	tests := []struct {
+		dockerfile string
+		entrypoint []string
+		cmd        []string
+		err        string
+	}{
+		{
+			dockerfile: `ENTRYPOINT ["/app", "-v"]` + "\n" + `CMD ["serve"]`,
+			entrypoint: []string{"/app", "-v"},
+			cmd:        []string{"serve"},
+		},
+		{
+			dockerfile: "ENTRYPOINT /app -v",
+			err:        `line 2: ENTRYPOINT: the shell form needs a shell, which a scratch image doesn't have. Use the exec form, e.g. ["/app","-v"]`,
+		},
+		{
+			dockerfile: `ENTRYPOINT ["/app"]` + "\nCMD serve",
+			err:        `line 3: CMD: the shell form needs a shell, which a scratch image doesn't have. Use the exec form, e.g. ["serve"]`,
+		},
+		{
+			// SHELL doesn't make the shell form work: there's still no shell
+			dockerfile: `SHELL ["/busybox", "sh", "-c"]` + "\nCMD serve",
+			err:        "line 3: CMD: the shell form needs a shell",
+		},
+		{
+			dockerfile: `ENTRYPOINT ["/app"]` + "\nHEALTHCHECK CMD /app -health",
+			err:        `line 3: HEALTHCHECK: the shell form needs a shell, which a scratch image doesn't have. Use the exec form, e.g. ["/app","-health"]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.dockerfile, func(t *testing.T) {
+			df, err := scratchbuild.ParseDockerfile(strings.NewReader("FROM scratch\n" + test.dockerfile + "\n"))
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(df.Config.Entrypoint, test.entrypoint) || !reflect.DeepEqual(df.Config.Cmd, test.cmd) {
+				t.Errorf("unexpected entrypoint %q and cmd %q", df.Config.Entrypoint, df.Config.Cmd)
+			}
+		})
+	}
+}
+
+func TestDockerfileLayersReproducible(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "static", "css"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"app", filepath.Join("static", "index.html"), filepath.Join("static", "css", "site.css")}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	df, err := scratchbuild.ParseDockerfile(strings.NewReader("FROM scratch\nCOPY app /srv/\nCOPY static /srv/static\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := func() [][]byte {
+		layers, err := df.Layers(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return layers
+	}
+	first := build()
+
+	// Touching the files, as a fresh checkout does, doesn't change the layers
+	later := time.Now().Add(time.Hour)
+	for _, name := range append(files, "static", filepath.Join("static", "css")) {
+		if err := os.Chtimes(filepath.Join(dir, name), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second := build()
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Errorf("layer %d changed when the file times changed", i)
+		}
+	}
+}
+
+func TestDockerfileHealthcheck(t *testing.T) {
+	tests := []struct {
+		dockerfile string
+		health     *scratchbuild.HealthConfig
+		err        string
+	}{
+		{
+			dockerfile: `HEALTHCHECK CMD ["/app", "-health"]`,
+			health:     &scratchbuild.HealthConfig{Test: []string{"CMD", "/app", "-health"}},
+		},
+		{
+			dockerfile: `HEALTHCHECK --interval=30s --timeout=5s --start-period=1m --retries=3 CMD ["/app", "-health"]`,
+			health: &scratchbuild.HealthConfig{
+				Test:     []string{"CMD", "/app", "-health"},
+				Interval: 30 * time.Second, Timeout: 5 * time.Second, StartPeriod: time.Minute, Retries: 3,
+			},
+		},
+		{
+			dockerfile: `healthcheck cmd ["/app"]`,
+			health:     &scratchbuild.HealthConfig{Test: []string{"CMD", "/app"}},
+		},
+		{
+			dockerfile: "HEALTHCHECK NONE",
+			health:     &scratchbuild.HealthConfig{Test: []string{"NONE"}},
+		},
+		{
+			// A later HEALTHCHECK replaces an earlier one
+			dockerfile: `HEALTHCHECK CMD ["/app"]` + "\nHEALTHCHECK NONE",
+			health:     &scratchbuild.HealthConfig{Test: []string{"NONE"}},
+		},
+		{
+			dockerfile: "HEALTHCHECK NONE --retries=3",
+			err:        "line 2: HEALTHCHECK: NONE takes no arguments or flags",
+		},
+		{
+			dockerfile: "HEALTHCHECK --retries=3 NONE",
+			err:        "line 2: HEALTHCHECK: NONE takes no arguments or flags",
+		},
+		{
+			dockerfile: "HEALTHCHECK CMD /app -health",
+			err:        "line 2: HEALTHCHECK: the shell form needs a shell",
+		},
+		{
+			dockerfile: "HEALTHCHECK CMD",
+			err:        "line 2: HEALTHCHECK: ",
+		},
+		{
+			dockerfile: `HEALTHCHECK RUN ["/app"]`,
+			err:        "line 2: HEALTHCHECK: expected CMD or NONE",
+		},
+		{
+			dockerfile: `HEALTHCHECK --interval=soon CMD ["/app"]`,
+			err:        "line 2: HEALTHCHECK: --interval: ",
+		},
+		{
+			dockerfile: `HEALTHCHECK --retries=-1 CMD ["/app"]`,
+			err:        "line 2: HEALTHCHECK: retries -1 must not be negative",
+		},
+		{
+			dockerfile: `HEALTHCHECK --start-interval=1s CMD ["/app"]`,
+			err:        "line 2: HEALTHCHECK: flag --start-interval is not supported",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.dockerfile, func(t *testing.T) {
+			df, err := scratchbuild.ParseDockerfile(strings.NewReader("FROM scratch\n" + test.dockerfile + "\n"))
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(df.Config.Healthcheck, test.health) {
+				t.Errorf("expected %+v, got %+v", test.health, df.Config.Healthcheck)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package scratchbuild
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// binaryInfo is what we learn from the ELF header of the program an image runs
+type binaryInfo struct {
+	// architecture and variant are in the form used for image platforms
+	architecture string
+	variant      string
+	// machine and class must match for a binary to load a library
+	machine elf.Machine
+	class   elf.Class
+	// interpreter is the dynamic loader from PT_INTERP, if any
+	interpreter string
+	// needed lists the shared libraries the binary is linked against
+	needed []string
+	// runpath lists extra directories to search for libraries
+	runpath []string
+}
+
+// dynamic reports whether the binary is dynamically linked
+func (b *binaryInfo) dynamic() bool {
+	return b.interpreter != "" || len(b.needed) > 0
+}
+
+// readBinary reads the ELF header of an executable. It returns nil if the data
+// is not an ELF file, for example if it is a script.
+func readBinary(data []byte) (*binaryInfo, error) {
+	if !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return nil, nil
+	}
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not read ELF file: %w", err)
+	}
+	defer f.Close()
+
+	b := &binaryInfo{machine: f.Machine, class: f.Class}
+	b.architecture, b.variant = elfPlatform(f)
+	if b.variant == "" {
+		b.variant = goVariant(data)
+	}
+
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		interp := make([]byte, p.Filesz)
+		if _, err := p.ReadAt(interp, 0); err != nil {
+			return nil, fmt.Errorf("could not read ELF interpreter: %w", err)
+		}
+		b.interpreter = string(bytes.TrimRight(interp, "\x00"))
+	}
+
+	if f.Section(".dynamic") != nil {
+		if b.needed, err = f.DynString(elf.DT_NEEDED); err != nil {
+			return nil, fmt.Errorf("could not read ELF dynamic section: %w", err)
+		}
+		for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+			paths, err := f.DynString(tag)
+			if err != nil {
+				return nil, fmt.Errorf("could not read ELF dynamic section: %w", err)
+			}
+			for _, p := range paths {
+				b.runpath = append(b.runpath, strings.Split(p, ":")...)
+			}
+		}
+	}
+	return b, nil
+}
+
+// elfPlatform converts the ELF machine to an architecture and variant. It
+// returns an empty architecture for machines we don't recognise.
+func elfPlatform(f *elf.File) (architecture, variant string) {
+	is64 := f.Class == elf.ELFCLASS64
+	little := f.Data == elf.ELFDATA2LSB
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "amd64", ""
+	case elf.EM_386:
+		return "386", ""
+	case elf.EM_AARCH64:
+		return "arm64", ""
+	case elf.EM_ARM:
+		return "arm", armVariant(f)
+	case elf.EM_RISCV:
+		if is64 {
+			return "riscv64", ""
+		}
+	case elf.EM_PPC64:
+		if little {
+			return "ppc64le", ""
+		}
+		return "ppc64", ""
+	case elf.EM_S390:
+		if is64 {
+			return "s390x", ""
+		}
+	case elf.EM_MIPS:
+		arch := "mips"
+		if is64 {
+			arch = "mips64"
+		}
+		if little {
+			arch += "le"
+		}
+		return arch, ""
+	}
+	return "", ""
+}
+
+// goVariant finds the CPU variant a Go binary was built for from the GOARM or
+// GOAMD64 setting recorded in it. It returns an empty string for other
+// binaries, and for amd64 v1 which has no variant.
+func goVariant(data []byte) string {
+	info, err := buildinfo.Read(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "GOARM":
+			// The value may have a suffix, e.g. 7,softfloat
+			v, _, _ := strings.Cut(s.Value, ",")
+			return "v" + v
+		case "GOAMD64":
+			if s.Value != "v1" {
+				return s.Value
+			}
+		}
+	}
+	return ""
+}
+
+// armVariant finds the ARM architecture version from the Tag_CPU_arch build
+// attribute. It returns an empty string if the binary does not record it.
+func armVariant(f *elf.File) string {
+	s := f.Section(".ARM.attributes")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil || len(data) < 1 || data[0] != 'A' {
+		return ""
+	}
+	data = data[1:]
+
+	// The attributes are in vendor subsections. We want the file attributes
+	// in the "aeabi" subsection.
+	for len(data) >= 4 {
+		size := f.ByteOrder.Uint32(data)
+		if size < 4 || int(size) > len(data) {
+			return ""
+		}
+		sub := data[4:size]
+		data = data[size:]
+		vendor, rest, ok := bytes.Cut(sub, []byte{0})
+		if !ok || string(vendor) != "aeabi" {
+			continue
+		}
+		for len(rest) >= 5 {
+			tag, size := rest[0], f.ByteOrder.Uint32(rest[1:])
+			if size < 5 || int(size) > len(rest) {
+				return ""
+			}
+			attrs := rest[5:size]
+			rest = rest[size:]
+			if tag == 1 {
+				return armVariantFromAttributes(attrs)
+			}
+		}
+	}
+	return ""
+}
+
+// armVariantFromAttributes scans file attributes for Tag_CPU_arch
+func armVariantFromAttributes(attrs []byte) string {
+	const tagCPUArch = 6
+	for len(attrs) > 0 {
+		tag, n := binary.Uvarint(attrs)
+		if n <= 0 {
+			return ""
+		}
+		attrs = attrs[n:]
+		// Tags 4, 5 and 67, and odd tags above 32, have string values. Tag 32
+		// has a number then a string. The rest have numbers.
+		if tag == 32 {
+			if _, n := binary.Uvarint(attrs); n > 0 {
+				attrs = attrs[n:]
+			}
+		}
+		if tag == 4 || tag == 5 || tag == 67 || (tag >= 32 && tag%2 == 1) || tag == 32 {
+			_, rest, ok := bytes.Cut(attrs, []byte{0})
+			if !ok {
+				return ""
+			}
+			attrs = rest
+			continue
+		}
+		value, n := binary.Uvarint(attrs)
+		if n <= 0 {
+			return ""
+		}
+		attrs = attrs[n:]
+		if tag != tagCPUArch {
+			continue
+		}
+		switch {
+		case value >= 3 && value <= 5:
+			return "v5"
+		case value >= 6 && value <= 9:
+			return "v6"
+		case value == 10:
+			return "v7"
+		case value >= 14:
+			return "v8"
+		}
+		return ""
+	}
+	return ""
+}
+
+// multiarchTriplets are the Debian multiarch library directory names for each
+// architecture
+var multiarchTriplets = map[string][]string{
+	"amd64":   {"x86_64-linux-gnu"},
+	"386":     {"i386-linux-gnu"},
+	"arm64":   {"aarch64-linux-gnu"},
+	"arm":     {"arm-linux-gnueabihf", "arm-linux-gnueabi"},
+	"riscv64": {"riscv64-linux-gnu"},
+	"ppc64le": {"powerpc64le-linux-gnu"},
+	"s390x":   {"s390x-linux-gnu"},
+}
+
+// libraryDirs lists the directories the dynamic loader searches for the
+// binary's libraries, in order. origin is the directory containing the binary,
+// which replaces $ORIGIN in its RUNPATH. If origin is empty RUNPATH entries
+// using $ORIGIN are skipped.
+func libraryDirs(b *binaryInfo, origin string, ldLibraryPath []string) []string {
+	var dirs []string
+	for _, dir := range b.runpath {
+		if origin == "" && strings.Contains(dir, "ORIGIN") {
+			continue
+		}
+		dir = strings.NewReplacer("${ORIGIN}", origin, "$ORIGIN", origin).Replace(dir)
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, ldLibraryPath...)
+	for _, triplet := range multiarchTriplets[b.architecture] {
+		dirs = append(dirs, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+	if strings.HasSuffix(b.architecture, "64") || b.architecture == "s390x" || b.architecture == "ppc64le" {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+	return append(dirs, "/lib", "/usr/lib", "/usr/local/lib")
+}
@@ -0,0 +1,422 @@
+package scratchbuild
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// elfSpec describes a small ELF file for tests. It has just the headers and
+// sections we read.
+type elfSpec struct {
+	class   elf.Class
+	data    elf.Data
+	machine elf.Machine
+	// interp adds a PT_INTERP program header
+	interp string
+	// needed and runpath add a dynamic section
+	needed  []string
+	runpath string
+	// armAttributes is the content of an .ARM.attributes section
+	armAttributes []byte
+}
+
+type elfSection struct {
+	name    string
+	typ     elf.SectionType
+	data    []byte
+	link    uint32
+	entsize uint64
+}
+
+// shtARMAttributes is the section type of .ARM.attributes
+const shtARMAttributes = elf.SectionType(0x70000003)
+
+// buildELF builds an ELF executable from a spec
+func buildELF(t *testing.T, s elfSpec) []byte {
+	t.Helper()
+	var order binary.ByteOrder = binary.LittleEndian
+	if s.data == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	is64 := s.class == elf.ELFCLASS64
+
+	sections := []elfSection{{}, {name: ".shstrtab", typ: elf.SHT_STRTAB}}
+	if s.interp != "" {
+		sections = append(sections, elfSection{name: ".interp", typ: elf.SHT_PROGBITS, data: append([]byte(s.interp), 0)})
+	}
+	if len(s.needed) > 0 || s.runpath != "" {
+		dynstr := []byte{0}
+		var dyn bytes.Buffer
+		addDyn := func(tag elf.DynTag, value string) {
+			offset := uint64(len(dynstr))
+			dynstr = append(append(dynstr, value...), 0)
+			if is64 {
+				binary.Write(&dyn, order, elf.Dyn64{Tag: int64(tag), Val: offset})
+			} else {
+				binary.Write(&dyn, order, elf.Dyn32{Tag: int32(tag), Val: uint32(offset)})
+			}
+		}
+		for _, lib := range s.needed {
+			addDyn(elf.DT_NEEDED, lib)
+		}
+		if s.runpath != "" {
+			addDyn(elf.DT_RUNPATH, s.runpath)
+		}
+		if is64 {
+			binary.Write(&dyn, order, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+		} else {
+			binary.Write(&dyn, order, elf.Dyn32{Tag: int32(elf.DT_NULL)})
+		}
+		entsize := uint64(8)
+		if is64 {
+			entsize = 16
+		}
+		sections = append(sections,
+			elfSection{name: ".dynstr", typ: elf.SHT_STRTAB, data: dynstr},
+			elfSection{name: ".dynamic", typ: elf.SHT_DYNAMIC, data: dyn.Bytes(), link: uint32(len(sections)), entsize: entsize},
+		)
+	}
+	if s.armAttributes != nil {
+		sections = append(sections, elfSection{name: ".ARM.attributes", typ: shtARMAttributes, data: s.armAttributes})
+	}
+
+	shstrtab := []byte{0}
+	names := make([]uint32, len(sections))
+	for i := range sections[1:] {
+		names[i+1] = uint32(len(shstrtab))
+		shstrtab = append(append(shstrtab, sections[i+1].name...), 0)
+	}
+	sections[1].data = shstrtab
+
+	ehsize, phentsize, shentsize := 52, 32, 40
+	if is64 {
+		ehsize, phentsize, shentsize = 64, 56, 64
+	}
+	phnum := 0
+	if s.interp != "" {
+		phnum = 1
+	}
+
+	// Section contents follow the headers, then the section header table
+	offset := ehsize + phnum*phentsize
+	offsets := make([]int, len(sections))
+	for i, sec := range sections[1:] {
+		offsets[i+1] = offset
+		offset += (len(sec.data) + 7) &^ 7
+	}
+	shoff := offset
+
+	var b bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(s.class), byte(s.data), byte(elf.EV_CURRENT)}
+	if is64 {
+		binary.Write(&b, order, elf.Header64{
+			Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(s.machine), Version: uint32(elf.EV_CURRENT),
+			Phoff: uint64(ehsize), Shoff: uint64(shoff), Ehsize: uint16(ehsize),
+			Phentsize: uint16(phentsize), Phnum: uint16(phnum), Shentsize: uint16(shentsize),
+			Shnum: uint16(len(sections)), Shstrndx: 1,
+		})
+	} else {
+		binary.Write(&b, order, elf.Header32{
+			Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(s.machine), Version: uint32(elf.EV_CURRENT),
+			Phoff: uint32(ehsize), Shoff: uint32(shoff), Ehsize: uint16(ehsize),
+			Phentsize: uint16(phentsize), Phnum: uint16(phnum), Shentsize: uint16(shentsize),
+			Shnum: uint16(len(sections)), Shstrndx: 1,
+		})
+	}
+	if s.interp != "" {
+		off, size := uint64(offsets[2]), uint64(len(sections[2].data))
+		if is64 {
+			binary.Write(&b, order, elf.Prog64{Type: uint32(elf.PT_INTERP), Flags: uint32(elf.PF_R), Off: off, Filesz: size, Memsz: size, Align: 1})
+		} else {
+			binary.Write(&b, order, elf.Prog32{Type: uint32(elf.PT_INTERP), Flags: uint32(elf.PF_R), Off: uint32(off), Filesz: uint32(size), Memsz: uint32(size), Align: 1})
+		}
+	}
+	for i, sec := range sections[1:] {
+		b.Write(sec.data)
+		b.Write(make([]byte, offsets[i+1]+((len(sec.data)+7)&^7)-b.Len()))
+	}
+	for i, sec := range sections {
+		if is64 {
+			binary.Write(&b, order, elf.Section64{
+				Name: names[i], Type: uint32(sec.typ), Off: uint64(offsets[i]), Size: uint64(len(sec.data)),
+				Link: sec.link, Addralign: 1, Entsize: sec.entsize,
+			})
+		} else {
+			binary.Write(&b, order, elf.Section32{
+				Name: names[i], Type: uint32(sec.typ), Off: uint32(offsets[i]), Size: uint32(len(sec.data)),
+				Link: sec.link, Addralign: 1, Entsize: uint32(sec.entsize),
+			})
+		}
+	}
+	return b.Bytes()
+}
+
+// armAttributes builds an .ARM.attributes section with file attributes in the
+// aeabi subsection
+func armAttributes(attrs ...byte) []byte {
+	file := append([]byte{1, 0, 0, 0, 0}, attrs...)
+	binary.LittleEndian.PutUint32(file[1:], uint32(len(file)))
+	sub := append([]byte{0, 0, 0, 0}, "aeabi\x00"...)
+	sub = append(sub, file...)
+	binary.LittleEndian.PutUint32(sub, uint32(len(sub)))
+	// A subsection from another vendor comes first, to be skipped
+	other := append([]byte{0, 0, 0, 0}, "gnu\x00\x01"...)
+	binary.LittleEndian.PutUint32(other, uint32(len(other)))
+	return append(append([]byte{'A'}, other...), sub...)
+}
+
+func TestReadBinaryPlatform(t *testing.T) {
+	const (
+		le  = elf.ELFDATA2LSB
+		be  = elf.ELFDATA2MSB
+		c32 = elf.ELFCLASS32
+		c64 = elf.ELFCLASS64
+	)
+	// Tag_CPU_name "7-A", Tag_conformance "2.09", then Tag_CPU_arch
+	cpuArch := func(v byte) []byte {
+		return armAttributes(append(append([]byte{5}, "7-A\x00"...), append(append([]byte{67}, "2.09\x00"...), 6, v)...)...)
+	}
+
+	tests := []struct {
+		name         string
+		spec         elfSpec
+		architecture string
+		variant      string
+	}{
+		{name: "amd64", spec: elfSpec{class: c64, data: le, machine: elf.EM_X86_64}, architecture: "amd64"},
+		{name: "386", spec: elfSpec{class: c32, data: le, machine: elf.EM_386}, architecture: "386"},
+		{name: "arm64", spec: elfSpec{class: c64, data: le, machine: elf.EM_AARCH64}, architecture: "arm64"},
+		{name: "arm without attributes", spec: elfSpec{class: c32, data: le, machine: elf.EM_ARM}, architecture: "arm"},
+		{name: "armv5", spec: elfSpec{class: c32, data: le, machine: elf.EM_ARM, armAttributes: cpuArch(4)}, architecture: "arm", variant: "v5"},
+		{name: "armv6", spec: elfSpec{class: c32, data: le, machine: elf.EM_ARM, armAttributes: cpuArch(6)}, architecture: "arm", variant: "v6"},
+		{name: "armv7", spec: elfSpec{class: c32, data: le, machine: elf.EM_ARM, armAttributes: cpuArch(10)}, architecture: "arm", variant: "v7"},
+		{name: "armv8", spec: elfSpec{class: c32, data: le, machine: elf.EM_ARM, armAttributes: cpuArch(14)}, architecture: "arm", variant: "v8"},
+		{name: "arm truncated attributes", spec: elfSpec{class: c32, data: le, machine: elf.EM_ARM, armAttributes: []byte{'A', 0xff, 0, 0, 0}}, architecture: "arm"},
+		{name: "riscv64", spec: elfSpec{class: c64, data: le, machine: elf.EM_RISCV}, architecture: "riscv64"},
+		{name: "riscv32", spec: elfSpec{class: c32, data: le, machine: elf.EM_RISCV}},
+		{name: "ppc64le", spec: elfSpec{class: c64, data: le, machine: elf.EM_PPC64}, architecture: "ppc64le"},
+		{name: "ppc64", spec: elfSpec{class: c64, data: be, machine: elf.EM_PPC64}, architecture: "ppc64"},
+		{name: "s390x", spec: elfSpec{class: c64, data: be, machine: elf.EM_S390}, architecture: "s390x"},
+		{name: "mips", spec: elfSpec{class: c32, data: be, machine: elf.EM_MIPS}, architecture: "mips"},
+		{name: "mipsle", spec: elfSpec{class: c32, data: le, machine: elf.EM_MIPS}, architecture: "mipsle"},
+		{name: "mips64le", spec: elfSpec{class: c64, data: le, machine: elf.EM_MIPS}, architecture: "mips64le"},
+		{name: "unknown", spec: elfSpec{class: c64, data: be, machine: elf.EM_SPARCV9}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := readBinary(buildELF(t, test.spec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.architecture != test.architecture || b.variant != test.variant {
+				t.Errorf("expected %s %s, got %s %s", test.architecture, test.variant, b.architecture, b.variant)
+			}
+			if b.machine != test.spec.machine || b.class != test.spec.class || b.dynamic() {
+				t.Errorf("unexpected binary %+v", b)
+			}
+		})
+	}
+}
+
+func TestReadBinaryNotELF(t *testing.T) {
+	b, err := readBinary([]byte("#!/bin/sh\necho hello\n"))
+	if b != nil || err != nil {
+		t.Errorf("expected nothing for a script, got %+v, %v", b, err)
+	}
+	if _, err := readBinary([]byte(elf.ELFMAG + "\x02\x01")); err == nil {
+		t.Error("expected an error for a truncated ELF file")
+	}
+}
+
+func TestReadBinaryStatic(t *testing.T) {
+	// testdata/app is a statically linked Go program for amd64
+	data, err := os.ReadFile("testdata/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.architecture != "amd64" || b.dynamic() {
+		t.Errorf("unexpected binary %+v", b)
+	}
+}
+
+func TestReadBinaryDynamic(t *testing.T) {
+	data := buildELF(t, elfSpec{
+		class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, machine: elf.EM_AARCH64,
+		interp:  "/lib/ld-linux-aarch64.so.1",
+		needed:  []string{"libc.so.6", "libfoo.so.1"},
+		runpath: "$ORIGIN/../lib:/opt/foo/lib",
+	})
+	b, err := readBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.dynamic() || b.interpreter != "/lib/ld-linux-aarch64.so.1" {
+		t.Errorf("unexpected binary %+v", b)
+	}
+	if !reflect.DeepEqual(b.needed, []string{"libc.so.6", "libfoo.so.1"}) {
+		t.Errorf("unexpected needed libraries %q", b.needed)
+	}
+	if !reflect.DeepEqual(b.runpath, []string{"$ORIGIN/../lib", "/opt/foo/lib"}) {
+		t.Errorf("unexpected runpath %q", b.runpath)
+	}
+
+	want := []string{
+		"/app/bin/../lib", "/opt/foo/lib", "/env/lib",
+		"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu",
+		"/lib64", "/usr/lib64", "/lib", "/usr/lib", "/usr/local/lib",
+	}
+	if dirs := libraryDirs(b, "/app/bin", []string{"/env/lib"}); !reflect.DeepEqual(dirs, want) {
+		t.Errorf("unexpected library directories %q", dirs)
+	}
+	// Without an origin, $ORIGIN entries are skipped
+	if dirs := libraryDirs(b, "", nil); dirs[0] != "/opt/foo/lib" {
+		t.Errorf("unexpected library directories %q", dirs)
+	}
+}
+
+func TestGoVariant(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds Go programs")
+	}
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/variant\n\ngo 1.18\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		env          []string
+		architecture string
+		variant      string
+	}{
+		{env: []string{"GOARCH=arm", "GOARM=5"}, architecture: "arm", variant: "v5"},
+		{env: []string{"GOARCH=arm", "GOARM=7"}, architecture: "arm", variant: "v7"},
+		{env: []string{"GOARCH=arm64"}, architecture: "arm64"},
+		{env: []string{"GOARCH=amd64", "GOAMD64=v1"}, architecture: "amd64"},
+		{env: []string{"GOARCH=amd64", "GOAMD64=v3"}, architecture: "amd64", variant: "v3"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.env, " "), func(t *testing.T) {
+			out := filepath.Join(dir, "app")
+			cmd := exec.Command(goCmd, "build", "-o", out, ".")
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "GOOS=linux", "CGO_ENABLED=0", "GOFLAGS=", "GOTOOLCHAIN=local")
+			cmd.Env = append(cmd.Env, test.env...)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("build failed: %s\n%s", err, output)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := readBinary(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.architecture != test.architecture || b.variant != test.variant {
+				t.Errorf("expected %s %s, got %s %s", test.architecture, test.variant, b.architecture, b.variant)
+			}
+		})
+	}
+}
+
+func TestCheckBinary(t *testing.T) {
+	arm64 := buildELF(t, elfSpec{class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, machine: elf.EM_AARCH64})
+	dynamic := buildELF(t, elfSpec{
+		class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, machine: elf.EM_X86_64,
+		interp:  "/lib64/ld-linux-x86-64.so.2",
+		needed:  []string{"libc.so.6", "libapp.so"},
+		runpath: "$ORIGIN/lib",
+	})
+
+	tests := []struct {
+		name     string
+		config   ImageConfig
+		entries  []tarEntry
+		platform string
+		err      string
+	}{
+		{
+			name:     "matching architecture",
+			config:   ImageConfig{Entrypoint: []string{"/app"}},
+			entries:  []tarEntry{file("app", 0o755, string(arm64))},
+			platform: "arm64",
+		},
+		{
+			name:     "wrong architecture",
+			config:   ImageConfig{Entrypoint: []string{"/app"}},
+			entries:  []tarEntry{file("app", 0o755, string(arm64))},
+			platform: "amd64",
+			err:      "Entrypoint[0]: /app is built for arm64 but the image is for amd64",
+		},
+		{
+			name:     "missing libraries",
+			config:   ImageConfig{Entrypoint: []string{"/srv/app"}},
+			entries:  []tarEntry{dir("srv"), file("srv/app", 0o755, string(dynamic))},
+			platform: "amd64",
+			err:      "Entrypoint[0]: /srv/app is dynamically linked and needs /lib64/ld-linux-x86-64.so.2, libc.so.6, libapp.so, which the image does not contain",
+		},
+		{
+			name:   "libraries present",
+			config: ImageConfig{Entrypoint: []string{"/srv/app"}},
+			entries: []tarEntry{
+				dir("lib64"), file("lib64/ld-linux-x86-64.so.2", 0o755, "loader"),
+				dir("lib"), dir("lib/x86_64-linux-gnu"), file("lib/x86_64-linux-gnu/libc.so.6", 0o755, "libc"),
+				dir("srv"), file("srv/app", 0o755, string(dynamic)),
+				// Found through RUNPATH $ORIGIN/lib
+				dir("srv/lib"), file("srv/lib/libapp.so", 0o755, "libapp"),
+			},
+			platform: "amd64",
+		},
+		{
+			name:   "library on LD_LIBRARY_PATH",
+			config: ImageConfig{Entrypoint: []string{"/srv/app"}, Env: []string{"LD_LIBRARY_PATH=/opt/lib"}},
+			entries: []tarEntry{
+				dir("lib64"), file("lib64/ld-linux-x86-64.so.2", 0o755, "loader"),
+				dir("usr"), dir("usr/lib"), file("usr/lib/libc.so.6", 0o755, "libc"),
+				dir("srv"), file("srv/app", 0o755, string(dynamic)),
+				dir("opt"), dir("opt/lib"), file("opt/lib/libapp.so", 0o755, "libapp"),
+			},
+			platform: "amd64",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ix, err := indexLayers([][]byte{testLayer(t, test.entries...)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ix.check(&test.config, Platform{OS: "linux", Architecture: test.platform}, ix.program(&test.config))
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) || len(configErr.Errors) != 1 || !strings.HasPrefix(configErr.Errors[0].Error(), test.err) {
+				t.Errorf("expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package scratchbuild
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ErrorCode is an error code returned by a registry, as defined by the OCI
+// distribution specification
+type ErrorCode string
+
+// These are the error codes defined by the OCI distribution specification, plus
+// TOOMANYREQUESTS which is returned by Docker Hub when rate limiting.
+const (
+	ErrorCodeBlobUnknown         ErrorCode = "BLOB_UNKNOWN"
+	ErrorCodeBlobUploadInvalid   ErrorCode = "BLOB_UPLOAD_INVALID"
+	ErrorCodeBlobUploadUnknown   ErrorCode = "BLOB_UPLOAD_UNKNOWN"
+	ErrorCodeDigestInvalid       ErrorCode = "DIGEST_INVALID"
+	ErrorCodeManifestBlobUnknown ErrorCode = "MANIFEST_BLOB_UNKNOWN"
+	ErrorCodeManifestInvalid     ErrorCode = "MANIFEST_INVALID"
+	ErrorCodeManifestUnknown     ErrorCode = "MANIFEST_UNKNOWN"
+	ErrorCodeNameInvalid         ErrorCode = "NAME_INVALID"
+	ErrorCodeNameUnknown         ErrorCode = "NAME_UNKNOWN"
+	ErrorCodeSizeInvalid         ErrorCode = "SIZE_INVALID"
+	ErrorCodeUnauthorized        ErrorCode = "UNAUTHORIZED"
+	ErrorCodeDenied              ErrorCode = "DENIED"
+	ErrorCodeUnsupported         ErrorCode = "UNSUPPORTED"
+	ErrorCodeTooManyRequests     ErrorCode = "TOOMANYREQUESTS"
+)
+
+// ErrUnsupported matches, using errors.Is, a RegistryError that says the
+// registry does not support an operation. Many registries don't support
+// deletion, for example.
+var ErrUnsupported = errors.New("operation not supported by registry")
+
+// TagExistsError is returned when Options.NoOverwrite is set and a tag already
+// points to a different image
+type TagExistsError struct {
+	// Repository is the fully-qualified repository name
+	Repository string
+	// Tag is the tag that already exists
+	Tag string
+	// Existing is the digest the tag points to
+	Existing digest.Digest
+	// Digest is the digest we wanted to push
+	Digest digest.Digest
+}
+
+// Error implements the error interface
+func (e *TagExistsError) Error() string {
+	return fmt.Sprintf("tag %s:%s already exists with digest %s, refusing to overwrite it with %s", e.Repository, e.Tag, e.Existing, e.Digest)
+}
+
+// DestinationError reports a failure to push an image to one repository
+type DestinationError struct {
+	// Repository is the fully-qualified repository name
+	Repository string
+	// Err is the reason the push failed
+	Err error
+}
+
+// Error implements the error interface
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Repository, e.Err)
+}
+
+// Unwrap returns the reason the push failed
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// PushError is returned by BuildImage when pushing to some of
+// Options.Destinations fails. The image may have been pushed to the others.
+type PushError struct {
+	// Errors has an entry for each repository the push failed for
+	Errors []*DestinationError
+}
+
+// Error implements the error interface
+func (e *PushError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("failed to push to %d repositories: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// ErrorInfo is a single error from the body of a registry error response
+type ErrorInfo struct {
+	// Code is the error code, e.g. BLOB_UNKNOWN
+	Code ErrorCode `json:"code"`
+	// Message is a human readable description of the error
+	Message string `json:"message,omitempty"`
+	// Detail is unstructured additional information about the error
+	Detail json.RawMessage `json:"detail,omitempty"`
+}
+
+// RegistryError is returned when a registry responds with an unexpected status.
+// Use errors.As to retrieve it and examine the error codes.
+type RegistryError struct {
+	// Method is the HTTP method of the failed request
+	Method string
+	// URL is the URL of the failed request. The query string is removed as it
+	// may contain credentials or upload state.
+	URL string
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+	// Status is the HTTP status of the response, e.g. "404 Not Found"
+	Status string
+	// Errors are the errors listed in the response body. This is empty if the
+	// body did not contain distribution errors.
+	Errors []ErrorInfo
+	// Body is the start of the response body if it could not be parsed as
+	// distribution errors
+	Body string
+	// RetryAfter is the delay requested by the registry in a Retry-After
+	// header, if any
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface
+func (e *RegistryError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s: unexpected status %s", e.Method, e.URL, e.Status)
+	for i, info := range e.Errors {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+		b.WriteString(string(info.Code))
+		if info.Message != "" {
+			b.WriteString(": ")
+			b.WriteString(info.Message)
+		}
+	}
+	if len(e.Errors) == 0 && e.Body != "" {
+		b.WriteString(". ")
+		b.WriteString(e.Body)
+	}
+	return b.String()
+}
+
+// HasCode reports whether the registry returned the given error code
+func (e *RegistryError) HasCode(code ErrorCode) bool {
+	for _, info := range e.Errors {
+		if info.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Is lets errors.Is(err, ErrUnsupported) detect registries responding 405
+// Method Not Allowed or with the UNSUPPORTED error code
+func (e *RegistryError) Is(target error) bool {
+	return target == ErrUnsupported && (e.StatusCode == http.StatusMethodNotAllowed || e.HasCode(ErrorCodeUnsupported))
+}
+
+// Temporary reports whether the request may succeed if retried later, for
+// example because the registry is rate limiting us
+func (e *RegistryError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return e.HasCode(ErrorCodeTooManyRequests)
+}
+
+// HasErrorCode reports whether err is, or wraps, a RegistryError with the given
+// error code
+func HasErrorCode(err error, code ErrorCode) bool {
+	var regErr *RegistryError
+	return errors.As(err, &regErr) && regErr.HasCode(code)
+}
+
+// maxErrorBody limits how much of an error response body we read
+const maxErrorBody = 64 * 1024
+
+// newRegistryError builds a RegistryError from an unexpected response. It reads
+// the response body but does not close it.
+func newRegistryError(rsp *http.Response) error {
+	e := &RegistryError{
+		StatusCode: rsp.StatusCode,
+		Status:     rsp.Status,
+	}
+	if req := rsp.Request; req != nil {
+		e.Method = req.Method
+		u := *req.URL
+		u.RawQuery = ""
+		u.User = nil
+		e.URL = u.String()
+	}
+	if secs, err := strconv.Atoi(rsp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, maxErrorBody))
+	if err != nil {
+		e.Body = fmt.Sprintf("failed to read response body: %s", err)
+		return e
+	}
+
+	var errs struct {
+		Errors []ErrorInfo `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &errs); err == nil && len(errs.Errors) > 0 {
+		e.Errors = errs.Errors
+	} else {
+		e.Body = strings.TrimSpace(string(body))
+		if len(e.Body) > 512 {
+			e.Body = e.Body[:512] + "..."
+		}
+	}
+	return e
+}
@@ -0,0 +1,107 @@
+package scratchbuild_test
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestRegistryErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+		check func(t *testing.T, err error, regErr *scratchbuild.RegistryError)
+	}{
+		{
+			name: "distribution errors",
+			write: func(w http.ResponseWriter) {
+				scratchbuildtest.WriteError(w, http.StatusForbidden, scratchbuild.ErrorCodeDenied, "no write access")
+			},
+			check: func(t *testing.T, err error, regErr *scratchbuild.RegistryError) {
+				if regErr.StatusCode != http.StatusForbidden || regErr.Status != "403 Forbidden" {
+					t.Errorf("unexpected status %d %q", regErr.StatusCode, regErr.Status)
+				}
+				if len(regErr.Errors) != 1 || regErr.Errors[0].Code != scratchbuild.ErrorCodeDenied || regErr.Errors[0].Message != "no write access" {
+					t.Errorf("unexpected errors %+v", regErr.Errors)
+				}
+				if regErr.Body != "" || regErr.Temporary() || errors.Is(err, scratchbuild.ErrUnsupported) {
+					t.Errorf("unexpected error %#v", regErr)
+				}
+				if !strings.HasSuffix(err.Error(), "unexpected status 403 Forbidden: DENIED: no write access") {
+					t.Errorf("unexpected message %q", err)
+				}
+			},
+		},
+		{
+			name: "not distribution errors",
+			write: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte("<html>bad gateway</html>\n"))
+			},
+			check: func(t *testing.T, err error, regErr *scratchbuild.RegistryError) {
+				if len(regErr.Errors) != 0 || regErr.Body != "<html>bad gateway</html>" {
+					t.Errorf("unexpected error %#v", regErr)
+				}
+				if !regErr.Temporary() {
+					t.Error("expected a bad gateway to be temporary")
+				}
+			},
+		},
+		{
+			name: "rate limited",
+			write: func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "7")
+				scratchbuildtest.WriteError(w, http.StatusTooManyRequests, scratchbuild.ErrorCodeTooManyRequests, "slow down")
+			},
+			check: func(t *testing.T, err error, regErr *scratchbuild.RegistryError) {
+				if regErr.RetryAfter != 7*time.Second || !regErr.Temporary() {
+					t.Errorf("unexpected error %#v", regErr)
+				}
+				if !scratchbuild.HasErrorCode(err, scratchbuild.ErrorCodeTooManyRequests) {
+					t.Error("expected TOOMANYREQUESTS")
+				}
+			},
+		},
+		{
+			name: "unsupported",
+			write: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			},
+			check: func(t *testing.T, err error, regErr *scratchbuild.RegistryError) {
+				if !errors.Is(err, scratchbuild.ErrUnsupported) {
+					t.Errorf("expected ErrUnsupported, got %v", err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := scratchbuildtest.NewRegistry(nil)
+			defer r.Close()
+			r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+				if req.Method == http.MethodPost && strings.Contains(req.URL.Path, "/blobs/uploads/") {
+					test.write(w)
+					return true
+				}
+				return false
+			})
+
+			c := newClient(t, r, "test/app", "latest")
+			_, err := c.BuildImage(&appConfig, appLayer(t))
+			var regErr *scratchbuild.RegistryError
+			if !errors.As(err, &regErr) {
+				t.Fatalf("expected a RegistryError, got %v", err)
+			}
+			if regErr.Method != http.MethodPost || regErr.URL != r.URL+"/v2/test/app/blobs/uploads/" {
+				t.Errorf("unexpected request %s %s", regErr.Method, regErr.URL)
+			}
+			test.check(t, err, regErr)
+		})
+	}
+}
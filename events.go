@@ -0,0 +1,99 @@
+package scratchbuild
+
+import (
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// EventKind identifies what an Event reports
+type EventKind int
+
+const (
+	// EventAuth is sent when the client requests a token. URL is the
+	// authentication realm, without any query parameters.
+	EventAuth EventKind = iota
+	// EventBlobCheck is sent when the client has checked whether the
+	// repository already has a blob. Exists reports the answer.
+	EventBlobCheck
+	// EventBlobUpload reports progress uploading a blob. It is sent when the
+	// upload starts, as data is sent, and when the upload completes with Sent
+	// equal to Total. If the upload fails it is sent once more with Err set.
+	EventBlobUpload
+	// EventManifestPush is sent when a manifest has been pushed to a tag. If
+	// the tag already pointed to the manifest it is not pushed again, and
+	// Exists is set.
+	EventManifestPush
+	// EventBlobDownload reports progress downloading a blob, in the same way
+	// as EventBlobUpload.
+	EventBlobDownload
+)
+
+// String returns a short name for the event kind
+func (k EventKind) String() string {
+	switch k {
+	case EventAuth:
+		return "auth"
+	case EventBlobCheck:
+		return "blob-check"
+	case EventBlobUpload:
+		return "blob-upload"
+	case EventManifestPush:
+		return "manifest-push"
+	case EventBlobDownload:
+		return "blob-download"
+	}
+	return "unknown"
+}
+
+// Event reports the progress of the client. Set Options.OnEvent to receive
+// events.
+type Event struct {
+	// Kind says what happened
+	Kind EventKind
+	// Repository is the fully-qualified repository name, e.g. eu.gcr.io/proj/app
+	Repository string
+	// URL is set for EventAuth
+	URL string
+	// Digest is the digest of the blob or manifest concerned
+	Digest digest.Digest
+	// Tag is set for EventManifestPush
+	Tag string
+	// Exists is set for EventBlobCheck and EventManifestPush
+	Exists bool
+	// Sent and Total are the bytes transferred so far and the total size of
+	// the blob for EventBlobUpload and EventBlobDownload
+	Sent, Total int64
+	// Err is set for EventBlobUpload and EventBlobDownload if the transfer
+	// failed. No more events are sent for the blob.
+	Err error
+}
+
+// event sends an event to the OnEvent callback, if there is one
+func (c *Client) event(e Event) {
+	if c.OnEvent == nil {
+		return
+	}
+	e.Repository = c.repository()
+	c.OnEvent(e)
+}
+
+// progressReader sends EventBlobUpload or EventBlobDownload events as data is
+// read from it
+type progressReader struct {
+	r      io.Reader
+	c      *Client
+	kind   EventKind
+	digest digest.Digest
+	sent   int64
+	total  int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.sent += int64(n)
+		p.c.event(Event{Kind: p.kind, Digest: p.digest, Sent: p.sent, Total: p.total})
+	}
+	return n, err
+}
@@ -1,8 +1,14 @@
 package scratchbuild_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/philpearl/scratchbuild"
 )
@@ -30,9 +36,106 @@ func ExampleClient() {
 	}
 	c.Token = func() string { return token }
 
-	if err := c.BuildImage(&scratchbuild.ImageConfig{
+	result, err := c.BuildImage(&scratchbuild.ImageConfig{
 		Entrypoint: []string{"/app"},
-	}, b.Bytes()); err != nil {
+	}, b.Bytes())
+	if err != nil {
 		log.Fatalf("failed to build and send image. %s", err)
 	}
+	fmt.Println(result.ManifestDigest)
+}
+
+func ExampleParseReference() {
+	for _, s := range []string{"alpine", "philpearl/test:v1", "eu.gcr.io/proj/app:v1.2", "localhost:5000/app"} {
+		ref, err := scratchbuild.ParseReference(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(ref, ref.BaseURL())
+	}
+	// Output:
+	// docker.io/library/alpine https://registry-1.docker.io
+	// docker.io/philpearl/test:v1 https://registry-1.docker.io
+	// eu.gcr.io/proj/app:v1.2 https://eu.gcr.io
+	// localhost:5000/app http://localhost:5000
+}
+
+func ExampleParseDockerfile() {
+	df, err := scratchbuild.ParseDockerfile(strings.NewReader(`FROM scratch
+ENV APP_HOME=/srv
+WORKDIR $APP_HOME
+COPY app ./
+EXPOSE 8080
+ENTRYPOINT ["/srv/app"]
+`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(df.Config.Env, df.Config.WorkingDir, df.Config.Entrypoint)
+	for _, cp := range df.Copies {
+		fmt.Println(cp.Sources, cp.Dest)
+	}
+
+	_, err = scratchbuild.ParseDockerfile(strings.NewReader("FROM scratch\nRUN make\n"))
+	fmt.Println(err)
+	// Output:
+	// [APP_HOME=/srv] /srv [/srv/app]
+	// [app] /srv/
+	// line 2: RUN is not supported: scratch images are built without running commands
+}
+
+func ExampleImageConfig_Validate() {
+	config := scratchbuild.ImageConfig{
+		Entrypoint:   []string{"/app"},
+		Env:          []string{"PATH=/", "FOO"},
+		ExposedPorts: map[string]struct{}{"8080": {}, "53/udp": {}},
+		WorkingDir:   "srv",
+		StopSignal:   "SIGTREM",
+	}
+	var configErr *scratchbuild.ConfigError
+	if errors.As(config.Validate(), &configErr) {
+		for _, err := range configErr.Errors {
+			fmt.Println(err)
+		}
+	}
+	// Output:
+	// Env[1]: "FOO" is not KEY=value
+	// ExposedPorts["8080"]: expected port[-port]/protocol with protocol tcp, udp or sctp
+	// WorkingDir: "srv" must be an absolute path
+	// StopSignal: unknown signal "SIGTREM"
+}
+
+func ExampleBaseFilesLayer() {
+	layer, err := scratchbuild.BaseFilesLayer(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s %04o %d:%d\n", h.Name, h.Mode, h.Uid, h.Gid)
+		if h.Name == "etc/passwd" {
+			if _, err := io.Copy(os.Stdout, tr); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	// Output:
+	// etc/ 0755 0:0
+	// etc/passwd 0644 0:0
+	// root:x:0:0:root:/root:/sbin/nologin
+	// nonroot:x:65532:65532:nonroot:/home/nonroot:/sbin/nologin
+	// etc/group 0644 0:0
+	// etc/nsswitch.conf 0644 0:0
+	// tmp/ 1777 0:0
+	// root/ 0700 0:0
+	// home/ 0755 0:0
+	// home/nonroot/ 0700 65532:65532
 }
@@ -0,0 +1,162 @@
+package scratchbuild
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// manifestAccept lists the manifest media types we understand, for the Accept
+// header on manifest requests
+var manifestAccept = strings.Join([]string{
+	MediaTypeManifest,
+	MediaTypeManifestList,
+	MediaTypeOCIManifest,
+	MediaTypeOCIIndex,
+}, ", ")
+
+// maxManifestSize limits the size of manifests we're prepared to read
+const maxManifestSize = 4 << 20
+
+// isIndex reports whether a media type is an OCI index or Docker manifest list
+func isIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeManifestList
+}
+
+// isImageManifest reports whether a media type is an image manifest we
+// understand
+func isImageManifest(mediaType string) bool {
+	return mediaType == MediaTypeManifest || mediaType == MediaTypeOCIManifest
+}
+
+// GetManifest fetches a manifest from the repository. reference is a tag or a
+// digest. The manifest bytes are returned exactly as the registry sent them,
+// along with a descriptor giving their media type, size and digest. If
+// reference is a digest the content is checked against it.
+func (c *Client) GetManifest(reference string) ([]byte, Descriptor, error) {
+	u := strings.Join([]string{c.BaseURL, "v2", c.Name, "manifests", reference}, "/")
+	req, err := c.newRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, Descriptor{}, fmt.Errorf("could not build request: %w", err)
+	}
+	req.Header.Set("Accept", manifestAccept)
+
+	rsp, err := c.do(req)
+	if err != nil {
+		return nil, Descriptor{}, fmt.Errorf("manifest fetch failed: %w", err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, Descriptor{}, newRegistryError(rsp)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, Descriptor{}, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(data) > maxManifestSize {
+		return nil, Descriptor{}, fmt.Errorf("manifest is larger than %d bytes", maxManifestSize)
+	}
+
+	desc := Descriptor{
+		MediaType: manifestMediaType(rsp.Header.Get("Content-Type"), data),
+		Size:      int64(len(data)),
+		Digest:    digest.FromBytes(data),
+	}
+	if want, err := digest.Parse(reference); err == nil && want != desc.Digest {
+		return nil, Descriptor{}, fmt.Errorf("manifest for %s has digest %s", reference, desc.Digest)
+	}
+
+	return data, desc, nil
+}
+
+// manifestMediaType works out the media type of a manifest. We trust the
+// mediaType field in the manifest over the Content-Type header, as some
+// registries are sloppy with the header.
+func manifestMediaType(contentType string, data []byte) string {
+	var v Versioned
+	if err := json.Unmarshal(data, &v); err == nil && v.MediaType != "" {
+		return v.MediaType
+	}
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	return contentType
+}
+
+// GetImage fetches the image configuration blob referenced by a manifest
+func (c *Client) GetImage(manifest *Manifest) (*Image, error) {
+	var b bytes.Buffer
+	if err := c.fetchBlob(manifest.Config, &b); err != nil {
+		return nil, fmt.Errorf("could not fetch image config: %w", err)
+	}
+	var image Image
+	if err := json.Unmarshal(b.Bytes(), &image); err != nil {
+		return nil, fmt.Errorf("could not unmarshal image config: %w", err)
+	}
+	return &image, nil
+}
+
+// getBlob starts fetching a blob. The caller must close the body.
+func (c *Client) getBlob(dgst digest.Digest) (io.ReadCloser, error) {
+	u := strings.Join([]string{c.BaseURL, "v2", c.Name, "blobs", dgst.String()}, "/")
+	req, err := c.newRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not build request: %w", err)
+	}
+
+	rsp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("blob fetch failed: %w", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+		return nil, newRegistryError(rsp)
+	}
+	return rsp.Body, nil
+}
+
+// fetchBlob streams a blob into w, checking its size and digest against the
+// descriptor as it goes. If the content does not match the descriptor an error
+// is returned, but w will already have received the content.
+func (c *Client) fetchBlob(desc Descriptor, w io.Writer) (err error) {
+	body, err := c.getBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	c.event(Event{Kind: EventBlobDownload, Digest: desc.Digest, Total: desc.Size})
+	defer func() {
+		if err != nil {
+			c.event(Event{Kind: EventBlobDownload, Digest: desc.Digest, Total: desc.Size, Err: err})
+		}
+	}()
+	verifier := desc.Digest.Verifier()
+	r := &progressReader{
+		// Read one byte more than we expect so we notice if the blob is too big
+		r:      io.LimitReader(body, desc.Size+1),
+		c:      c,
+		kind:   EventBlobDownload,
+		digest: desc.Digest,
+		total:  desc.Size,
+	}
+	n, err := io.Copy(io.MultiWriter(w, verifier), r)
+	if err != nil {
+		return fmt.Errorf("failed reading blob %s: %w", desc.Digest, err)
+	}
+	if n != desc.Size {
+		return fmt.Errorf("blob %s has size %d, expected %d", desc.Digest, n, desc.Size)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob content does not match digest %s", desc.Digest)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package scratchbuild_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestGetManifestAndImage(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "v1")
+
+	c := newClient(t, r, "test/app")
+	for _, ref := range []string{"v1", result.ManifestDigest.String()} {
+		data, desc, err := c.GetManifest(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc.Digest != result.ManifestDigest || desc.Size != int64(len(data)) || desc.MediaType != result.MediaType {
+			t.Errorf("%s: unexpected descriptor %+v", ref, desc)
+		}
+
+		var manifest scratchbuild.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		image, err := c.GetImage(&manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if image.Architecture != "amd64" || image.OS != "linux" || strings.Join(image.Config.Entrypoint, " ") != "/app" {
+			t.Errorf("unexpected image %+v", image)
+		}
+		if !image.Created.Equal(created) {
+			t.Errorf("unexpected creation time %s", image.Created)
+		}
+	}
+}
+
+func TestGetManifestUnknown(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	_, _, err := newClient(t, r, "test/app").GetManifest("v1")
+	if !scratchbuild.HasErrorCode(err, scratchbuild.ErrorCodeManifestUnknown) {
+		t.Errorf("expected MANIFEST_UNKNOWN, got %v", err)
+	}
+}
+
+func TestGetManifestWrongDigest(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "v1")
+	other, _, _ := r.Manifest("test/app", "v1")
+	other = append(other, '\n')
+
+	// The registry returns different content from what we asked for
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if strings.HasSuffix(req.URL.Path, "/manifests/"+result.ManifestDigest.String()) {
+			w.Header().Set("Content-Type", result.MediaType)
+			w.Write(other)
+			return true
+		}
+		return false
+	})
+	if _, _, err := newClient(t, r, "test/app").GetManifest(result.ManifestDigest.String()); err == nil {
+		t.Error("expected an error for a manifest that doesn't match its digest")
+	}
+}
+
+func TestGetImageWrongContent(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "v1")
+
+	data, _, _ := r.Manifest("test/app", "v1")
+	var manifest scratchbuild.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := r.Blob("test/app", result.ConfigDigest)
+	config = append([]byte(nil), config...)
+	config[0] = ' '
+
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if strings.HasSuffix(req.URL.Path, "/blobs/"+result.ConfigDigest.String()) {
+			w.Write(config)
+			return true
+		}
+		return false
+	})
+	_, err := newClient(t, r, "test/app").GetImage(&manifest)
+	if err == nil || !strings.Contains(err.Error(), "does not match digest") {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/klauspost/pgzip v1.2.5
 	github.com/opencontainers/go-digest v1.0.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require github.com/klauspost/compress v1.16.5 // indirect
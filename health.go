@@ -0,0 +1,51 @@
+package scratchbuild
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// minHealthDuration is the shortest interval, timeout or start period Docker
+// accepts for a healthcheck
+const minHealthDuration = time.Millisecond
+
+// Validate checks the healthcheck has a valid test and durations
+func (h *HealthConfig) Validate() error {
+	if len(h.Test) == 0 {
+		return errors.New("test must be set")
+	}
+	switch h.Test[0] {
+	case "NONE":
+		if len(h.Test) != 1 {
+			return errors.New(`a NONE test takes no arguments`)
+		}
+	case "CMD":
+		if len(h.Test) < 2 {
+			return errors.New(`a CMD test needs a command`)
+		}
+	case "CMD-SHELL":
+		if len(h.Test) != 2 {
+			return errors.New(`a CMD-SHELL test takes a single command string`)
+		}
+	default:
+		return fmt.Errorf("test must start with NONE, CMD or CMD-SHELL, not %q", h.Test[0])
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"interval", h.Interval},
+		{"timeout", h.Timeout},
+		{"start period", h.StartPeriod},
+	} {
+		if d.value != 0 && d.value < minHealthDuration {
+			return fmt.Errorf("%s %s must be at least %s", d.name, d.value, minHealthDuration)
+		}
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("retries %d must not be negative", h.Retries)
+	}
+	return nil
+}
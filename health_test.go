@@ -0,0 +1,70 @@
+package scratchbuild_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+func TestHealthConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		health scratchbuild.HealthConfig
+		err    string
+	}{
+		{name: "none", health: scratchbuild.HealthConfig{Test: []string{"NONE"}}},
+		{name: "cmd", health: scratchbuild.HealthConfig{Test: []string{"CMD", "/app", "-health"}}},
+		{name: "cmd-shell", health: scratchbuild.HealthConfig{Test: []string{"CMD-SHELL", "/app -health || exit 1"}}},
+		{
+			name: "durations and retries",
+			health: scratchbuild.HealthConfig{
+				Test:     []string{"CMD", "/app"},
+				Interval: 30 * time.Second, Timeout: time.Millisecond, StartPeriod: time.Minute, Retries: 3,
+			},
+		},
+		{name: "empty test", health: scratchbuild.HealthConfig{}, err: "test must be set"},
+		{name: "none with arguments", health: scratchbuild.HealthConfig{Test: []string{"NONE", "x"}}, err: "a NONE test takes no arguments"},
+		{name: "cmd without command", health: scratchbuild.HealthConfig{Test: []string{"CMD"}}, err: "a CMD test needs a command"},
+		{name: "cmd-shell without command", health: scratchbuild.HealthConfig{Test: []string{"CMD-SHELL"}}, err: "a CMD-SHELL test takes a single command string"},
+		{name: "cmd-shell with arguments", health: scratchbuild.HealthConfig{Test: []string{"CMD-SHELL", "/app", "-health"}}, err: "a CMD-SHELL test takes a single command string"},
+		{name: "unknown form", health: scratchbuild.HealthConfig{Test: []string{"/app"}}, err: `test must start with NONE, CMD or CMD-SHELL, not "/app"`},
+		{name: "lowercase form", health: scratchbuild.HealthConfig{Test: []string{"cmd", "/app"}}, err: `test must start with NONE, CMD or CMD-SHELL, not "cmd"`},
+		{
+			name:   "negative interval",
+			health: scratchbuild.HealthConfig{Test: []string{"CMD", "/app"}, Interval: -time.Second},
+			err:    "interval -1s must be at least 1ms",
+		},
+		{
+			name:   "timeout too short",
+			health: scratchbuild.HealthConfig{Test: []string{"CMD", "/app"}, Timeout: time.Microsecond},
+			err:    "timeout 1µs must be at least 1ms",
+		},
+		{
+			name:   "negative start period",
+			health: scratchbuild.HealthConfig{Test: []string{"CMD", "/app"}, StartPeriod: -time.Minute},
+			err:    "start period -1m0s must be at least 1ms",
+		},
+		{
+			name:   "negative retries",
+			health: scratchbuild.HealthConfig{Test: []string{"CMD", "/app"}, Retries: -1},
+			err:    "retries -1 must not be negative",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.health.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package scratchbuild
+
+import (
+	"encoding/json"
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// PushIndex pushes a manifest list referring to images already in the
+// repository to each of the tags in Options, and to the destinations. Use it
+// to publish a multi-platform image: build the image for each platform with
+// BuildImage, setting Options.Platform and no tags, then push an index of the
+// result descriptors.
+func (c *Client) PushIndex(manifests []Descriptor) (*BuildResult, error) {
+	index := Index{
+		Versioned: Versioned{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeManifestList,
+		},
+		Manifests: manifests,
+	}
+	data, err := json.Marshal(&index)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal index: %w", err)
+	}
+
+	result := &BuildResult{
+		ManifestDigest: digest.FromBytes(data),
+		ManifestSize:   int64(len(data)),
+		MediaType:      MediaTypeManifestList,
+	}
+	return c.push(result, nil, MediaTypeManifestList, data)
+}
@@ -0,0 +1,165 @@
+package scratchbuild
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/pgzip"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// LayerCache lets builds share work on identical layers, such as a layer of CA
+// certificates used by many images. Each layer is compressed just once, and
+// once a blob is in one repository it is mounted into other repositories on
+// the same registry rather than uploaded again. Set Options.LayerCache to the
+// same LayerCache for each build. A LayerCache is safe for concurrent use.
+type LayerCache struct {
+	mu         sync.Mutex
+	compressed map[digest.Digest]*cachedLayer
+	blobs      map[cachedBlobKey]*cachedBlob
+}
+
+// NewLayerCache creates an empty LayerCache
+func NewLayerCache() *LayerCache {
+	return &LayerCache{
+		compressed: make(map[digest.Digest]*cachedLayer),
+		blobs:      make(map[cachedBlobKey]*cachedBlob),
+	}
+}
+
+type cachedLayer struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// cachedBlobKey identifies a blob on a registry
+type cachedBlobKey struct {
+	baseURL string
+	digest  digest.Digest
+}
+
+// cachedBlob records a repository on a registry that has a blob, or will have
+// once an upload in progress finishes
+type cachedBlob struct {
+	done chan struct{}
+	// name is the repository with the blob. It is empty if the upload failed.
+	name string
+}
+
+// compressLayer gzips a layer
+func compressLayer(layer []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	gw := pgzip.NewWriter(b)
+	if _, err := gw.Write(layer); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// compress returns the compressed form of a layer with the given uncompressed
+// digest, compressing it if no other build has. It works on a nil LayerCache.
+func (lc *LayerCache) compress(dig digest.Digest, layer []byte) ([]byte, error) {
+	if lc == nil {
+		return compressLayer(layer)
+	}
+
+	lc.mu.Lock()
+	cl, ok := lc.compressed[dig]
+	if !ok {
+		cl = &cachedLayer{}
+		lc.compressed[dig] = cl
+	}
+	lc.mu.Unlock()
+
+	cl.once.Do(func() {
+		cl.data, cl.err = compressLayer(layer)
+	})
+	return cl.data, cl.err
+}
+
+// have records that a repository already has a blob
+func (lc *LayerCache) have(c *Client, dig digest.Digest) {
+	if lc == nil {
+		return
+	}
+	key := cachedBlobKey{baseURL: c.BaseURL, digest: dig}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if _, ok := lc.blobs[key]; !ok {
+		done := make(chan struct{})
+		close(done)
+		lc.blobs[key] = &cachedBlob{done: done, name: c.Name}
+	}
+}
+
+// claim is called before uploading a blob. If a repository on the registry has
+// the blob, or is uploading it, claim waits for the upload and returns that
+// repository so the blob can be mounted from it. Otherwise it returns an empty
+// name, and the caller must call finish once its upload is done so that others
+// can mount from it.
+func (lc *LayerCache) claim(c *Client, dig digest.Digest) (from string, finish func(err error)) {
+	finish = func(error) {}
+	if lc == nil {
+		return "", finish
+	}
+	key := cachedBlobKey{baseURL: c.BaseURL, digest: dig}
+	lc.mu.Lock()
+	cb, ok := lc.blobs[key]
+	if !ok {
+		cb = &cachedBlob{done: make(chan struct{})}
+		lc.blobs[key] = cb
+		lc.mu.Unlock()
+		return "", func(err error) {
+			lc.mu.Lock()
+			defer lc.mu.Unlock()
+			if err == nil {
+				cb.name = c.Name
+			} else {
+				// Let the next build try
+				delete(lc.blobs, key)
+			}
+			close(cb.done)
+		}
+	}
+	lc.mu.Unlock()
+
+	<-cb.done
+	return cb.name, finish
+}
+
+// uploadBlobOnce uploads a blob the repository does not have, mounting it from
+// another repository on the same registry if the LayerCache knows of one
+func (c *Client) uploadBlobOnce(dig digest.Digest, data []byte) (err error) {
+	from, finish := c.LayerCache.claim(c, dig)
+	defer func() { finish(err) }()
+
+	if from == c.Name {
+		// Another build has just uploaded it to this repository
+		return nil
+	}
+	if from != "" {
+		loc, mounted, err := c.mountBlob(dig, from)
+		if err != nil {
+			return fmt.Errorf("could not mount blob: %w", err)
+		}
+		if mounted {
+			return nil
+		}
+		return c.uploadBlob(loc, dig, data)
+	}
+
+	// The repository tells us where the blob should be uploaded to
+	loc, err := c.getBlobUploadLocation()
+	if err != nil {
+		return fmt.Errorf("could not get location for blob upload: %w", err)
+	}
+	if err := c.uploadBlob(loc, dig, data); err != nil {
+		return fmt.Errorf("blob upload failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package scratchbuild_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestLayerCacheConcurrentBuilds(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	cache := scratchbuild.NewLayerCache()
+	layer := appLayer(t)
+	var wg sync.WaitGroup
+	results := make([]*scratchbuild.BuildResult, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			o := r.ClientOptions(fmt.Sprintf("test/app%d", i), "latest")
+			o.LayerCache = cache
+			o.Created = created
+			result, err := scratchbuild.New(&o).BuildImage(&appConfig, layer)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = result
+		}(i)
+	}
+	wg.Wait()
+
+	// The layer and config are the same for each image, so each is uploaded
+	// once and mounted into the other repositories
+	var uploads int
+	for _, req := range r.Requests() {
+		if strings.HasPrefix(req, "PUT ") && strings.Contains(req, "/blobs/uploads/") {
+			uploads++
+		}
+	}
+	if uploads != 2 {
+		t.Errorf("expected 2 uploads, got %d", uploads)
+	}
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+		if _, ok := r.Blob(fmt.Sprintf("test/app%d", i), result.Layers[0].Digest); !ok {
+			t.Errorf("test/app%d is missing the layer", i)
+		}
+	}
+}
+
+func TestLayerCacheUploadFailure(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	// Uploads to the first repository fail
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/v2/test/bad/blobs/uploads/") {
+			scratchbuildtest.WriteError(w, http.StatusInternalServerError, scratchbuild.ErrorCodeBlobUploadInvalid, "disk full")
+			return true
+		}
+		return false
+	})
+
+	cache := scratchbuild.NewLayerCache()
+	layer := appLayer(t)
+	o := r.ClientOptions("test/bad", "latest")
+	o.LayerCache = cache
+	if _, err := scratchbuild.New(&o).BuildImage(&appConfig, layer); err == nil {
+		t.Fatal("expected the first build to fail")
+	}
+
+	// The next build doesn't try to mount from the failed repository
+	o = r.ClientOptions("test/good", "latest")
+	o.LayerCache = cache
+	result, err := scratchbuild.New(&o).BuildImage(&appConfig, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Blob("test/good", result.Layers[0].Digest); !ok {
+		t.Error("layer not uploaded")
+	}
+}
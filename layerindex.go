@@ -0,0 +1,375 @@
+package scratchbuild
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// defaultPath is the PATH used to find the program to run if the image does not
+// set one, as in Docker
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// layerFile is an entry in the filesystem built from image layers
+type layerFile struct {
+	// layer is the index of the layer containing the entry
+	layer int
+	// name is the name of the entry in the layer tar file
+	name     string
+	typeflag byte
+	mode     int64
+	linkname string
+}
+
+// layerIndex is the filesystem built from a set of image layers, keyed by
+// absolute path
+type layerIndex struct {
+	layers [][]byte
+	files  map[string]*layerFile
+}
+
+// indexLayers reads the tar headers of the layers, bottom-most first, to find
+// the files in the image. Whiteout files in upper layers remove files from
+// lower ones.
+func indexLayers(layers [][]byte) (*layerIndex, error) {
+	ix := &layerIndex{layers: layers, files: make(map[string]*layerFile)}
+	for i, layer := range layers {
+		tr := tar.NewReader(bytes.NewReader(layer))
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not read layer %d: %w", i, err)
+			}
+			name := path.Clean("/" + h.Name)
+			dir, base := path.Split(name)
+			ix.addParents(i, dir)
+			switch {
+			case base == ".wh..wh..opq":
+				ix.removeChildren(path.Clean(dir))
+				continue
+			case strings.HasPrefix(base, ".wh."):
+				removed := path.Join(dir, strings.TrimPrefix(base, ".wh."))
+				delete(ix.files, removed)
+				ix.removeChildren(removed)
+				continue
+			}
+
+			f := &layerFile{
+				layer:    i,
+				name:     h.Name,
+				typeflag: h.Typeflag,
+				mode:     h.Mode,
+				linkname: h.Linkname,
+			}
+			if h.Typeflag == tar.TypeLink {
+				// A hard link is the same file as its target
+				if target, ok := ix.files[path.Clean("/"+h.Linkname)]; ok {
+					f = target
+				}
+			}
+			ix.files[name] = f
+		}
+	}
+	return ix, nil
+}
+
+// addParents adds the parent directories of a layer entry that the image does
+// not have. Layers need not include them, and the runtime creates them owned by
+// root with mode 0755.
+func (ix *layerIndex) addParents(layer int, dir string) {
+	for dir = path.Clean(dir); dir != "/"; dir = path.Dir(dir) {
+		if _, ok := ix.files[dir]; ok {
+			return
+		}
+		ix.files[dir] = &layerFile{
+			layer:    layer,
+			name:     strings.TrimPrefix(dir, "/") + "/",
+			typeflag: tar.TypeDir,
+			mode:     0o755,
+		}
+	}
+}
+
+func (ix *layerIndex) removeChildren(dir string) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for name := range ix.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(ix.files, name)
+		}
+	}
+}
+
+// errNotExist is returned by lookup if a path does not exist
+var errNotExist = errors.New("does not exist in the image")
+
+// lookup finds the file at an absolute path, following symbolic links. It
+// returns the file and its path after following links.
+func (ix *layerIndex) lookup(p string) (*layerFile, string, error) {
+	resolved := "/"
+	remaining := strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	var f *layerFile
+	for links := 0; len(remaining) > 0; {
+		component := remaining[0]
+		remaining = remaining[1:]
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, component)
+		var ok bool
+		f, ok = ix.files[next]
+		if !ok {
+			return nil, "", errNotExist
+		}
+		if f.typeflag != tar.TypeSymlink {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > 40 {
+			return nil, "", errors.New("has too many levels of symbolic links")
+		}
+		target := f.linkname
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	if f == nil {
+		// The root directory
+		return &layerFile{typeflag: tar.TypeDir, mode: 0o755}, "/", nil
+	}
+	return f, resolved, nil
+}
+
+// read returns the content of a file
+func (ix *layerIndex) read(f *layerFile) ([]byte, error) {
+	tr := tar.NewReader(bytes.NewReader(ix.layers[f.layer]))
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if h.Name == f.name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// findProgram finds the program a container runs, as the runtime would:
+// searching PATH if the name has no slash, or relative to the working
+// directory if it is relative.
+func (ix *layerIndex) findProgram(program string, config *ImageConfig) (*layerFile, string, error) {
+	if strings.Contains(program, "/") {
+		if !path.IsAbs(program) {
+			program = path.Join("/", config.WorkingDir, program)
+		}
+		f, resolved, err := ix.lookup(program)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s %w", program, err)
+		}
+		return f, resolved, nil
+	}
+
+	searchPath := defaultPath
+	for _, e := range config.Env {
+		if strings.HasPrefix(e, "PATH=") {
+			searchPath = strings.TrimPrefix(e, "PATH=")
+		}
+	}
+	for _, dir := range strings.Split(searchPath, ":") {
+		if !path.IsAbs(dir) {
+			continue
+		}
+		f, resolved, err := ix.lookup(path.Join(dir, program))
+		if err == nil && f.typeflag != tar.TypeDir {
+			return f, resolved, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%s is not in any directory on the PATH %s", program, searchPath)
+}
+
+// imageProgram is the program an image runs, as found in its layers
+type imageProgram struct {
+	// field is Entrypoint[0] or Cmd[0]
+	field string
+	// path is the path to the program after following links
+	path string
+	// binary is from the program's ELF header. It is nil if the program is
+	// not an ELF binary.
+	binary *binaryInfo
+	// err says why the program can't be run
+	err error
+}
+
+// program finds the program the image runs and reads its ELF header
+func (ix *layerIndex) program(config *ImageConfig) *imageProgram {
+	p := &imageProgram{field: "Entrypoint[0]"}
+	var program string
+	if len(config.Entrypoint) > 0 {
+		program = config.Entrypoint[0]
+	} else if len(config.Cmd) > 0 {
+		p.field, program = "Cmd[0]", config.Cmd[0]
+	}
+	if program == "" {
+		return p
+	}
+
+	f, resolved, err := ix.findProgram(program, config)
+	p.path = resolved
+	switch {
+	case err != nil:
+		p.err = err
+	case f.typeflag == tar.TypeDir:
+		p.err = fmt.Errorf("%s is a directory", resolved)
+	case f.typeflag != tar.TypeReg && f.typeflag != tar.TypeLink:
+		p.err = fmt.Errorf("%s is not a regular file", resolved)
+	case f.mode&0o111 == 0:
+		p.err = fmt.Errorf("%s is not executable (mode %04o)", resolved, f.mode&0o7777)
+	}
+	if p.err != nil {
+		return p
+	}
+
+	data, err := ix.read(f)
+	if err != nil {
+		p.err = fmt.Errorf("could not read %s: %w", resolved, err)
+		return p
+	}
+	if p.binary, err = readBinary(data); err != nil {
+		p.err = fmt.Errorf("%s: %w", resolved, err)
+	}
+	return p
+}
+
+// check checks that what the configuration refers to is in the layers: the
+// program to run must exist and be executable, built for the image platform
+// and either statically linked or have its loader and libraries in the image.
+// The working directory must be a directory, and user and group names must be
+// in /etc/passwd and /etc/group.
+func (ix *layerIndex) check(config *ImageConfig, platform Platform, prog *imageProgram) error {
+	var errs []*FieldError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if prog.err != nil {
+		add(prog.field, "%s", prog.err)
+	}
+	if bin := prog.binary; bin != nil {
+		if bin.architecture != "" && bin.architecture != platform.Architecture {
+			add(prog.field, "%s is built for %s but the image is for %s", prog.path, bin.architecture, platform.Architecture)
+		}
+		if bin.dynamic() {
+			if missing := ix.missingLibraries(config, prog); len(missing) > 0 {
+				add(prog.field, "%s is dynamically linked and needs %s, which the image does not contain. Build it statically, for example with CGO_ENABLED=0, or add its libraries",
+					prog.path, strings.Join(missing, ", "))
+			}
+		}
+	}
+
+	if config.WorkingDir != "" {
+		f, _, err := ix.lookup(config.WorkingDir)
+		switch {
+		case err != nil:
+			add("WorkingDir", "%s %s", config.WorkingDir, err)
+		case f.typeflag != tar.TypeDir:
+			add("WorkingDir", "%s is not a directory", config.WorkingDir)
+		}
+	}
+
+	if config.User != "" {
+		user, group, _ := strings.Cut(config.User, ":")
+		if err := ix.checkName(user, "/etc/passwd", "user"); err != nil {
+			add("User", "%s", err)
+		}
+		if group != "" {
+			if err := ix.checkName(group, "/etc/group", "group"); err != nil {
+				add("User", "%s", err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ConfigError{Errors: errs}
+	}
+	return nil
+}
+
+// missingLibraries lists the dynamic loader and shared libraries a program
+// needs that are not in the image. Libraries are looked for where the loader
+// would look: the binary's RUNPATH, LD_LIBRARY_PATH and the standard library
+// directories. Libraries needed by those libraries are not checked.
+func (ix *layerIndex) missingLibraries(config *ImageConfig, prog *imageProgram) []string {
+	bin := prog.binary
+	var missing []string
+	if bin.interpreter != "" {
+		if _, _, err := ix.lookup(bin.interpreter); err != nil {
+			missing = append(missing, bin.interpreter)
+		}
+	}
+
+	var ldLibraryPath []string
+	for _, e := range config.Env {
+		if strings.HasPrefix(e, "LD_LIBRARY_PATH=") {
+			ldLibraryPath = strings.Split(strings.TrimPrefix(e, "LD_LIBRARY_PATH="), ":")
+		}
+	}
+	dirs := libraryDirs(bin, path.Dir(prog.path), ldLibraryPath)
+	for _, lib := range bin.needed {
+		if !ix.findLibrary(lib, dirs) {
+			missing = append(missing, lib)
+		}
+	}
+	return missing
+}
+
+func (ix *layerIndex) findLibrary(lib string, dirs []string) bool {
+	if strings.Contains(lib, "/") {
+		_, _, err := ix.lookup(lib)
+		return err == nil
+	}
+	for _, dir := range dirs {
+		if f, _, err := ix.lookup(path.Join(dir, lib)); err == nil && f.typeflag != tar.TypeDir {
+			return true
+		}
+	}
+	return false
+}
+
+// checkName checks a user or group is numeric or is listed in a passwd or
+// group file
+func (ix *layerIndex) checkName(name, file, what string) error {
+	if _, err := strconv.Atoi(name); err == nil {
+		return nil
+	}
+	f, _, err := ix.lookup(file)
+	if err != nil {
+		return fmt.Errorf("%s %s can't be found as %s %s; use a numeric ID instead", what, name, file, err)
+	}
+	data, err := ix.read(f)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", file, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if entry, _, _ := strings.Cut(scanner.Text(), ":"); entry == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s is not in %s", what, name, file)
+}
@@ -0,0 +1,300 @@
+package scratchbuild
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// tarEntry is a file in a test layer
+type tarEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	body     string
+	linkname string
+}
+
+func file(name string, mode int64, body string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeReg, mode: mode, body: body}
+}
+
+func dir(name string) tarEntry {
+	return tarEntry{name: name + "/", typeflag: tar.TypeDir, mode: 0o755}
+}
+
+func symlink(name, target string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeSymlink, mode: 0o777, linkname: target}
+}
+
+func hardlink(name, target string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeLink, linkname: target}
+}
+
+func whiteout(name string) tarEntry {
+	return file(name, 0o644, "")
+}
+
+// testLayer builds a layer tar file from entries
+func testLayer(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: e.mode, Linkname: e.linkname, Size: int64(len(e.body))}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// checkLayers runs the layer checks BuildImage runs for an amd64 image
+func checkLayers(t *testing.T, config *ImageConfig, layers ...[]byte) error {
+	t.Helper()
+	ix, err := indexLayers(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix.check(config, Platform{OS: "linux", Architecture: "amd64"}, ix.program(config))
+}
+
+const script = "#!/app/run\n"
+
+func TestLayerChecks(t *testing.T) {
+	passwd := file("etc/passwd", 0o644, "root:x:0:0:root:/root:/sbin/nologin\nnonroot:x:65532:65532:nonroot:/home/nonroot:/sbin/nologin\n")
+	group := file("etc/group", 0o644, "root:x:0:\nnonroot:x:65532:\n")
+
+	tests := []struct {
+		name   string
+		config ImageConfig
+		layers [][]tarEntry
+		// errs lists the field errors we expect, as field: message prefix
+		errs []string
+	}{
+		{
+			name:   "program present",
+			config: ImageConfig{Entrypoint: []string{"/app"}},
+			layers: [][]tarEntry{{file("app", 0o755, script)}},
+		},
+		{
+			name:   "parent directories not in the layer",
+			config: ImageConfig{Entrypoint: []string{"/opt/app/bin/run"}, WorkingDir: "/opt/app"},
+			layers: [][]tarEntry{{file("opt/app/bin/run", 0o755, script)}},
+		},
+		{
+			name:   "cmd used when there is no entrypoint",
+			config: ImageConfig{Cmd: []string{"/missing"}},
+			layers: [][]tarEntry{{file("app", 0o755, script)}},
+			errs:   []string{"Cmd[0]: /missing does not exist in the image"},
+		},
+		{
+			name:   "not executable",
+			config: ImageConfig{Entrypoint: []string{"/app"}},
+			layers: [][]tarEntry{{file("app", 0o644, script)}},
+			errs:   []string{"Entrypoint[0]: /app is not executable (mode 0644)"},
+		},
+		{
+			name:   "directory",
+			config: ImageConfig{Entrypoint: []string{"/app"}},
+			layers: [][]tarEntry{{dir("app")}},
+			errs:   []string{"Entrypoint[0]: /app is a directory"},
+		},
+		{
+			name:   "removed by whiteout",
+			config: ImageConfig{Entrypoint: []string{"/bin/app"}},
+			layers: [][]tarEntry{
+				{dir("bin"), file("bin/app", 0o755, script)},
+				{whiteout("bin/.wh.app")},
+			},
+			errs: []string{"Entrypoint[0]: /bin/app does not exist in the image"},
+		},
+		{
+			name:   "directory removed by whiteout",
+			config: ImageConfig{Entrypoint: []string{"/bin/app"}},
+			layers: [][]tarEntry{
+				{dir("bin"), file("bin/app", 0o755, script)},
+				{whiteout(".wh.bin")},
+			},
+			errs: []string{"Entrypoint[0]: /bin/app does not exist in the image"},
+		},
+		{
+			name:   "replaced after whiteout",
+			config: ImageConfig{Entrypoint: []string{"/bin/app"}},
+			layers: [][]tarEntry{
+				{dir("bin"), file("bin/app", 0o644, script)},
+				{whiteout("bin/.wh.app")},
+				{file("bin/app", 0o755, script)},
+			},
+		},
+		{
+			name:   "opaque directory",
+			config: ImageConfig{Entrypoint: []string{"/bin/app"}},
+			layers: [][]tarEntry{
+				{dir("bin"), file("bin/app", 0o755, script)},
+				{dir("bin"), whiteout("bin/.wh..wh..opq"), file("bin/tool", 0o755, script)},
+			},
+			errs: []string{"Entrypoint[0]: /bin/app does not exist in the image"},
+		},
+		{
+			name:   "added to opaque directory",
+			config: ImageConfig{Entrypoint: []string{"/bin/tool"}},
+			layers: [][]tarEntry{
+				{dir("bin"), file("bin/app", 0o755, script)},
+				{dir("bin"), whiteout("bin/.wh..wh..opq"), file("bin/tool", 0o755, script)},
+			},
+		},
+		{
+			name:   "relative symlink",
+			config: ImageConfig{Entrypoint: []string{"/usr/bin/app"}},
+			layers: [][]tarEntry{{
+				dir("usr"), dir("usr/bin"), dir("usr/lib"), dir("usr/lib/app"),
+				file("usr/lib/app/app", 0o755, script),
+				symlink("usr/bin/app", "../lib/app/app"),
+			}},
+		},
+		{
+			name:   "absolute directory symlink",
+			config: ImageConfig{Entrypoint: []string{"/bin/app"}},
+			layers: [][]tarEntry{{
+				dir("usr"), dir("usr/bin"),
+				file("usr/bin/app", 0o755, script),
+				symlink("bin", "/usr/bin"),
+			}},
+		},
+		{
+			name:   "dangling symlink",
+			config: ImageConfig{Entrypoint: []string{"/app"}},
+			layers: [][]tarEntry{{symlink("app", "/opt/app")}},
+			errs:   []string{"Entrypoint[0]: /app does not exist in the image"},
+		},
+		{
+			name:   "symlink loop",
+			config: ImageConfig{Entrypoint: []string{"/a"}},
+			layers: [][]tarEntry{{symlink("a", "b"), symlink("b", "a")}},
+			errs:   []string{"Entrypoint[0]: /a has too many levels of symbolic links"},
+		},
+		{
+			name:   "hard link",
+			config: ImageConfig{Entrypoint: []string{"/app"}},
+			layers: [][]tarEntry{{file("real", 0o755, script), hardlink("app", "real")}},
+		},
+		{
+			name:   "default PATH",
+			config: ImageConfig{Entrypoint: []string{"app"}},
+			layers: [][]tarEntry{{
+				dir("usr"), dir("usr/local"), dir("usr/local/bin"),
+				file("usr/local/bin/app", 0o755, script),
+			}},
+		},
+		{
+			name:   "PATH from Env",
+			config: ImageConfig{Entrypoint: []string{"app"}, Env: []string{"PATH=/opt/bin:/srv"}},
+			layers: [][]tarEntry{{
+				dir("opt"), dir("opt/bin"), dir("opt/bin/app"), dir("srv"),
+				file("srv/app", 0o755, script),
+			}},
+		},
+		{
+			name:   "not on PATH",
+			config: ImageConfig{Entrypoint: []string{"app"}, Env: []string{"PATH=/opt/bin"}},
+			layers: [][]tarEntry{{file("app", 0o755, script)}},
+			errs:   []string{"Entrypoint[0]: app is not in any directory on the PATH /opt/bin"},
+		},
+		{
+			name:   "relative to WorkingDir",
+			config: ImageConfig{Entrypoint: []string{"./app"}, WorkingDir: "/srv"},
+			layers: [][]tarEntry{{dir("srv"), file("srv/app", 0o755, script)}},
+		},
+		{
+			name:   "WorkingDir not a directory",
+			config: ImageConfig{Entrypoint: []string{"/app"}, WorkingDir: "/app"},
+			layers: [][]tarEntry{{file("app", 0o755, script)}},
+			errs:   []string{"WorkingDir: /app is not a directory"},
+		},
+		{
+			name:   "WorkingDir missing",
+			config: ImageConfig{Entrypoint: []string{"/app"}, WorkingDir: "/srv"},
+			layers: [][]tarEntry{{file("app", 0o755, script)}},
+			errs:   []string{"WorkingDir: /srv does not exist in the image"},
+		},
+		{
+			name:   "users and groups in passwd and group",
+			config: ImageConfig{Entrypoint: []string{"/app"}, User: "nonroot:nonroot"},
+			layers: [][]tarEntry{{dir("etc"), passwd, group, file("app", 0o755, script)}},
+		},
+		{
+			name:   "numeric user needs no passwd",
+			config: ImageConfig{Entrypoint: []string{"/app"}, User: "65532:65532"},
+			layers: [][]tarEntry{{file("app", 0o755, script)}},
+		},
+		{
+			name:   "unknown user and group",
+			config: ImageConfig{Entrypoint: []string{"/app"}, User: "ghost:staff"},
+			layers: [][]tarEntry{{dir("etc"), passwd, group, file("app", 0o755, script)}},
+			errs:   []string{"User: user ghost is not in /etc/passwd", "User: group staff is not in /etc/group"},
+		},
+		{
+			name:   "no passwd",
+			config: ImageConfig{Entrypoint: []string{"/app"}, User: "nonroot"},
+			layers: [][]tarEntry{{file("app", 0o755, script)}},
+			errs:   []string{"User: user nonroot can't be found as /etc/passwd does not exist in the image; use a numeric ID instead"},
+		},
+		{
+			name:   "passwd removed by whiteout",
+			config: ImageConfig{Entrypoint: []string{"/app"}, User: "nonroot"},
+			layers: [][]tarEntry{
+				{dir("etc"), passwd, file("app", 0o755, script)},
+				{whiteout("etc/.wh.passwd")},
+			},
+			errs: []string{"User: user nonroot can't be found"},
+		},
+		{
+			name:   "every problem reported",
+			config: ImageConfig{Entrypoint: []string{"/app"}, WorkingDir: "/srv", User: "ghost"},
+			layers: [][]tarEntry{{dir("etc"), passwd}},
+			errs: []string{
+				"Entrypoint[0]: /app does not exist in the image",
+				"WorkingDir: /srv does not exist in the image",
+				"User: user ghost is not in /etc/passwd",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var layers [][]byte
+			for _, entries := range test.layers {
+				layers = append(layers, testLayer(t, entries...))
+			}
+			err := checkLayers(t, &test.config, layers...)
+			if len(test.errs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("expected a ConfigError, got %v", err)
+			}
+			if len(configErr.Errors) != len(test.errs) {
+				t.Fatalf("expected %d errors, got %v", len(test.errs), err)
+			}
+			for i, want := range test.errs {
+				if got := configErr.Errors[i].Error(); !strings.HasPrefix(got, want) {
+					t.Errorf("expected error %q, got %q", want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package scratchbuild
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ldSoConf is the file listing the host's extra library directories. Tests
+// change it.
+var ldSoConf = "/etc/ld.so.conf"
+
+// LibraryLayer builds a layer holding the dynamic loader and shared libraries
+// that the program the image runs needs, so that a dynamically linked program,
+// such as a Go program built with CGO, runs in an image without a
+// distribution base. config and layers are the image configuration and layers
+// BuildImage will be given; add the layer LibraryLayer returns after them.
+//
+// The libraries are copied from this machine, so the program must have been
+// built for it. Libraries are found as the dynamic loader would find them,
+// searching the program's RUNPATH, the standard library directories and those
+// in /etc/ld.so.conf, and libraries they need are added too. Each is put at the
+// path it has on this machine, except that libraries from the /etc/ld.so.conf
+// directories, which the image has no ld.so.conf to find, are put in the first
+// standard library directory this machine has, e.g. /usr/lib/x86_64-linux-gnu.
+// Libraries already in the layers are not added.
+// Libraries loaded with dlopen, such as NSS modules, are not found.
+//
+// LibraryLayer returns nil if the program is not a dynamically linked ELF
+// binary.
+func LibraryLayer(config *ImageConfig, layers ...[]byte) ([]byte, error) {
+	ix, err := indexLayers(layers)
+	if err != nil {
+		return nil, err
+	}
+	prog := ix.program(config)
+	if prog.err != nil {
+		return nil, fmt.Errorf("%s: %w", prog.field, prog.err)
+	}
+	if prog.binary == nil || !prog.binary.dynamic() {
+		return nil, nil
+	}
+
+	var b bytes.Buffer
+	lb := &libraryBundler{
+		ix:       ix,
+		lw:       NewLayerWriter(&b),
+		hostDirs: readLdSoConf(ldSoConf, map[string]bool{}),
+		added:    make(map[string]bool),
+	}
+	for _, e := range config.Env {
+		if strings.HasPrefix(e, "LD_LIBRARY_PATH=") {
+			lb.ldLibraryPath = strings.Split(strings.TrimPrefix(e, "LD_LIBRARY_PATH="), ":")
+		}
+	}
+	if err := lb.add(prog.binary, path.Dir(prog.path), ""); err != nil {
+		return nil, err
+	}
+	if err := lb.lw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// libraryBundler adds the libraries binaries need to a layer
+type libraryBundler struct {
+	ix *layerIndex
+	lw *LayerWriter
+	// ldLibraryPath is LD_LIBRARY_PATH in the image
+	ldLibraryPath []string
+	// hostDirs are the library directories from the host's ld.so.conf
+	hostDirs []string
+	// added records the libraries we have dealt with, by name
+	added map[string]bool
+}
+
+// add adds the loader and libraries a binary needs, and the libraries they
+// need. imageOrigin and hostOrigin are the directories containing the binary
+// in the image and on this machine, if known.
+func (lb *libraryBundler) add(bin *binaryInfo, imageOrigin, hostOrigin string) error {
+	if interp := bin.interpreter; interp != "" && !lb.added[interp] {
+		lb.added[interp] = true
+		// libc lists the loader as a needed library by name
+		lb.added[path.Base(interp)] = true
+		if _, _, err := lb.ix.lookup(interp); err != nil {
+			data, err := os.ReadFile(interp)
+			if err != nil {
+				return fmt.Errorf("could not read dynamic loader: %w", err)
+			}
+			if err := lb.lw.AddBytes(interp, data, 0o755); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, lib := range bin.needed {
+		if lb.added[lib] {
+			continue
+		}
+		lb.added[lib] = true
+		if lb.ix.findLibrary(lib, libraryDirs(bin, imageOrigin, lb.ldLibraryPath)) {
+			continue
+		}
+
+		dirs := append(libraryDirs(bin, hostOrigin, nil), lb.hostDirs...)
+		hostPath, data, libInfo, err := findHostLibrary(lib, dirs, bin)
+		if err != nil {
+			return err
+		}
+		imagePath := hostPath
+		if !strings.Contains(lib, "/") && !contains(libraryDirs(bin, hostOrigin, nil), path.Dir(hostPath)) {
+			imagePath = path.Join(standardLibraryDir(bin), lib)
+		}
+		if err := lb.lw.AddBytes(imagePath, data, 0o755); err != nil {
+			return err
+		}
+		realPath, err := filepath.EvalSymlinks(hostPath)
+		if err != nil {
+			return err
+		}
+		if err := lb.add(libInfo, "", filepath.Dir(realPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findHostLibrary looks for a library on this machine that the binary can load
+func findHostLibrary(lib string, dirs []string, bin *binaryInfo) (string, []byte, *binaryInfo, error) {
+	if strings.Contains(lib, "/") {
+		dirs, lib = []string{path.Dir(lib)}, path.Base(lib)
+	}
+	for _, dir := range dirs {
+		candidate := path.Join(dir, lib)
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			continue
+		}
+		info, err := readBinary(data)
+		if err != nil || info == nil {
+			continue
+		}
+		if info.machine != bin.machine || info.class != bin.class {
+			// e.g. a 32-bit library when we want 64-bit
+			continue
+		}
+		return candidate, data, info, nil
+	}
+	return "", nil, nil, fmt.Errorf("could not find library %s for %s on this machine", lib, archName(bin))
+}
+
+// standardLibraryDir picks the directory to put libraries in that the image's
+// loader would not otherwise find. This is the first of the loader's standard
+// directories this machine has, as the loader we copy is built for its layout.
+func standardLibraryDir(bin *binaryInfo) string {
+	for _, dir := range libraryDirs(&binaryInfo{architecture: bin.architecture}, "", nil) {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+	}
+	return "/usr/lib"
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func archName(bin *binaryInfo) string {
+	if bin.architecture != "" {
+		return bin.architecture
+	}
+	return bin.machine.String()
+}
+
+// readLdSoConf reads the library directories from an ld.so.conf file,
+// following include directives. It ignores files it can't read.
+func readLdSoConf(filename string, seen map[string]bool) []string {
+	if seen[filename] {
+		return nil
+	}
+	seen[filename] = true
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var dirs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if pattern := strings.TrimPrefix(line, "include "); pattern != line {
+			pattern = strings.TrimSpace(pattern)
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(filename), pattern)
+			}
+			matches, _ := filepath.Glob(pattern)
+			for _, m := range matches {
+				dirs = append(dirs, readLdSoConf(m, seen)...)
+			}
+			continue
+		}
+		if filepath.IsAbs(line) {
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs
+}
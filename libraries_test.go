@@ -0,0 +1,173 @@
+package scratchbuild
+
+import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// layerFiles lists the regular files in a layer
+func layerFiles(t *testing.T, layer []byte) []string {
+	t.Helper()
+	var files []string
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			files = append(files, "/"+h.Name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// useLdSoConf points LibraryLayer at an ld.so.conf listing dirs, read through
+// an include
+func useLdSoConf(t *testing.T, dirs ...string) {
+	t.Helper()
+	conf := t.TempDir()
+	if err := os.Mkdir(filepath.Join(conf, "conf.d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var extra bytes.Buffer
+	for _, dir := range dirs {
+		extra.WriteString(dir + " # a comment\n")
+	}
+	if err := os.WriteFile(filepath.Join(conf, "conf.d", "test.conf"), extra.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(conf, "ld.so.conf"), []byte("include conf.d/*.conf\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := ldSoConf
+	ldSoConf = filepath.Join(conf, "ld.so.conf")
+	t.Cleanup(func() { ldSoConf = old })
+}
+
+func writeLibrary(t *testing.T, dir, name string, spec elfSpec) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), buildELF(t, spec), 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLibraryLayerLdSoConfDirs(t *testing.T) {
+	amd64 := elfSpec{class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, machine: elf.EM_X86_64}
+
+	// The first directory has a 32-bit build of the library, which is skipped
+	libs32, libs := t.TempDir(), t.TempDir()
+	writeLibrary(t, libs32, "libtest.so.1", elfSpec{class: elf.ELFCLASS32, data: elf.ELFDATA2LSB, machine: elf.EM_386})
+	libtest := amd64
+	libtest.needed = []string{"libdep.so.2"}
+	writeLibrary(t, libs, "libtest.so.1", libtest)
+	writeLibrary(t, libs, "libdep.so.2", amd64)
+	useLdSoConf(t, libs32, libs)
+
+	prog := amd64
+	prog.needed = []string{"libtest.so.1"}
+	config := ImageConfig{Entrypoint: []string{"/app"}}
+	app := testLayer(t, file("app", 0o755, string(buildELF(t, prog))))
+
+	libraryDir := standardLibraryDir(&binaryInfo{architecture: "amd64"})
+	tests := []struct {
+		name   string
+		layers [][]byte
+		want   []string
+	}{
+		{
+			name:   "all libraries",
+			layers: [][]byte{app},
+			want:   []string{path.Join(libraryDir, "libdep.so.2"), path.Join(libraryDir, "libtest.so.1")},
+		},
+		{
+			name: "library already in the image",
+			layers: [][]byte{
+				testLayer(t, dir("usr"), dir("usr/lib"), file("usr/lib/libdep.so.2", 0o755, "libdep")),
+				app,
+			},
+			want: []string{path.Join(libraryDir, "libtest.so.1")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layer, err := LibraryLayer(&config, test.layers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files := layerFiles(t, layer); !reflect.DeepEqual(files, test.want) {
+				t.Errorf("expected %q, got %q", test.want, files)
+			}
+
+			// The loader in the image finds the libraries without an
+			// ld.so.conf
+			ix, err := indexLayers(append(test.layers, layer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ix.check(&config, Platform{OS: "linux", Architecture: "amd64"}, ix.program(&config)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLibraryLayerStandardDirs(t *testing.T) {
+	useLdSoConf(t)
+
+	// Use the C library on this machine, if it has one, which stays where it
+	// is
+	prog := elfSpec{class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, machine: elf.EM_X86_64, needed: []string{"libc.so.6"}}
+	bin, err := readBinary(buildELF(t, prog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	libc, _, _, err := findHostLibrary("libc.so.6", libraryDirs(bin, "", nil), bin)
+	if err != nil {
+		t.Skip("no amd64 C library on this machine")
+	}
+
+	config := ImageConfig{Entrypoint: []string{"/app"}}
+	layer, err := LibraryLayer(&config, testLayer(t, file("app", 0o755, string(buildELF(t, prog)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := layerFiles(t, layer)
+	if i := sort.SearchStrings(files, libc); i == len(files) || files[i] != libc {
+		t.Errorf("expected %s in %q", libc, files)
+	}
+}
+
+func TestLibraryLayerStatic(t *testing.T) {
+	layer, err := LibraryLayer(&ImageConfig{Entrypoint: []string{"/app"}}, testLayer(t, file("app", 0o755, string(buildELF(t, elfSpec{
+		class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, machine: elf.EM_X86_64,
+	})))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer != nil {
+		t.Error("expected no layer for a statically linked program")
+	}
+
+	// A missing library is an error
+	useLdSoConf(t)
+	_, err = LibraryLayer(&ImageConfig{Entrypoint: []string{"/app"}}, testLayer(t, file("app", 0o755, string(buildELF(t, elfSpec{
+		class: elf.ELFCLASS64, data: elf.ELFDATA2LSB, machine: elf.EM_X86_64, needed: []string{"libmissing.so.9"},
+	})))))
+	if err == nil || err.Error() != "could not find library libmissing.so.9 for amd64 on this machine" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package scratchbuild
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Pull fetches an image from the repository and writes it into the OCI image
+// layout directory dir, creating the layout if necessary. reference is a tag
+// or a digest. If it refers to an index or manifest list, every manifest in
+// the index is pulled. The digest of every blob is verified as it is
+// downloaded. The image is added to the layout's index.json, annotated with
+// the tag if reference is a tag. Pull returns the descriptor of the top-level
+// manifest.
+func (c *Client) Pull(reference, dir string) (Descriptor, error) {
+	if err := initLayout(dir); err != nil {
+		return Descriptor{}, err
+	}
+
+	data, desc, err := c.GetManifest(reference)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("could not fetch manifest for %s: %w", reference, err)
+	}
+
+	if err := c.pullManifest(dir, data, desc); err != nil {
+		return Descriptor{}, err
+	}
+
+	if !isDigest(reference) {
+		desc.Annotations = map[string]string{AnnotationRefName: reference}
+	}
+	if err := addToLayoutIndex(dir, desc); err != nil {
+		return Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// pullManifest pulls everything a manifest refers to into the layout, then
+// writes the manifest itself
+func (c *Client) pullManifest(dir string, data []byte, desc Descriptor) error {
+	switch {
+	case isIndex(desc.MediaType):
+		var index Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("could not unmarshal index %s: %w", desc.Digest, err)
+		}
+		for _, m := range index.Manifests {
+			childData, childDesc, err := c.GetManifest(m.Digest.String())
+			if err != nil {
+				return fmt.Errorf("could not fetch manifest %s: %w", m.Digest, err)
+			}
+			if err := c.pullManifest(dir, childData, childDesc); err != nil {
+				return err
+			}
+		}
+
+	case isImageManifest(desc.MediaType):
+		var manifest Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("could not unmarshal manifest %s: %w", desc.Digest, err)
+		}
+		for _, blob := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := c.pullBlob(dir, blob); err != nil {
+				return fmt.Errorf("could not pull blob %s: %w", blob.Digest, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("manifest %s has unsupported media type %q", desc.Digest, desc.MediaType)
+	}
+
+	return writeLayoutBlob(dir, desc.Digest, data)
+}
+
+// pullBlob downloads a blob into the layout, unless it is already there. A
+// blob file that doesn't match its digest, say from an interrupted copy, is
+// replaced.
+func (c *Client) pullBlob(dir string, desc Descriptor) error {
+	filename := layoutBlobPath(dir, desc.Digest)
+	if layoutBlobValid(filename, desc) {
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), "pull-*")
+	if err != nil {
+		return fmt.Errorf("could not create blob file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := c.fetchBlob(desc, f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not write blob file: %w", err)
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// layoutBlobValid reports whether a blob file exists and has the size and
+// digest it should
+func layoutBlobValid(filename string, desc Descriptor) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.Size() != desc.Size {
+		return false
+	}
+	verifier := desc.Digest.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return false
+	}
+	return verifier.Verified()
+}
+
+// ociLayout is the content of the oci-layout file
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// initLayout creates the basic structure of an OCI image layout, if it does
+// not already exist
+func initLayout(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", string(digest.Canonical)), 0o755); err != nil {
+		return fmt.Errorf("could not create OCI layout: %w", err)
+	}
+
+	layoutFile := filepath.Join(dir, "oci-layout")
+	if _, err := os.Stat(layoutFile); err == nil {
+		return nil
+	}
+	data, err := json.Marshal(ociLayout{ImageLayoutVersion: "1.0.0"})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(layoutFile, data, 0o644); err != nil {
+		return fmt.Errorf("could not create OCI layout: %w", err)
+	}
+	return nil
+}
+
+func layoutBlobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// writeLayoutBlob writes content we already hold into the layout
+func writeLayoutBlob(dir string, dgst digest.Digest, data []byte) error {
+	filename := layoutBlobPath(dir, dgst)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return fmt.Errorf("could not create blob directory: %w", err)
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		return fmt.Errorf("could not write blob %s: %w", dgst, err)
+	}
+	return nil
+}
+
+// addToLayoutIndex adds a manifest to the layout's index.json. Any existing
+// entry with the same tag is replaced.
+func addToLayoutIndex(dir string, desc Descriptor) error {
+	filename := filepath.Join(dir, "index.json")
+	index := Index{
+		Versioned: Versioned{SchemaVersion: 2, MediaType: MediaTypeOCIIndex},
+	}
+	data, err := os.ReadFile(filename)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("could not unmarshal layout index.json: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("could not read layout index.json: %w", err)
+	}
+
+	refName := desc.Annotations[AnnotationRefName]
+	manifests := index.Manifests[:0]
+	for _, m := range index.Manifests {
+		if existing := m.Annotations[AnnotationRefName]; existing == refName && (refName != "" || m.Digest == desc.Digest) {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	index.Manifests = append(manifests, desc)
+
+	data, err = json.MarshalIndent(&index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal layout index.json: %w", err)
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		return fmt.Errorf("could not write layout index.json: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package scratchbuild_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func layoutBlob(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func TestPull(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "v1")
+
+	dir := t.TempDir()
+	c := newClient(t, r, "test/app")
+	desc, err := c.Pull("v1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != result.ManifestDigest || desc.Annotations[scratchbuild.AnnotationRefName] != "v1" {
+		t.Errorf("unexpected descriptor %+v", desc)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		t.Error(err)
+	}
+	for _, dgst := range []digest.Digest{result.ManifestDigest, result.ConfigDigest, result.Layers[0].Digest} {
+		data, err := os.ReadFile(layoutBlob(dir, dgst))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest.FromBytes(data) != dgst {
+			t.Errorf("blob %s has the wrong content", dgst)
+		}
+	}
+
+	var index scratchbuild.Index
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != result.ManifestDigest {
+		t.Errorf("unexpected index %+v", index)
+	}
+
+	// Pulling again doesn't download the blobs again, and doesn't add another
+	// entry for the tag
+	blobGets := countRequests(r, "GET /v2/test/app/blobs/")
+	if _, err := c.Pull("v1", dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(r, "GET /v2/test/app/blobs/"); n != blobGets {
+		t.Errorf("expected no more blob downloads, got %d", n-blobGets)
+	}
+	index = scratchbuild.Index{}
+	data, _ = os.ReadFile(filepath.Join(dir, "index.json"))
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Errorf("expected one entry in the index, got %d", len(index.Manifests))
+	}
+}
+
+func TestPullReplacesCorruptBlob(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "v1")
+
+	dir := t.TempDir()
+	c := newClient(t, r, "test/app")
+	if _, err := c.Pull("v1", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the layer without changing its size
+	filename := layoutBlob(dir, result.Layers[0].Digest)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	blobGets := countRequests(r, "GET /v2/test/app/blobs/")
+	if _, err := c.Pull("v1", dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(r, "GET /v2/test/app/blobs/"); n != blobGets+1 {
+		t.Errorf("expected the layer to be downloaded again, got %d downloads", n-blobGets)
+	}
+	data, err = os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(data) != result.Layers[0].Digest {
+		t.Error("layer has not been replaced")
+	}
+}
+
+func TestPullIndex(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "amd64")
+
+	index, err := json.Marshal(scratchbuild.Index{
+		Versioned: scratchbuild.Versioned{SchemaVersion: 2, MediaType: scratchbuild.MediaTypeOCIIndex},
+		Manifests: []scratchbuild.Descriptor{{
+			MediaType: result.MediaType,
+			Digest:    result.ManifestDigest,
+			Size:      result.ManifestSize,
+			Platform:  &scratchbuild.Platform{Architecture: "amd64", OS: "linux"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDigest := r.PutManifest("test/app", scratchbuild.MediaTypeOCIIndex, index)
+
+	dir := t.TempDir()
+	desc, err := newClient(t, r, "test/app").Pull(indexDigest.String(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != indexDigest || desc.Annotations != nil {
+		t.Errorf("unexpected descriptor %+v", desc)
+	}
+	for _, dgst := range []digest.Digest{indexDigest, result.ManifestDigest, result.ConfigDigest, result.Layers[0].Digest} {
+		if _, err := os.Stat(layoutBlob(dir, dgst)); err != nil {
+			t.Error(err)
+		}
+	}
+}
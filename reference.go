@@ -0,0 +1,149 @@
+package scratchbuild
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// dockerHubRegistry is the name we give the Docker Hub registry in references
+	dockerHubRegistry = "docker.io"
+	// dockerHubURL is where the Docker Hub registry API actually lives
+	dockerHubURL = "https://registry-1.docker.io"
+)
+
+var (
+	// pathComponentRE matches a single component of a repository path
+	pathComponentRE = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	// tagRE matches a valid tag
+	tagRE = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// Reference is a parsed image reference such as eu.gcr.io/proj/app:v1.2 or
+// alpine@sha256:...
+type Reference struct {
+	// Registry is the host (and optional port) of the registry, e.g. eu.gcr.io
+	// or localhost:5000. Docker Hub references have the registry docker.io.
+	Registry string
+	// Repository is the path of the repository within the registry, e.g.
+	// proj/app. Docker Hub official images have the prefix library/.
+	Repository string
+	// Tag is the tag, if any.
+	Tag string
+	// Digest is the digest, if any.
+	Digest digest.Digest
+}
+
+// ParseReference parses an image reference of the form
+// [registry/]path/name[:tag][@digest]. References without a registry are
+// Docker Hub references, and single component Docker Hub names get the
+// library/ prefix, so "alpine" becomes "docker.io/library/alpine".
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	rest := s
+	if i := strings.IndexByte(rest, '@'); i >= 0 {
+		dig, err := digest.Parse(rest[i+1:])
+		if err != nil {
+			return ref, fmt.Errorf("invalid digest in reference %q: %w", s, err)
+		}
+		ref.Digest = dig
+		rest = rest[:i]
+	}
+
+	// A tag follows the last colon, but only if that colon is after the last
+	// slash. Otherwise it is part of a registry host:port.
+	if i := strings.LastIndexByte(rest, ':'); i > strings.LastIndexByte(rest, '/') {
+		ref.Tag = rest[i+1:]
+		rest = rest[:i]
+		if !tagRE.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag %q in reference %q", ref.Tag, s)
+		}
+	}
+
+	if i := strings.IndexByte(rest, '/'); i >= 0 && isRegistryHost(rest[:i]) {
+		ref.Registry, ref.Repository = rest[:i], rest[i+1:]
+	} else {
+		ref.Registry, ref.Repository = dockerHubRegistry, rest
+	}
+
+	if ref.Registry == "index.docker.io" || ref.Registry == "registry-1.docker.io" {
+		ref.Registry = dockerHubRegistry
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+
+	if ref.Repository == "" {
+		return ref, fmt.Errorf("no repository name in reference %q", s)
+	}
+	for _, part := range strings.Split(ref.Repository, "/") {
+		if !pathComponentRE.MatchString(part) {
+			return ref, fmt.Errorf("invalid repository name %q in reference %q", ref.Repository, s)
+		}
+	}
+
+	return ref, nil
+}
+
+// isRegistryHost decides whether the first component of a reference is a
+// registry host rather than part of a Docker Hub repository path
+func isRegistryHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// Name returns the fully-qualified repository name, e.g. eu.gcr.io/proj/app
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// String returns the fully-qualified reference
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// BaseURL returns the base URL of the registry API. Registries on localhost
+// are assumed to use plain HTTP.
+func (r Reference) BaseURL() string {
+	if r.Registry == dockerHubRegistry {
+		return dockerHubURL
+	}
+	host := r.Registry
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	if host == "localhost" || host == "127.0.0.1" {
+		return "http://" + r.Registry
+	}
+	return "https://" + r.Registry
+}
+
+// registryFromURL converts a registry base URL back into the registry name
+// used in references
+func registryFromURL(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return baseURL
+	}
+	switch u.Host {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHubRegistry
+	}
+	return u.Host
+}
+
+// isDigest reports whether a tag given in Options.Tags is actually a digest
+func isDigest(tag string) bool {
+	_, err := digest.Parse(tag)
+	return err == nil
+}
@@ -0,0 +1,130 @@
+package scratchbuild_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+func TestParseReference(t *testing.T) {
+	const dgst = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	tests := []struct {
+		in      string
+		want    scratchbuild.Reference
+		baseURL string
+		err     string
+	}{
+		{
+			in:      "localhost:5000/app:v1",
+			want:    scratchbuild.Reference{Registry: "localhost:5000", Repository: "app", Tag: "v1"},
+			baseURL: "http://localhost:5000",
+		},
+		{
+			in:      "localhost:5000/team/app",
+			want:    scratchbuild.Reference{Registry: "localhost:5000", Repository: "team/app"},
+			baseURL: "http://localhost:5000",
+		},
+		{
+			in:      "localhost/app",
+			want:    scratchbuild.Reference{Registry: "localhost", Repository: "app"},
+			baseURL: "http://localhost",
+		},
+		{
+			in:      "127.0.0.1:5000/app:v1",
+			want:    scratchbuild.Reference{Registry: "127.0.0.1:5000", Repository: "app", Tag: "v1"},
+			baseURL: "http://127.0.0.1:5000",
+		},
+		{
+			in:      "registry.example.com:8443/team/app",
+			want:    scratchbuild.Reference{Registry: "registry.example.com:8443", Repository: "team/app"},
+			baseURL: "https://registry.example.com:8443",
+		},
+		{
+			in:      "eu.gcr.io/proj/app:v1.2",
+			want:    scratchbuild.Reference{Registry: "eu.gcr.io", Repository: "proj/app", Tag: "v1.2"},
+			baseURL: "https://eu.gcr.io",
+		},
+		{
+			in:      "eu.gcr.io/proj/app:v1@" + dgst,
+			want:    scratchbuild.Reference{Registry: "eu.gcr.io", Repository: "proj/app", Tag: "v1", Digest: dgst},
+			baseURL: "https://eu.gcr.io",
+		},
+		{
+			in:      "alpine@" + dgst,
+			want:    scratchbuild.Reference{Registry: "docker.io", Repository: "library/alpine", Digest: dgst},
+			baseURL: "https://registry-1.docker.io",
+		},
+		{
+			// localhost on its own is a Docker Hub name, not a registry
+			in:      "localhost:v1",
+			want:    scratchbuild.Reference{Registry: "docker.io", Repository: "library/localhost", Tag: "v1"},
+			baseURL: "https://registry-1.docker.io",
+		},
+		{
+			in:      "docker.io/alpine",
+			want:    scratchbuild.Reference{Registry: "docker.io", Repository: "library/alpine"},
+			baseURL: "https://registry-1.docker.io",
+		},
+		{
+			in:      "index.docker.io/alpine:3",
+			want:    scratchbuild.Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3"},
+			baseURL: "https://registry-1.docker.io",
+		},
+		{
+			in:      "registry-1.docker.io/philpearl/test",
+			want:    scratchbuild.Reference{Registry: "docker.io", Repository: "philpearl/test"},
+			baseURL: "https://registry-1.docker.io",
+		},
+		{
+			in:      "philpearl/test:v1",
+			want:    scratchbuild.Reference{Registry: "docker.io", Repository: "philpearl/test", Tag: "v1"},
+			baseURL: "https://registry-1.docker.io",
+		},
+		{
+			in:      "ghcr.io/org/my-app__x.y:V1_2.3-rc",
+			want:    scratchbuild.Reference{Registry: "ghcr.io", Repository: "org/my-app__x.y", Tag: "V1_2.3-rc"},
+			baseURL: "https://ghcr.io",
+		},
+
+		{in: "ghcr.io/Org/app", err: `invalid repository name "Org/app"`},
+		{in: "Alpine", err: `invalid repository name "library/Alpine"`},
+		{in: "ghcr.io/org//app", err: `invalid repository name "org//app"`},
+		{in: "ghcr.io/org/-app", err: `invalid repository name "org/-app"`},
+		{in: "ghcr.io/", err: "no repository name"},
+		{in: "", err: `invalid repository name "library/"`},
+		{in: "alpine:", err: `invalid tag ""`},
+		{in: "alpine:-v1", err: `invalid tag "-v1"`},
+		{in: "alpine:" + strings.Repeat("a", 129), err: "invalid tag"},
+		{in: "alpine@sha256:abc", err: "invalid digest"},
+		{in: "alpine@v1", err: "invalid digest"},
+		{in: "alpine:v1@", err: "invalid digest"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			ref, err := scratchbuild.ParseReference(test.in)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %+v, %v", test.err, ref, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref != test.want {
+				t.Errorf("expected %+v, got %+v", test.want, ref)
+			}
+			if got := ref.BaseURL(); got != test.baseURL {
+				t.Errorf("expected base URL %s, got %s", test.baseURL, got)
+			}
+
+			// The reference parses back to itself
+			again, err := scratchbuild.ParseReference(ref.String())
+			if err != nil || again != ref {
+				t.Errorf("%s parses to %+v, %v", ref, again, err)
+			}
+		})
+	}
+}
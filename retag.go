@@ -0,0 +1,33 @@
+package scratchbuild
+
+import "fmt"
+
+// Tag adds tags to an existing image in the repository without rebuilding it.
+// reference is the tag or digest of the image. The manifest bytes are pushed
+// unchanged under each new tag, so this works equally for image manifests and
+// indexes, and the image keeps its digest. If NoOverwrite is set no tags are
+// changed if any of them already points to a different image. Tag returns the
+// descriptor of the manifest.
+func (c *Client) Tag(reference string, tags ...string) (Descriptor, error) {
+	for _, tag := range tags {
+		if !isDigest(tag) && !tagRE.MatchString(tag) {
+			return Descriptor{}, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+
+	data, desc, err := c.GetManifest(reference)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("could not fetch manifest for %s: %w", reference, err)
+	}
+
+	if err := c.checkTags(tags, desc.Digest); err != nil {
+		return Descriptor{}, err
+	}
+
+	for _, tag := range tags {
+		if _, err := c.pushManifest(desc.Digest, data, desc.MediaType, tag); err != nil {
+			return Descriptor{}, fmt.Errorf("could not send manifest for tag %s: %w", tag, err)
+		}
+	}
+	return desc, nil
+}
@@ -0,0 +1,94 @@
+package scratchbuild_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestTag(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "build-1")
+	orig, _, _ := r.Manifest("test/app", "build-1")
+
+	c := newClient(t, r, "test/app")
+	desc, err := c.Tag("build-1", "v1", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != result.ManifestDigest {
+		t.Errorf("unexpected digest %s", desc.Digest)
+	}
+	if tags, want := r.Tags("test/app"), []string{"build-1", "latest", "v1"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("expected tags %v, got %v", want, tags)
+	}
+	for _, tag := range []string{"v1", "latest"} {
+		if data, _, _ := r.Manifest("test/app", tag); !bytes.Equal(data, orig) {
+			t.Errorf("tag %s does not have the original manifest", tag)
+		}
+	}
+	// No blobs are pushed
+	if n := countRequests(r, "POST "); n != 2 {
+		t.Errorf("expected only the original 2 blob uploads, got %d", n)
+	}
+
+	// Tagging by digest works too, and pushing a tag that is already right
+	// doesn't push the manifest again
+	puts := countRequests(r, "PUT /v2/test/app/manifests/")
+	if _, err := c.Tag(result.ManifestDigest.String(), "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(r, "PUT /v2/test/app/manifests/"); n != puts {
+		t.Errorf("expected no manifest push, got %d", n-puts)
+	}
+}
+
+func TestTagInvalid(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	pushApp(t, r, "test/app", "v1")
+
+	if _, err := newClient(t, r, "test/app").Tag("v1", "ok", "not ok"); err == nil {
+		t.Error("expected an error for an invalid tag")
+	}
+	if tags := r.Tags("test/app"); len(tags) != 1 {
+		t.Errorf("expected no tags to be added, got %v", tags)
+	}
+	if _, err := newClient(t, r, "test/app").Tag("v2", "latest"); !scratchbuild.HasErrorCode(err, scratchbuild.ErrorCodeManifestUnknown) {
+		t.Errorf("expected MANIFEST_UNKNOWN tagging a missing image, got %v", err)
+	}
+}
+
+func TestTagNoOverwrite(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	results := pushBuilds(t, r, 1, 2)
+
+	c := newClient(t, r, "test/app")
+	c.NoOverwrite = true
+	if _, err := c.Tag("build-1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	// Moving v1 is refused, and the new tag isn't added either
+	_, err := c.Tag("build-2", "new", "v1")
+	var exists *scratchbuild.TagExistsError
+	if !errors.As(err, &exists) {
+		t.Fatalf("expected a TagExistsError, got %v", err)
+	}
+	if exists.Tag != "v1" || exists.Existing != results["build-1"].ManifestDigest || exists.Digest != results["build-2"].ManifestDigest {
+		t.Errorf("unexpected error %+v", exists)
+	}
+	if tags, want := r.Tags("test/app"), []string{"build-1", "build-2", "v1"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("expected tags %v, got %v", want, tags)
+	}
+
+	// Tagging with the same image again is fine
+	if _, err := c.Tag("build-1", "v1"); err != nil {
+		t.Error(err)
+	}
+}
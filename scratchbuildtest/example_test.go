@@ -0,0 +1,55 @@
+package scratchbuildtest_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func ExampleRegistry() {
+	r := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{
+		User:     "philpearl",
+		Password: "sekret",
+	})
+	defer r.Close()
+
+	o := r.ClientOptions("philpearl/test", "latest", "v1")
+	c := scratchbuild.New(&o)
+	token, err := c.Auth()
+	if err != nil {
+		log.Fatalf("failed to authorize. %s", err)
+	}
+	c.Token = func() string { return token }
+
+	b := &bytes.Buffer{}
+	if err := scratchbuild.TarDirectory("../testdata", b); err != nil {
+		log.Fatalf("failed to tar layer. %s", err)
+	}
+
+	result, err := c.BuildImage(&scratchbuild.ImageConfig{Entrypoint: []string{"/app"}}, b.Bytes())
+	if err != nil {
+		log.Fatalf("failed to build and send image. %s", err)
+	}
+	_, _, ok := r.Manifest("philpearl/test", result.ManifestDigest.String())
+	fmt.Println(r.Tags("philpearl/test"), ok)
+
+	// Now make the registry rate limit manifest pushes
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/manifests/") {
+			scratchbuildtest.WriteError(w, http.StatusTooManyRequests, scratchbuild.ErrorCodeTooManyRequests, "slow down")
+			return true
+		}
+		return false
+	})
+	result, err = c.BuildImage(&scratchbuild.ImageConfig{Entrypoint: []string{"/app"}}, b.Bytes())
+	fmt.Println(result == nil, scratchbuild.HasErrorCode(err, scratchbuild.ErrorCodeTooManyRequests))
+
+	// Output:
+	// [latest v1] true
+	// true true
+}
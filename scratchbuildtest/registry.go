@@ -0,0 +1,559 @@
+/*
+Package scratchbuildtest provides an in-memory registry implementing the OCI
+distribution API, for testing code that pushes and pulls images with
+scratchbuild.
+*/
+package scratchbuildtest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/philpearl/scratchbuild"
+)
+
+// Options configures a Registry
+type Options struct {
+	// User and Password enable token authentication. If User is set, clients
+	// must fetch a token from the registry's token endpoint using these
+	// credentials, just as they would with Docker Hub.
+	User     string
+	Password string
+	// DisableDelete makes the registry refuse to delete manifests, as many
+	// real registries do.
+	DisableDelete bool
+	// Hook, if set, is called before each request is handled. If it returns
+	// true the request is considered handled and the registry does nothing
+	// more. Use it to inject failures, perhaps with WriteError.
+	Hook func(w http.ResponseWriter, r *http.Request) bool
+}
+
+// Registry is an in-memory registry running on an httptest.Server
+type Registry struct {
+	*httptest.Server
+
+	user          string
+	password      string
+	disableDelete bool
+
+	mu        sync.Mutex
+	hook      func(w http.ResponseWriter, r *http.Request) bool
+	blobs     map[digest.Digest][]byte
+	repoBlobs map[string]map[digest.Digest]bool
+	manifests map[string]map[digest.Digest]manifest
+	tags      map[string]map[string]digest.Digest
+	uploads   map[string]*upload
+	tokens    map[string]bool
+	requests  []string
+}
+
+type manifest struct {
+	data      []byte
+	mediaType string
+}
+
+type upload struct {
+	repo string
+	data bytes.Buffer
+}
+
+// NewRegistry starts a new in-memory registry. Call Close when finished with it.
+func NewRegistry(o *Options) *Registry {
+	if o == nil {
+		o = &Options{}
+	}
+	r := &Registry{
+		user:          o.User,
+		password:      o.Password,
+		disableDelete: o.DisableDelete,
+		hook:          o.Hook,
+		blobs:         make(map[digest.Digest][]byte),
+		repoBlobs:     make(map[string]map[digest.Digest]bool),
+		manifests:     make(map[string]map[digest.Digest]manifest),
+		tags:          make(map[string]map[string]digest.Digest),
+		uploads:       make(map[string]*upload),
+		tokens:        make(map[string]bool),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// ClientOptions returns scratchbuild Options for talking to the repository
+// name on this registry.
+func (r *Registry) ClientOptions(name string, tags ...string) scratchbuild.Options {
+	return scratchbuild.Options{
+		BaseURL:    r.URL,
+		Name:       name,
+		Tags:       tags,
+		User:       r.user,
+		Password:   r.password,
+		HTTPClient: r.Client(),
+	}
+}
+
+// SetHook replaces the hook called before each request. See Options.Hook.
+func (r *Registry) SetHook(hook func(w http.ResponseWriter, r *http.Request) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hook = hook
+}
+
+// Requests returns the requests the registry has received, each as
+// "METHOD /path"
+func (r *Registry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+// Blob returns the content of a blob in a repository
+func (r *Registry) Blob(repo string, dgst digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.repoBlobs[repo][dgst] {
+		return nil, false
+	}
+	return r.blobs[dgst], true
+}
+
+// PutBlob adds a blob to a repository
+func (r *Registry) PutBlob(repo string, data []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dgst := digest.FromBytes(data)
+	r.addBlob(repo, dgst, data)
+	return dgst
+}
+
+// Manifest returns a manifest and its media type. reference may be a tag or
+// a digest.
+func (r *Registry) Manifest(repo, reference string) (data []byte, mediaType string, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.lookupManifest(repo, reference)
+	return m.data, m.mediaType, ok
+}
+
+// PutManifest adds a manifest to a repository, tagging it with each of the
+// tags. Unlike a push over HTTP it does not check the referenced blobs exist.
+func (r *Registry) PutManifest(repo, mediaType string, data []byte, tags ...string) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dgst := digest.FromBytes(data)
+	r.addManifest(repo, dgst, manifest{data: data, mediaType: mediaType})
+	for _, tag := range tags {
+		r.tags[repo][tag] = dgst
+	}
+	return dgst
+}
+
+// Tags returns the tags in a repository in lexical order
+func (r *Registry) Tags(repo string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sortedTags(repo)
+}
+
+// WriteError writes a distribution API error response
+func WriteError(w http.ResponseWriter, status int, code scratchbuild.ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]scratchbuild.ErrorInfo{
+		"errors": {{Code: code, Message: message}},
+	})
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	hook := r.hook
+	r.mu.Unlock()
+
+	if hook != nil && hook(w, req) {
+		return
+	}
+
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	if !r.authorized(req) {
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="scratchbuildtest"`, r.URL))
+		WriteError(w, http.StatusUnauthorized, scratchbuild.ErrorCodeUnauthorized, "authentication required")
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i > 0 {
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i > 0 {
+		r.serveBlob(w, req, path[:i], path[i+len("/blobs/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i > 0 {
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		r.serveTags(w, req, strings.TrimSuffix(path, "/tags/list"))
+		return
+	}
+	WriteError(w, http.StatusNotFound, scratchbuild.ErrorCodeNameUnknown, "unknown path")
+}
+
+func (r *Registry) authorized(req *http.Request) bool {
+	if r.user == "" {
+		return true
+	}
+	tok := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokens[tok]
+}
+
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	user, password, ok := req.BasicAuth()
+	if !ok || user != r.user || password != r.password {
+		WriteError(w, http.StatusUnauthorized, scratchbuild.ErrorCodeUnauthorized, "incorrect username or password")
+		return
+	}
+
+	tok := randomID()
+	r.mu.Lock()
+	r.tokens[tok] = true
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": tok})
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeDigestInvalid, err.Error())
+		return
+	}
+
+	switch req.Method {
+	case http.MethodHead, http.MethodGet:
+		if !r.repoBlobs[repo][dgst] {
+			if req.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			WriteError(w, http.StatusNotFound, scratchbuild.ErrorCodeBlobUnknown, "blob unknown to registry")
+			return
+		}
+		data := r.blobs[dgst]
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		WriteError(w, http.StatusMethodNotAllowed, scratchbuild.ErrorCodeUnsupported, "method not allowed")
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, repo, id string) {
+	if id == "" {
+		if req.Method != http.MethodPost {
+			WriteError(w, http.StatusMethodNotAllowed, scratchbuild.ErrorCodeUnsupported, "method not allowed")
+			return
+		}
+		r.startUpload(w, req, repo)
+		return
+	}
+
+	up, ok := r.uploads[id]
+	if !ok || up.repo != repo {
+		WriteError(w, http.StatusNotFound, scratchbuild.ErrorCodeBlobUploadUnknown, "blob upload unknown to registry")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPatch:
+		io.Copy(&up.data, req.Body)
+		r.uploadAccepted(w, repo, id, up)
+	case http.MethodPut:
+		io.Copy(&up.data, req.Body)
+		if r.completeUpload(w, repo, req.URL.Query().Get("digest"), up.data.Bytes()) {
+			delete(r.uploads, id)
+		}
+	case http.MethodDelete:
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		WriteError(w, http.StatusMethodNotAllowed, scratchbuild.ErrorCodeUnsupported, "method not allowed")
+	}
+}
+
+func (r *Registry) startUpload(w http.ResponseWriter, req *http.Request, repo string) {
+	q := req.URL.Query()
+	if mount, from := q.Get("mount"), q.Get("from"); mount != "" && from != "" {
+		if dgst, err := digest.Parse(mount); err == nil && r.repoBlobs[from][dgst] {
+			r.addBlob(repo, dgst, r.blobs[dgst])
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/"+dgst.String())
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		// Fall through to a normal upload, as the spec says
+	}
+
+	if dgst := q.Get("digest"); dgst != "" {
+		// A monolithic upload in a single POST
+		data, _ := io.ReadAll(req.Body)
+		r.completeUpload(w, repo, dgst, data)
+		return
+	}
+
+	id := randomID()
+	up := &upload{repo: repo}
+	r.uploads[id] = up
+	r.uploadAccepted(w, repo, id, up)
+}
+
+func (r *Registry) uploadAccepted(w http.ResponseWriter, repo, id string, up *upload) {
+	w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+	w.Header().Set("Docker-Upload-UUID", id)
+	end := up.data.Len() - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (r *Registry) completeUpload(w http.ResponseWriter, repo, ref string, data []byte) bool {
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeDigestInvalid, "invalid or missing digest")
+		return false
+	}
+	if actual := digest.FromBytes(data); actual != dgst {
+		WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeDigestInvalid, fmt.Sprintf("content has digest %s", actual))
+		return false
+	}
+	r.addBlob(repo, dgst, append([]byte(nil), data...))
+	w.Header().Set("Location", "/v2/"+repo+"/blobs/"+dgst.String())
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+	return true
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	switch req.Method {
+	case http.MethodHead, http.MethodGet:
+		m, ok := r.lookupManifest(repo, ref)
+		if !ok {
+			if req.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			WriteError(w, http.StatusNotFound, scratchbuild.ErrorCodeManifestUnknown, "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.data)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.data).String())
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(m.data)
+		}
+	case http.MethodPut:
+		r.putManifest(w, req, repo, ref)
+	case http.MethodDelete:
+		r.deleteManifest(w, repo, ref)
+	default:
+		WriteError(w, http.StatusMethodNotAllowed, scratchbuild.ErrorCodeUnsupported, "method not allowed")
+	}
+}
+
+func (r *Registry) putManifest(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeManifestInvalid, err.Error())
+		return
+	}
+	dgst := digest.FromBytes(data)
+
+	if refDigest, err := digest.Parse(ref); err == nil && refDigest != dgst {
+		WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeDigestInvalid, fmt.Sprintf("manifest has digest %s", dgst))
+		return
+	}
+
+	// Check everything the manifest refers to is present
+	var content struct {
+		Config    *scratchbuild.Descriptor  `json:"config"`
+		Layers    []scratchbuild.Descriptor `json:"layers"`
+		Manifests []scratchbuild.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeManifestInvalid, err.Error())
+		return
+	}
+	blobs := content.Layers
+	if content.Config != nil {
+		blobs = append(blobs, *content.Config)
+	}
+	for _, desc := range blobs {
+		if !r.repoBlobs[repo][desc.Digest] {
+			WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeManifestBlobUnknown, fmt.Sprintf("blob %s unknown to registry", desc.Digest))
+			return
+		}
+	}
+	for _, desc := range content.Manifests {
+		if _, ok := r.manifests[repo][desc.Digest]; !ok {
+			WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeManifestBlobUnknown, fmt.Sprintf("manifest %s unknown to registry", desc.Digest))
+			return
+		}
+	}
+
+	r.addManifest(repo, dgst, manifest{data: data, mediaType: req.Header.Get("Content-Type")})
+	if !isDigest(ref) {
+		r.tags[repo][ref] = dgst
+	}
+
+	w.Header().Set("Location", "/v2/"+repo+"/manifests/"+dgst.String())
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (r *Registry) deleteManifest(w http.ResponseWriter, repo, ref string) {
+	if r.disableDelete {
+		WriteError(w, http.StatusMethodNotAllowed, scratchbuild.ErrorCodeUnsupported, "deletion is disabled")
+		return
+	}
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeDigestInvalid, "manifests can only be deleted by digest")
+		return
+	}
+	if _, ok := r.manifests[repo][dgst]; !ok {
+		WriteError(w, http.StatusNotFound, scratchbuild.ErrorCodeManifestUnknown, "manifest unknown")
+		return
+	}
+
+	delete(r.manifests[repo], dgst)
+	for tag, tagged := range r.tags[repo] {
+		if tagged == dgst {
+			delete(r.tags[repo], tag)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (r *Registry) serveTags(w http.ResponseWriter, req *http.Request, repo string) {
+	if req.Method != http.MethodGet {
+		WriteError(w, http.StatusMethodNotAllowed, scratchbuild.ErrorCodeUnsupported, "method not allowed")
+		return
+	}
+	if _, ok := r.tags[repo]; !ok {
+		WriteError(w, http.StatusNotFound, scratchbuild.ErrorCodeNameUnknown, "repository name not known to registry")
+		return
+	}
+
+	tags := r.sortedTags(repo)
+	q := req.URL.Query()
+	if last := q.Get("last"); last != "" {
+		i := sort.SearchStrings(tags, last)
+		if i < len(tags) && tags[i] == last {
+			i++
+		}
+		tags = tags[i:]
+	}
+	if n, err := strconv.Atoi(q.Get("n")); err == nil && n >= 0 && n < len(tags) {
+		tags = tags[:n]
+		if n > 0 {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, repo, n, tags[n-1]))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{Name: repo, Tags: tags})
+}
+
+func (r *Registry) addBlob(repo string, dgst digest.Digest, data []byte) {
+	r.blobs[dgst] = data
+	if r.repoBlobs[repo] == nil {
+		r.repoBlobs[repo] = make(map[digest.Digest]bool)
+	}
+	r.repoBlobs[repo][dgst] = true
+}
+
+func (r *Registry) addManifest(repo string, dgst digest.Digest, m manifest) {
+	if r.manifests[repo] == nil {
+		r.manifests[repo] = make(map[digest.Digest]manifest)
+	}
+	r.manifests[repo][dgst] = m
+	if r.tags[repo] == nil {
+		r.tags[repo] = make(map[string]digest.Digest)
+	}
+}
+
+func (r *Registry) lookupManifest(repo, ref string) (manifest, bool) {
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		var ok bool
+		if dgst, ok = r.tags[repo][ref]; !ok {
+			return manifest{}, false
+		}
+	}
+	m, ok := r.manifests[repo][dgst]
+	return m, ok
+}
+
+func (r *Registry) sortedTags(repo string) []string {
+	tags := make([]string, 0, len(r.tags[repo]))
+	for tag := range r.tags[repo] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func isDigest(ref string) bool {
+	_, err := digest.Parse(ref)
+	return err == nil
+}
+
+func randomID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
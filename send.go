@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	digest "github.com/opencontainers/go-digest"
 )
@@ -27,8 +27,73 @@ type Options struct {
 	// Token is the bearer token for the repository. For GCR you can use $(gcloud auth print-access-token).
 	// For Docker, supply your Docker Hub username and password instead.
 	Token func() string
-	// Tag is the tag for the image. Set to "latest" if you're out of ideas
+	// Tags are the tags for the image. Set to "latest" if you're out of ideas. A
+	// tag may instead be a digest (sha256:...), in which case the image is
+	// pushed by digest and the digest must match the manifest we build. If
+	// there are no tags at all the image is pushed by its digest.
 	Tags []string
+	// OnEvent, if set, is called to report progress such as authentication,
+	// blob checks, upload progress and manifest pushes. It may be called from
+	// multiple goroutines.
+	OnEvent func(Event)
+	// NoOverwrite refuses to push a tag that already points to a different
+	// image, returning a *TagExistsError instead. Use it to stop release tags
+	// being replaced.
+	NoOverwrite bool
+	// Verify checks each push by comparing the digest the registry reports
+	// for the manifest with the one we computed, then reading the manifest
+	// back by tag and checking the registry has every blob it refers to.
+	// Failures wrap ErrVerifyFailed.
+	Verify bool
+	// NoLayerChecks turns off the checks BuildImage makes that the layers
+	// contain what the image configuration refers to: an executable
+	// entrypoint, the working directory, and the user and group names.
+	NoLayerChecks bool
+	// Created is the creation time recorded in built images. If it is zero the
+	// current time is used. Set it, for example to the time of the last commit,
+	// to make builds reproducible so unchanged images are not pushed again.
+	Created time.Time
+	// MountFrom lists other repositories on the same registry that Auth should
+	// request pull access to, so that blobs can be mounted from them rather
+	// than uploaded. Copy uses this.
+	MountFrom []string
+	// HTTPClient is used for all requests to the registry. If nil
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+	// Author is recorded in built images as the author
+	Author string
+	// Platform is the platform recorded in built images. If Architecture is not
+	// set BuildImage uses the architecture of the entrypoint binary, or amd64.
+	// If OS is not set linux is used.
+	Platform Platform
+	// LayerCache, if set, is shared with other builds so that identical layers
+	// are compressed and uploaded just once
+	LayerCache *LayerCache
+	// Destinations lists other repositories BuildImage pushes the image to, for
+	// example to publish to both GCR and Docker Hub. Each sets its own
+	// BaseURL, Name, Tags and credentials, and also NoOverwrite, Verify and
+	// MountFrom if wanted. OnEvent and HTTPClient are taken from these Options
+	// if not set. If a destination has no Token, BuildImage calls Auth for it.
+	Destinations []Options
+}
+
+// SetReference sets BaseURL, Name and Tags from a full image reference such as
+// eu.gcr.io/proj/app:v1.2 or philpearl/test@sha256:... The tag or digest in the
+// reference is added to Tags.
+func (o *Options) SetReference(ref string) error {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	o.BaseURL = r.BaseURL()
+	o.Name = r.Repository
+	if r.Tag != "" {
+		o.Tags = append(o.Tags, r.Tag)
+	}
+	if r.Digest != "" {
+		o.Tags = append(o.Tags, r.Digest.String())
+	}
+	return nil
 }
 
 // Client lets you send a container up to a repository
@@ -43,6 +108,46 @@ func New(o *Options) *Client {
 	}
 }
 
+// destination returns a client for one of the destinations in Options
+func (c *Client) destination(o *Options) *Client {
+	d := New(o)
+	if d.OnEvent == nil {
+		d.OnEvent = c.OnEvent
+	}
+	if d.HTTPClient == nil {
+		d.HTTPClient = c.HTTPClient
+	}
+	d.Destinations = nil
+	return d
+}
+
+// authDestination gets a token for a destination that has none
+func (c *Client) authDestination() error {
+	if c.Token != nil {
+		return nil
+	}
+	token, err := c.Auth()
+	if err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	c.Token = func() string { return token }
+	return nil
+}
+
+// repository returns the fully-qualified name of the client's repository, e.g.
+// eu.gcr.io/proj/app
+func (c *Client) repository() string {
+	return registryFromURL(c.BaseURL) + "/" + c.Name
+}
+
+// do sends a request using the configured HTTP client
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.HTTPClient != nil {
+		return c.HTTPClient.Do(req)
+	}
+	return http.DefaultClient.Do(req)
+}
+
 func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
@@ -55,27 +160,24 @@ func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request,
 	return req, nil
 }
 
-func (c *Client) sendBlob(digest digest.Digest, data []byte) error {
+// sendBlob uploads a blob if the repository does not already have it. It
+// returns true if the upload was skipped because the blob already exists.
+func (c *Client) sendBlob(digest digest.Digest, data []byte) (skipped bool, err error) {
 	uploaded, err := c.isBlobUploaded(digest)
 	if err != nil {
-		return fmt.Errorf("could not check if blob is already uploaded: %w", err)
+		return false, fmt.Errorf("could not check if blob is already uploaded: %w", err)
 	}
+	c.event(Event{Kind: EventBlobCheck, Digest: digest, Exists: uploaded})
 	if uploaded {
-		fmt.Printf("blob already uploaded\n")
-		return nil
-	}
-
-	// The repository tells us where the blob should be uploaded to
-	loc, err := c.getBlobUploadLocation()
-	if err != nil {
-		return fmt.Errorf("could not get location for blob upload: %w", err)
+		c.LayerCache.have(c, digest)
+		return true, nil
 	}
 
-	if err := c.uploadBlob(loc, digest, data); err != nil {
-		return fmt.Errorf("blob upload failed: %w", err)
+	if err := c.uploadBlobOnce(digest, data); err != nil {
+		return false, err
 	}
 
-	return nil
+	return false, nil
 }
 
 func (c *Client) isBlobUploaded(digest digest.Digest) (bool, error) {
@@ -83,71 +185,184 @@ func (c *Client) isBlobUploaded(digest digest.Digest) (bool, error) {
 
 	req, err := c.newRequest(http.MethodHead, u, nil)
 	if err != nil {
-		return false, fmt.Errorf("could nto build request: %w", err)
+		return false, fmt.Errorf("could not build request: %w", err)
 	}
 
-	rsp, err := http.DefaultClient.Do(req)
+	rsp, err := c.do(req)
 	if err != nil {
-		return false, fmt.Errorf("blob upload failed: %w", err)
+		return false, fmt.Errorf("blob check failed: %w", err)
 	}
+	defer rsp.Body.Close()
 
-	return rsp.StatusCode == http.StatusOK, nil
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, newRegistryError(rsp)
 }
 
 func (c *Client) getBlobUploadLocation() (*url.URL, error) {
+	loc, _, err := c.startBlobUpload(nil)
+	return loc, err
+}
+
+// mountBlob asks the registry to mount a blob from another repository on the
+// same registry. If the registry can't do this it starts a normal upload
+// instead, and mountBlob returns the upload location.
+func (c *Client) mountBlob(digest digest.Digest, from string) (loc *url.URL, mounted bool, err error) {
+	return c.startBlobUpload(url.Values{
+		"mount": []string{digest.String()},
+		"from":  []string{from},
+	})
+}
+
+// startBlobUpload starts a blob upload with a POST. The registry responds with
+// a location to upload the blob to, or with 201 Created if it has mounted the
+// blob.
+func (c *Client) startBlobUpload(query url.Values) (loc *url.URL, created bool, err error) {
 	u := strings.Join([]string{c.BaseURL, "v2", c.Name, "blobs/uploads/"}, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
 	req, err := c.newRequest(http.MethodPost, u, nil)
 	if err != nil {
-		return nil, fmt.Errorf("could not build request: %w", err)
+		return nil, false, fmt.Errorf("could not build request: %w", err)
 	}
 
-	rsp, err := http.DefaultClient.Do(req)
+	rsp, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("blob upload failed: %w", err)
+		return nil, false, fmt.Errorf("blob upload failed: %w", err)
 	}
 	defer rsp.Body.Close()
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read body on blob upload response: %w", err)
-	}
 
-	if rsp.StatusCode != http.StatusAccepted {
-		return nil, fmt.Errorf("unexpected status %s. %s", rsp.Status, string(body))
+	switch rsp.StatusCode {
+	case http.StatusAccepted:
+	case http.StatusCreated:
+		io.Copy(io.Discard, rsp.Body)
+		return nil, true, nil
+	default:
+		return nil, false, newRegistryError(rsp)
 	}
+	io.Copy(io.Discard, rsp.Body)
 
-	return rsp.Location()
+	loc, err = rsp.Location()
+	return loc, false, err
 }
 
 func (c *Client) uploadBlob(loc *url.URL, digest digest.Digest, data []byte) error {
+	return c.uploadBlobFrom(loc, digest, int64(len(data)), func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// uploadBlobFrom uploads a blob of a known size, streaming it from what open
+// returns. open is called again if the request needs to be resent, for example
+// after a redirect.
+func (c *Client) uploadBlobFrom(loc *url.URL, digest digest.Digest, size int64, open func() (io.ReadCloser, error)) (err error) {
 	q := loc.Query()
 	q.Set("digest", digest.String())
 	loc.RawQuery = q.Encode()
 
-	r := bytes.NewReader(data)
-	req, err := c.newRequest(http.MethodPut, loc.String(), r)
+	c.event(Event{Kind: EventBlobUpload, Digest: digest, Total: size})
+	defer func() {
+		if err != nil {
+			c.event(Event{Kind: EventBlobUpload, Digest: digest, Total: size, Err: err})
+		}
+	}()
+	getBody := func() (io.ReadCloser, error) {
+		if size == 0 {
+			// Otherwise net/http treats the length as unknown
+			return http.NoBody, nil
+		}
+		rc, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{&progressReader{r: rc, c: c, kind: EventBlobUpload, digest: digest, total: size}, rc}, nil
+	}
+	body, err := getBody()
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(http.MethodPut, loc.String(), body)
 	if err != nil {
+		body.Close()
 		return err
 	}
-	req.ContentLength = int64(len(data))
+	req.ContentLength = size
+	req.GetBody = getBody
 	req.Header.Set("Content-Type", "application/octet-stream")
 
-	rsp, err := http.DefaultClient.Do(req)
+	rsp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("blob upload failed: %w", err)
 	}
 	defer rsp.Body.Close()
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read body on blob upload response: %w", err)
-	}
 
 	if rsp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("unexpected status %s. %s", rsp.Status, string(body))
+		return newRegistryError(rsp)
 	}
+	io.Copy(io.Discard, rsp.Body)
+
+	return nil
+}
 
+// checkTags checks, if NoOverwrite is set, that none of the tags points to an
+// image other than the one with the given digest. We do this before uploading
+// anything so failures are cheap.
+func (c *Client) checkTags(tags []string, digest digest.Digest) error {
+	if !c.NoOverwrite {
+		return nil
+	}
+	for _, tag := range tags {
+		if isDigest(tag) {
+			continue
+		}
+		existing, exists, err := c.HeadManifest(tag)
+		if err != nil {
+			return fmt.Errorf("could not check existing manifest for tag %s: %w", tag, err)
+		}
+		if exists && existing.Digest != digest {
+			return &TagExistsError{Repository: c.repository(), Tag: tag, Existing: existing.Digest, Digest: digest}
+		}
+	}
 	return nil
 }
 
+// pushManifest pushes a manifest to a tag, unless the tag already points to
+// the same manifest. It returns true if it pushed the manifest. If NoOverwrite
+// is set and the tag points to a different manifest it returns a
+// *TagExistsError.
+func (c *Client) pushManifest(digest digest.Digest, data []byte, mediaType, tag string) (changed bool, err error) {
+	existing, exists, err := c.HeadManifest(tag)
+	if err != nil {
+		return false, fmt.Errorf("could not check existing manifest: %w", err)
+	}
+	if exists && existing.Digest == digest {
+		c.event(Event{Kind: EventManifestPush, Digest: digest, Tag: tag, Exists: true})
+	} else {
+		if exists && c.NoOverwrite && !isDigest(tag) {
+			return false, &TagExistsError{Repository: c.repository(), Tag: tag, Existing: existing.Digest, Digest: digest}
+		}
+		if err := c.sendManifest(digest, data, mediaType, tag); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	if c.Verify {
+		if err := c.verifyManifest(tag, digest); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
 func (c *Client) sendManifest(digest digest.Digest, data []byte, mediaType, tag string) error {
 	u := strings.Join([]string{c.BaseURL, "v2", c.Name, "manifests", tag}, "/")
 	b := bytes.NewReader(data)
@@ -157,21 +372,24 @@ func (c *Client) sendManifest(digest digest.Digest, data []byte, mediaType, tag
 	}
 	req.Header.Set("Content-Type", mediaType)
 
-	log.Printf("Sending %s", u)
-
-	rsp, err := http.DefaultClient.Do(req)
+	rsp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("manifest upload failed: %w", err)
 	}
 	defer rsp.Body.Close()
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read body on manifest upload response: %w", err)
-	}
 
 	if rsp.StatusCode != http.StatusCreated && rsp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status %s. %s", rsp.Status, string(body))
+		return newRegistryError(rsp)
+	}
+	io.Copy(io.Discard, rsp.Body)
+	if c.Verify {
+		// Not all registries send this header. If it is missing we rely on
+		// reading the manifest back.
+		if got := rsp.Header.Get("Docker-Content-Digest"); got != "" && got != digest.String() {
+			return fmt.Errorf("%w: registry reports manifest digest %s, expected %s", ErrVerifyFailed, got, digest)
+		}
 	}
+	c.event(Event{Kind: EventManifestPush, Digest: digest, Tag: tag})
 
 	return nil
 }
@@ -0,0 +1,234 @@
+package scratchbuild_test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+// newClient returns a client for a repository on a test registry,
+// authenticated if the registry needs it
+func newClient(t *testing.T, r *scratchbuildtest.Registry, name string, tags ...string) *scratchbuild.Client {
+	t.Helper()
+	o := r.ClientOptions(name, tags...)
+	o.Created = created
+	c := scratchbuild.New(&o)
+	if o.User != "" {
+		token, err := c.Auth()
+		if err != nil {
+			t.Fatalf("failed to authorize. %s", err)
+		}
+		c.Token = func() string { return token }
+	}
+	return c
+}
+
+// appLayer is a layer containing the test program at /app
+func appLayer(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := scratchbuild.TarDirectory("./testdata", &b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+var appConfig = scratchbuild.ImageConfig{Entrypoint: []string{"/app"}}
+
+// created is the creation time of test images, so that building the same image
+// twice gives the same configuration blob
+var created = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// pushApp pushes an image running the test program to a test registry
+func pushApp(t *testing.T, r *scratchbuildtest.Registry, name string, tags ...string) *scratchbuild.BuildResult {
+	t.Helper()
+	result, err := newClient(t, r, name, tags...).BuildImage(&appConfig, appLayer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestUploadFollowsRedirect(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	// Redirect each blob upload once, as registries that store blobs
+	// elsewhere do
+	var mu sync.Mutex
+	redirected := 0
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method != http.MethodPut || !strings.Contains(req.URL.Path, "/blobs/uploads/") || req.URL.Query().Get("redirected") != "" {
+			return false
+		}
+		mu.Lock()
+		redirected++
+		mu.Unlock()
+		u := *req.URL
+		q := u.Query()
+		q.Set("redirected", "1")
+		u.RawQuery = q.Encode()
+		http.Redirect(w, req, u.String(), http.StatusTemporaryRedirect)
+		return true
+	})
+
+	c := newClient(t, r, "test/app", "latest")
+	result, err := c.BuildImage(&appConfig, appLayer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirected != 2 {
+		t.Errorf("expected the layer and config uploads to be redirected, got %d redirects", redirected)
+	}
+	for _, l := range result.Layers {
+		if _, ok := r.Blob("test/app", l.Digest); !ok {
+			t.Errorf("layer %s not uploaded", l.Digest)
+		}
+	}
+}
+
+// countRequests counts the requests the registry has received that start with
+// prefix, e.g. "PUT /v2/test/app/blobs/uploads/"
+func countRequests(r *scratchbuildtest.Registry, prefix string) int {
+	n := 0
+	for _, req := range r.Requests() {
+		if strings.HasPrefix(req, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBlobsUploadedOnce(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{User: "user", Password: "pass"})
+	defer r.Close()
+
+	c := newClient(t, r, "test/app", "latest")
+	layer := appLayer(t)
+	result, err := c.BuildImage(&appConfig, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Skipped) != 0 {
+		t.Errorf("expected nothing to be skipped on the first push, got %v", result.Skipped)
+	}
+	// Each blob is checked with a HEAD, then uploaded with a POST and a PUT
+	if n := countRequests(r, "HEAD /v2/test/app/blobs/"); n != 2 {
+		t.Errorf("expected 2 blob checks, got %d", n)
+	}
+	if n := countRequests(r, "PUT /v2/test/app/blobs/uploads/"); n != 2 {
+		t.Errorf("expected 2 blob uploads, got %d", n)
+	}
+	for _, dgst := range []digest.Digest{result.Layers[0].Digest, result.ConfigDigest} {
+		if _, ok := r.Blob("test/app", dgst); !ok {
+			t.Errorf("blob %s is missing", dgst)
+		}
+	}
+
+	// Pushing again finds the blobs are there and doesn't upload them
+	result, err = c.BuildImage(&appConfig, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Skipped) != 2 {
+		t.Errorf("expected both blobs to be skipped, got %v", result.Skipped)
+	}
+	if n := countRequests(r, "PUT /v2/test/app/blobs/uploads/"); n != 2 {
+		t.Errorf("expected no more uploads, got %d in all", n)
+	}
+}
+
+func TestBlobsMountedBetweenRepositories(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	cache := scratchbuild.NewLayerCache()
+	layer := appLayer(t)
+	for _, name := range []string{"test/one", "test/two"} {
+		o := r.ClientOptions(name, "latest")
+		o.LayerCache = cache
+		o.Created = created
+		if _, err := scratchbuild.New(&o).BuildImage(&appConfig, layer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := countRequests(r, "PUT /v2/test/two/blobs/uploads/"); n != 0 {
+		t.Errorf("expected test/two to mount its blobs, but it uploaded %d", n)
+	}
+	if n := countRequests(r, "POST /v2/test/two/blobs/uploads/"); n != 2 {
+		t.Errorf("expected 2 mount requests, got %d", n)
+	}
+	if _, _, ok := r.Manifest("test/two", "latest"); !ok {
+		t.Error("test/two has no manifest")
+	}
+}
+
+func TestMountFallsBackToUpload(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	// The registry refuses to mount, so the blob is uploaded to the location
+	// it returns instead
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if q := req.URL.Query(); q.Get("mount") != "" {
+			req.URL.RawQuery = ""
+		}
+		return false
+	})
+
+	cache := scratchbuild.NewLayerCache()
+	layer := appLayer(t)
+	for _, name := range []string{"test/one", "test/two"} {
+		o := r.ClientOptions(name, "latest")
+		o.LayerCache = cache
+		o.Created = created
+		if _, err := scratchbuild.New(&o).BuildImage(&appConfig, layer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countRequests(r, "PUT /v2/test/two/blobs/uploads/"); n != 2 {
+		t.Errorf("expected test/two to upload its blobs, got %d uploads", n)
+	}
+}
+
+func TestFailedUploadEvent(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/blobs/uploads/") {
+			scratchbuildtest.WriteError(w, http.StatusBadRequest, scratchbuild.ErrorCodeBlobUploadInvalid, "no")
+			return true
+		}
+		return false
+	})
+
+	c := newClient(t, r, "app")
+	var mu sync.Mutex
+	var failed []scratchbuild.Event
+	c.OnEvent = func(e scratchbuild.Event) {
+		if e.Kind == scratchbuild.EventBlobUpload && e.Err != nil {
+			mu.Lock()
+			failed = append(failed, e)
+			mu.Unlock()
+		}
+	}
+	if _, err := c.BuildImage(&appConfig, appLayer(t)); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+	if len(failed) == 0 {
+		t.Fatal("expected an event reporting the failed upload")
+	}
+	for _, e := range failed {
+		if !scratchbuild.HasErrorCode(e.Err, scratchbuild.ErrorCodeBlobUploadInvalid) {
+			t.Errorf("unexpected error %v", e.Err)
+		}
+	}
+}
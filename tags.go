@@ -0,0 +1,114 @@
+package scratchbuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListTags lists the tags in the repository. pageSize is the number of tags to
+// ask for in each request, or zero to let the registry decide. ListTags follows
+// the registry's Link headers until it has every tag, or until a page brings no
+// new tags.
+func (c *Client) ListTags(pageSize int) ([]string, error) {
+	u, err := url.Parse(strings.Join([]string{c.BaseURL, "v2", c.Name, "tags/list"}, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("could not build tags URL: %w", err)
+	}
+	if pageSize > 0 {
+		u.RawQuery = url.Values{"n": []string{strconv.Itoa(pageSize)}}.Encode()
+	}
+
+	var tags []string
+	seen := make(map[string]bool)
+	for u != nil {
+		page, next, err := c.listTagsPage(u)
+		if err != nil {
+			return nil, err
+		}
+		added := 0
+		for _, tag := range page {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+				added++
+			}
+		}
+
+		if next == nil && pageSize > 0 && len(page) == pageSize {
+			// Some registries page without sending a Link header. We ask for
+			// the next page ourselves.
+			q := u.Query()
+			q.Set("last", page[len(page)-1])
+			next = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawQuery: q.Encode()}
+		}
+		// Stop if the registry is sending us round in circles, rather than
+		// asking for the same pages forever
+		if added == 0 || (next != nil && next.String() == u.String()) {
+			break
+		}
+		u = next
+	}
+
+	return tags, nil
+}
+
+// listTagsPage fetches a single page of tags. It returns the URL of the next
+// page if the registry sent one in a Link header.
+func (c *Client) listTagsPage(u *url.URL) (tags []string, next *url.URL, err error) {
+	req, err := c.newRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not build request: %w", err)
+	}
+
+	rsp, err := c.do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tag list failed: %w", err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, nil, newRegistryError(rsp)
+	}
+
+	var list struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&list); err != nil {
+		return nil, nil, fmt.Errorf("could not decode tag list: %w", err)
+	}
+
+	if link := nextLink(rsp.Header.Values("Link")); link != "" {
+		next, err = u.Parse(link)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse Link header %q: %w", link, err)
+		}
+	}
+
+	return list.Tags, next, nil
+}
+
+// nextLink finds the URL with rel="next" in Link headers of the form
+// <url>; rel="next"
+func nextLink(headers []string) string {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+				if param == `rel="next"` || param == "rel=next" {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
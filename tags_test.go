@@ -0,0 +1,133 @@
+package scratchbuild_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestListTagsPagination(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+	result := pushApp(t, r, "test/app", "a")
+	data, mediaType, _ := r.Manifest("test/app", result.ManifestDigest.String())
+	r.PutManifest("test/app", mediaType, data, "b", "c", "d", "e")
+
+	for _, test := range []struct {
+		pageSize int
+		requests int
+	}{
+		{pageSize: 0, requests: 1},
+		{pageSize: 2, requests: 3},
+		// A full page without a Link header might not be the last
+		{pageSize: 5, requests: 2},
+		{pageSize: 10, requests: 1},
+	} {
+		t.Run(fmt.Sprint(test.pageSize), func(t *testing.T) {
+			before := countRequests(r, "GET /v2/test/app/tags/list")
+			tags, err := newClient(t, r, "test/app").ListTags(test.pageSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(tags, want) {
+				t.Errorf("expected %v, got %v", want, tags)
+			}
+			if n := countRequests(r, "GET /v2/test/app/tags/list") - before; n != test.requests {
+				t.Errorf("expected %d requests, got %d", test.requests, n)
+			}
+		})
+	}
+}
+
+// writeTags writes a page of a tag list, with a Link header if next is set
+func writeTags(w http.ResponseWriter, next string, tags ...string) {
+	if next != "" {
+		w.Header().Set("Link", "<"+next+`>; rel="next"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": "test/app", "tags": tags})
+}
+
+func TestListTagsWithoutLinkHeader(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	// The registry pages but doesn't say where the next page is
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if !strings.HasSuffix(req.URL.Path, "/tags/list") {
+			return false
+		}
+		switch req.URL.Query().Get("last") {
+		case "":
+			writeTags(w, "", "a", "b")
+		case "b":
+			writeTags(w, "", "c")
+		default:
+			t.Errorf("unexpected request for %s", req.URL)
+			writeTags(w, "")
+		}
+		return true
+	})
+
+	tags, err := newClient(t, r, "test/app").ListTags(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("expected %v, got %v", want, tags)
+	}
+}
+
+func TestListTagsStopsLooping(t *testing.T) {
+	tests := []struct {
+		name string
+		page func(w http.ResponseWriter, req *http.Request)
+	}{
+		{
+			name: "link to the same page",
+			page: func(w http.ResponseWriter, req *http.Request) {
+				writeTags(w, req.URL.RequestURI(), "a", "b")
+			},
+		},
+		{
+			name: "pages repeat",
+			page: func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Query().Get("page") == "2" {
+					writeTags(w, "/v2/test/app/tags/list?page=1", "b", "c")
+					return
+				}
+				writeTags(w, "/v2/test/app/tags/list?page=2", "a", "b")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := scratchbuildtest.NewRegistry(nil)
+			defer r.Close()
+			r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+				if !strings.HasSuffix(req.URL.Path, "/tags/list") {
+					return false
+				}
+				test.page(w, req)
+				return true
+			})
+
+			tags, err := newClient(t, r, "test/app").ListTags(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := countRequests(r, "GET /v2/test/app/tags/list"); n > 4 {
+				t.Errorf("expected ListTags to stop, but it made %d requests", n)
+			}
+			if tags[0] != "a" || tags[1] != "b" || len(tags) > 3 {
+				t.Errorf("unexpected tags %v", tags)
+			}
+		})
+	}
+}
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // TarDirectory builds a directory into a tar file. At the moment it does not support
@@ -53,3 +56,173 @@ func TarDirectory(dir string, w io.Writer) error {
 
 	return nil
 }
+
+// LayerWriter writes the tar file for an image layer. Files can be added at any
+// path in the image. Only the directories made with Mkdir are written to the
+// layer, so that parent directories keep the mode and owner lower layers give
+// them; those missing from the image are created by the runtime, owned by root
+// with mode 0755. Files are owned by root unless SetOwner says otherwise.
+type LayerWriter struct {
+	tw   *tar.Writer
+	dirs map[string]bool
+	uid  int
+	gid  int
+}
+
+// NewLayerWriter creates a LayerWriter that writes the layer to w. Call Close
+// to finish the layer.
+func NewLayerWriter(w io.Writer) *LayerWriter {
+	return &LayerWriter{
+		tw:   tar.NewWriter(w),
+		dirs: map[string]bool{".": true},
+	}
+}
+
+// SetOwner sets the numeric user and group ID of files added from now on
+func (l *LayerWriter) SetOwner(uid, gid int) {
+	l.uid, l.gid = uid, gid
+}
+
+// Close finishes the layer. It does not close the underlying writer.
+func (l *LayerWriter) Close() error {
+	return l.tw.Close()
+}
+
+// layerPath converts an absolute path in the image into the form used in the
+// layer tar file
+func layerPath(name string) string {
+	return path.Clean(strings.TrimPrefix(path.Clean("/"+name), "/"))
+}
+
+// Mkdir adds a directory to the layer. Its parents are not added.
+func (l *LayerWriter) Mkdir(name string, mode os.FileMode) error {
+	name = layerPath(name)
+	if l.dirs[name] {
+		return nil
+	}
+	h := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     tarMode(mode),
+		Uid:      l.uid,
+		Gid:      l.gid,
+	}
+	if err := l.tw.WriteHeader(h); err != nil {
+		return fmt.Errorf("failed writing header for %s: %w", name, err)
+	}
+	l.dirs[name] = true
+	return nil
+}
+
+// AddBytes adds a file with the given content to the layer
+func (l *LayerWriter) AddBytes(name string, data []byte, mode os.FileMode) error {
+	name = layerPath(name)
+	h := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     tarMode(mode),
+		Size:     int64(len(data)),
+		Uid:      l.uid,
+		Gid:      l.gid,
+	}
+	if err := l.tw.WriteHeader(h); err != nil {
+		return fmt.Errorf("failed writing header for %s: %w", name, err)
+	}
+	if _, err := l.tw.Write(data); err != nil {
+		return fmt.Errorf("failed writing %s into tar file: %w", name, err)
+	}
+	return nil
+}
+
+// AddSymlink adds a symbolic link to the layer
+func (l *LayerWriter) AddSymlink(name, target string) error {
+	name = layerPath(name)
+	h := &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0o777,
+		Uid:      l.uid,
+		Gid:      l.gid,
+	}
+	if err := l.tw.WriteHeader(h); err != nil {
+		return fmt.Errorf("failed writing header for %s: %w", name, err)
+	}
+	return nil
+}
+
+// AddFile copies the file src from the local filesystem to dst in the layer. If
+// src is a directory its contents are copied into dst, recursively. Symbolic
+// links are copied as links.
+func (l *LayerWriter) AddFile(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.IsDir():
+		if err := l.Mkdir(dst, fi.Mode()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return fmt.Errorf("failed to read directory: %w", err)
+		}
+		for _, e := range entries {
+			if err := l.AddFile(filepath.Join(src, e.Name()), path.Join(dst, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return l.AddSymlink(dst, target)
+
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("%s is not a regular file, directory or symbolic link", src)
+	}
+
+	name := layerPath(dst)
+	h, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return fmt.Errorf("failed building tar header for %s: %w", src, err)
+	}
+	h.Name = name
+	h.Uid, h.Gid = l.uid, l.gid
+	h.Uname, h.Gname = "", ""
+	// Times would make the layer differ each time the files are checked out
+	h.ModTime, h.AccessTime, h.ChangeTime = time.Time{}, time.Time{}, time.Time{}
+	if err := l.tw.WriteHeader(h); err != nil {
+		return fmt.Errorf("failed writing header for %s: %w", name, err)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(l.tw, f); err != nil {
+		return fmt.Errorf("failed copying %s into tar file: %w", src, err)
+	}
+	return nil
+}
+
+// tarMode converts a file mode to the permission bits used in tar headers
+func tarMode(mode os.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
@@ -0,0 +1,123 @@
+package scratchbuild_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+// applyLayers unpacks the headers of layers on top of each other as a runtime
+// does, creating missing parent directories owned by root with mode 0755
+func applyLayers(t *testing.T, layers ...[]byte) map[string]*tar.Header {
+	t.Helper()
+	fs := make(map[string]*tar.Header)
+	for _, layer := range layers {
+		tr := tar.NewReader(bytes.NewReader(layer))
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := path.Clean("/" + h.Name)
+			for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+				if _, ok := fs[dir]; !ok {
+					fs[dir] = &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0o755}
+				}
+			}
+			fs[name] = h
+		}
+	}
+	return fs
+}
+
+func TestLayerWriterKeepsLowerDirectories(t *testing.T) {
+	base, err := scratchbuild.BaseFilesLayer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/x", []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	lw := scratchbuild.NewLayerWriter(&b)
+	if err := lw.AddFile(dir+"/x", "/tmp/x"); err != nil {
+		t.Fatal(err)
+	}
+	lw.SetOwner(65532, 65532)
+	if err := lw.AddBytes("/home/nonroot/.config/app/settings", []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := lw.AddSymlink("/home/nonroot/link", "/tmp/x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := applyLayers(t, base, b.Bytes())
+	tests := []struct {
+		name     string
+		mode     int64
+		uid, gid int
+	}{
+		{name: "/tmp", mode: 0o1777},
+		{name: "/home", mode: 0o755},
+		{name: "/home/nonroot", mode: 0o700, uid: 65532, gid: 65532},
+		{name: "/root", mode: 0o700},
+		{name: "/etc", mode: 0o755},
+		{name: "/tmp/x", mode: 0o644},
+		// Directories missing below are made by the runtime
+		{name: "/home/nonroot/.config", mode: 0o755},
+		{name: "/home/nonroot/.config/app/settings", mode: 0o600, uid: 65532, gid: 65532},
+	}
+	for _, test := range tests {
+		h, ok := fs[test.name]
+		if !ok {
+			t.Errorf("%s is missing", test.name)
+			continue
+		}
+		if h.Mode != test.mode || h.Uid != test.uid || h.Gid != test.gid {
+			t.Errorf("%s: expected %04o %d:%d, got %04o %d:%d", test.name, test.mode, test.uid, test.gid, h.Mode, h.Uid, h.Gid)
+		}
+	}
+}
+
+func TestLayerWriterMkdir(t *testing.T) {
+	var b bytes.Buffer
+	lw := scratchbuild.NewLayerWriter(&b)
+	for _, dir := range []string{"/var/lib/app", "/var/lib/app/", "/"} {
+		if err := lw.Mkdir(dir, 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the directory asked for is written, once
+	tr := tar.NewReader(&b)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	if len(names) != 1 || names[0] != "var/lib/app/" {
+		t.Errorf("unexpected entries %q", names)
+	}
+}
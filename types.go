@@ -27,8 +27,29 @@ const (
 	// MediaTypeUncompressedLayer is the mediaType used for layers which
 	// are not compressed.
 	MediaTypeUncompressedLayer = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// MediaTypeManifestList specifies the mediaType for a Docker manifest list,
+	// which points to manifests for different platforms.
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeOCIManifest specifies the mediaType for an OCI image manifest.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// MediaTypeOCIIndex specifies the mediaType for an OCI image index.
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+
+	// MediaTypeOCIImageConfig specifies the mediaType for an OCI image
+	// configuration.
+	MediaTypeOCIImageConfig = "application/vnd.oci.image.config.v1+json"
+
+	// MediaTypeOCILayer is the mediaType used for gzipped OCI layers.
+	MediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar+gzip"
 )
 
+// AnnotationRefName is the annotation used in an OCI layout index.json to give
+// the tag of an image.
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
 var (
 	// SchemaVersion provides a pre-initialized version structure for this
 	// packages version of the manifest.
@@ -63,6 +84,31 @@ type Descriptor struct {
 
 	// URLs contains the source URLs of this content.
 	URLs []string `json:"urls,omitempty"`
+
+	// Annotations contains arbitrary metadata relating to the targeted content.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Platform describes the platform an image manifest is for. It is only
+	// used for manifests listed in an index.
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+// Platform describes the platform which an image in an index runs on
+type Platform struct {
+	// Architecture is the CPU architecture, e.g. amd64 or arm64.
+	Architecture string `json:"architecture"`
+
+	// OS is the operating system, e.g. linux.
+	OS string `json:"os"`
+
+	// OSVersion is the version of the operating system.
+	OSVersion string `json:"os.version,omitempty"`
+
+	// OSFeatures lists required OS features.
+	OSFeatures []string `json:"os.features,omitempty"`
+
+	// Variant is the variant of the CPU, e.g. v7 for arm.
+	Variant string `json:"variant,omitempty"`
 }
 
 // Manifest describes a container image
@@ -77,6 +123,18 @@ type Manifest struct {
 	Layers []Descriptor `json:"layers"`
 }
 
+// Index references manifests for different platforms. It is used both for OCI
+// image indexes and Docker manifest lists.
+type Index struct {
+	Versioned
+
+	// Manifests lists the manifests in the index.
+	Manifests []Descriptor `json:"manifests"`
+
+	// Annotations contains arbitrary metadata for the index.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
 // ImageConfig defines the execution parameters which should be used as a base when running a container using an image.
 type ImageConfig struct {
 	// User defines the username or UID which the process in the container should run as.
@@ -105,6 +163,39 @@ type ImageConfig struct {
 
 	// StopSignal contains the system call signal that will be sent to the container to exit.
 	StopSignal string `json:"StopSignal,omitempty"`
+
+	// Healthcheck describes how to check the container is healthy. It is a Docker extension.
+	Healthcheck *HealthConfig `json:"Healthcheck,omitempty"`
+
+	// Shell is the shell used for the shell form of commands, e.g. ["/bin/sh", "-c"]. It is a Docker extension.
+	Shell []string `json:"Shell,omitempty"`
+
+	// ArgsEscaped is true if the command is already escaped, which matters only on Windows. It is a Docker extension.
+	ArgsEscaped bool `json:"ArgsEscaped,omitempty"`
+
+	// OnBuild lists Dockerfile instructions to run when the image is used as a base. It is a Docker extension.
+	OnBuild []string `json:"OnBuild,omitempty"`
+}
+
+// HealthConfig describes how to check a container is healthy. Zero durations
+// and retries mean the runtime's default is used.
+type HealthConfig struct {
+	// Test is the check to run. It is one of ["NONE"] to disable checks,
+	// ["CMD", args...] to run a command, or ["CMD-SHELL", command] to run a
+	// command with the shell.
+	Test []string `json:"Test,omitempty"`
+
+	// Interval is the time to wait between checks.
+	Interval time.Duration `json:"Interval,omitempty"`
+
+	// Timeout is the time to wait before considering a check to have hung.
+	Timeout time.Duration `json:"Timeout,omitempty"`
+
+	// StartPeriod is the time the container has to start before failed checks count.
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+
+	// Retries is the number of consecutive failures needed to consider the container unhealthy.
+	Retries int `json:"Retries,omitempty"`
 }
 
 // RootFS describes a layer content addresses
@@ -149,6 +240,15 @@ type Image struct {
 	// OS is the name of the operating system which the image is built to run on.
 	OS string `json:"os"`
 
+	// OSVersion is the version of the operating system, e.g. 10.0.14393.1066 for Windows.
+	OSVersion string `json:"os.version,omitempty"`
+
+	// OSFeatures lists features of the operating system the image requires.
+	OSFeatures []string `json:"os.features,omitempty"`
+
+	// Variant is the variant of the CPU, e.g. v7 for 32-bit arm.
+	Variant string `json:"variant,omitempty"`
+
 	// Config defines the execution parameters which should be used as a base when running a container using the image.
 	Config ImageConfig `json:"config,omitempty"`
 
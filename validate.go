@@ -0,0 +1,161 @@
+package scratchbuild
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a problem with one field of an ImageConfig
+type FieldError struct {
+	// Field names the field, e.g. Env[2] or ExposedPorts["8080"]
+	Field string
+	// Message describes the problem
+	Message string
+}
+
+// Error implements the error interface
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ConfigError is returned by ImageConfig.Validate. It lists every problem
+// found, so they can all be fixed at once.
+type ConfigError struct {
+	Errors []*FieldError
+}
+
+// Error implements the error interface
+func (e *ConfigError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "invalid image config: " + strings.Join(msgs, "; ")
+}
+
+// signals are the Linux signal names, without the SIG prefix
+var signals = map[string]bool{
+	"HUP": true, "INT": true, "QUIT": true, "ILL": true, "TRAP": true, "ABRT": true,
+	"IOT": true, "BUS": true, "FPE": true, "KILL": true, "USR1": true, "SEGV": true,
+	"USR2": true, "PIPE": true, "ALRM": true, "TERM": true, "STKFLT": true, "CHLD": true,
+	"CLD": true, "CONT": true, "STOP": true, "TSTP": true, "TTIN": true, "TTOU": true,
+	"URG": true, "XCPU": true, "XFSZ": true, "VTALRM": true, "PROF": true, "WINCH": true,
+	"IO": true, "POLL": true, "PWR": true, "SYS": true, "RTMIN": true, "RTMAX": true,
+}
+
+var (
+	portRE        = regexp.MustCompile(`^([0-9]+)(?:-([0-9]+))?/(tcp|udp|sctp)$`)
+	realtimeSigRE = regexp.MustCompile(`^RTMIN\+([0-9]+)$|^RTMAX-([0-9]+)$`)
+)
+
+// Validate checks the configuration for mistakes that would otherwise only
+// show up when a container is run: malformed environment variables, exposed
+// ports without a protocol, relative paths, unknown stop signals, a bad
+// healthcheck, and having nothing to run. It returns a *ConfigError listing
+// every problem.
+func (c *ImageConfig) Validate() error {
+	var errs []*FieldError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(c.Entrypoint) == 0 && len(c.Cmd) == 0 {
+		add("Entrypoint", "either Entrypoint or Cmd must be set")
+	}
+	if len(c.Entrypoint) > 0 && c.Entrypoint[0] == "" {
+		add("Entrypoint[0]", "the program must not be empty")
+	}
+	if len(c.Entrypoint) == 0 && len(c.Cmd) > 0 && c.Cmd[0] == "" {
+		add("Cmd[0]", "the program must not be empty")
+	}
+
+	for i, e := range c.Env {
+		k, _, ok := strings.Cut(e, "=")
+		switch {
+		case !ok:
+			add(fmt.Sprintf("Env[%d]", i), "%q is not KEY=value", e)
+		case k == "":
+			add(fmt.Sprintf("Env[%d]", i), "%q has no variable name", e)
+		case strings.ContainsAny(k, " \t\n"):
+			add(fmt.Sprintf("Env[%d]", i), "variable name %q contains whitespace", k)
+		}
+	}
+
+	for _, p := range sortedKeys(c.ExposedPorts) {
+		field := fmt.Sprintf("ExposedPorts[%q]", p)
+		m := portRE.FindStringSubmatch(p)
+		if m == nil {
+			add(field, "expected port[-port]/protocol with protocol tcp, udp or sctp")
+			continue
+		}
+		low, _ := strconv.Atoi(m[1])
+		high := low
+		if m[2] != "" {
+			high, _ = strconv.Atoi(m[2])
+		}
+		if low < 1 || high > 65535 || high < low {
+			add(field, "ports must be between 1 and 65535")
+		}
+	}
+
+	for _, v := range sortedKeys(c.Volumes) {
+		if !path.IsAbs(v) {
+			add(fmt.Sprintf("Volumes[%q]", v), "must be an absolute path")
+		}
+	}
+
+	if c.WorkingDir != "" && !path.IsAbs(c.WorkingDir) {
+		add("WorkingDir", "%q must be an absolute path", c.WorkingDir)
+	}
+
+	if c.StopSignal != "" && !validSignal(c.StopSignal) {
+		add("StopSignal", "unknown signal %q", c.StopSignal)
+	}
+
+	for k := range c.Labels {
+		if k == "" {
+			add("Labels", "label keys must not be empty")
+		}
+	}
+
+	if c.Healthcheck != nil {
+		if err := c.Healthcheck.Validate(); err != nil {
+			add("Healthcheck", "%s", err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ConfigError{Errors: errs}
+	}
+	return nil
+}
+
+// validSignal reports whether s names a signal, e.g. SIGTERM, TERM or 15
+func validSignal(s string) bool {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n >= 1 && n <= 64
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if signals[name] {
+		return true
+	}
+	m := realtimeSigRE.FindStringSubmatch(name)
+	if m == nil {
+		return false
+	}
+	n, _ := strconv.Atoi(m[1] + m[2])
+	return n >= 0 && n <= 30
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
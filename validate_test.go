@@ -0,0 +1,169 @@
+package scratchbuild_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+)
+
+func TestImageConfigValidate(t *testing.T) {
+	set := func(p ...string) map[string]struct{} {
+		m := make(map[string]struct{}, len(p))
+		for _, p := range p {
+			m[p] = struct{}{}
+		}
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		config scratchbuild.ImageConfig
+		// errs lists the errors we expect, in order
+		errs []string
+	}{
+		{name: "entrypoint", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}}},
+		{name: "cmd only", config: scratchbuild.ImageConfig{Cmd: []string{"/app", "serve"}}},
+		{name: "nothing to run", config: scratchbuild.ImageConfig{}, errs: []string{"Entrypoint: either Entrypoint or Cmd must be set"}},
+		{name: "empty entrypoint", config: scratchbuild.ImageConfig{Entrypoint: []string{""}, Cmd: []string{"serve"}}, errs: []string{"Entrypoint[0]: the program must not be empty"}},
+		{name: "empty cmd", config: scratchbuild.ImageConfig{Cmd: []string{""}}, errs: []string{"Cmd[0]: the program must not be empty"}},
+		{
+			// Cmd is just arguments when there is an entrypoint
+			name:   "empty argument",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, Cmd: []string{""}},
+		},
+
+		{
+			name:   "env",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, Env: []string{"PATH=/bin", "EMPTY=", "EQUALS=a=b"}},
+		},
+		{
+			name:   "malformed env",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, Env: []string{"FOO", "=bar", "MY VAR=x", "TAB\tVAR=x"}},
+			errs: []string{
+				`Env[0]: "FOO" is not KEY=value`,
+				`Env[1]: "=bar" has no variable name`,
+				`Env[2]: variable name "MY VAR" contains whitespace`,
+				`Env[3]: variable name "TAB\tVAR" contains whitespace`,
+			},
+		},
+
+		{
+			name:   "ports",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, ExposedPorts: set("1/tcp", "53/udp", "9000/sctp", "65535/tcp", "8000-8010/tcp", "7000-7000/udp")},
+		},
+		{
+			name:   "bad ports",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, ExposedPorts: set("8080", "53/UDP", "80/http", "0/tcp", "65536/tcp", "9000-8000/tcp", "x/tcp", "1-/tcp")},
+			errs: []string{
+				`ExposedPorts["0/tcp"]: ports must be between 1 and 65535`,
+				`ExposedPorts["1-/tcp"]: expected port[-port]/protocol with protocol tcp, udp or sctp`,
+				`ExposedPorts["53/UDP"]: expected port[-port]/protocol with protocol tcp, udp or sctp`,
+				`ExposedPorts["65536/tcp"]: ports must be between 1 and 65535`,
+				`ExposedPorts["80/http"]: expected port[-port]/protocol with protocol tcp, udp or sctp`,
+				`ExposedPorts["8080"]: expected port[-port]/protocol with protocol tcp, udp or sctp`,
+				`ExposedPorts["9000-8000/tcp"]: ports must be between 1 and 65535`,
+				`ExposedPorts["x/tcp"]: expected port[-port]/protocol with protocol tcp, udp or sctp`,
+			},
+		},
+
+		{
+			name:   "volumes",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, Volumes: set("/data", "/var/cache/app/")},
+		},
+		{
+			name:   "relative volumes",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, Volumes: set("data", "", "./cache")},
+			errs: []string{
+				`Volumes[""]: must be an absolute path`,
+				`Volumes["./cache"]: must be an absolute path`,
+				`Volumes["data"]: must be an absolute path`,
+			},
+		},
+
+		{name: "working dir", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, WorkingDir: "/srv"}},
+		{
+			name:   "relative working dir",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, WorkingDir: "srv/app"},
+			errs:   []string{`WorkingDir: "srv/app" must be an absolute path`},
+		},
+
+		{name: "signal name", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "SIGTERM"}},
+		{name: "signal without prefix", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "quit"}},
+		{name: "signal number", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "15"}},
+		{name: "highest signal number", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "64"}},
+		{name: "realtime signal", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "SIGRTMIN+3"}},
+		{name: "realtime signal from max", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "RTMAX-2"}},
+		{name: "unknown signal", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "SIGTREM"}, errs: []string{`StopSignal: unknown signal "SIGTREM"`}},
+		{name: "signal 0", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "0"}, errs: []string{`StopSignal: unknown signal "0"`}},
+		{name: "signal number too high", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "65"}, errs: []string{`StopSignal: unknown signal "65"`}},
+		{name: "realtime signal too high", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "SIGRTMIN+31"}, errs: []string{`StopSignal: unknown signal "SIGRTMIN+31"`}},
+		{name: "realtime signal without number", config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, StopSignal: "SIGRTMIN+"}, errs: []string{`StopSignal: unknown signal "SIGRTMIN+"`}},
+
+		{
+			name:   "empty label key",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, Labels: map[string]string{"": "x", "team": ""}},
+			errs:   []string{"Labels: label keys must not be empty"},
+		},
+		{
+			name:   "bad healthcheck",
+			config: scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, Healthcheck: &scratchbuild.HealthConfig{Test: []string{"CMD"}}},
+			errs:   []string{"Healthcheck: a CMD test needs a command"},
+		},
+
+		{
+			name: "every problem is reported",
+			config: scratchbuild.ImageConfig{
+				Env:          []string{"FOO"},
+				ExposedPorts: set("8080"),
+				Volumes:      set("data"),
+				WorkingDir:   "srv",
+				StopSignal:   "SIGTREM",
+				Healthcheck:  &scratchbuild.HealthConfig{},
+			},
+			errs: []string{
+				"Entrypoint: either Entrypoint or Cmd must be set",
+				`Env[0]: "FOO" is not KEY=value`,
+				`ExposedPorts["8080"]: expected port[-port]/protocol with protocol tcp, udp or sctp`,
+				`Volumes["data"]: must be an absolute path`,
+				`WorkingDir: "srv" must be an absolute path`,
+				`StopSignal: unknown signal "SIGTREM"`,
+				"Healthcheck: test must be set",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Validate()
+			if len(test.errs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var configErr *scratchbuild.ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("expected a ConfigError, got %v", err)
+			}
+			var got []string
+			for _, e := range configErr.Errors {
+				got = append(got, e.Error())
+			}
+			if !reflect.DeepEqual(got, test.errs) {
+				t.Errorf("expected errors\n%q\ngot\n%q", test.errs, got)
+			}
+		})
+	}
+}
+
+func TestBuildImageValidates(t *testing.T) {
+	// An invalid config is rejected before anything is pushed
+	c := scratchbuild.New(&scratchbuild.Options{BaseURL: "http://127.0.0.1:1", Name: "test/app"})
+	_, err := c.BuildImage(&scratchbuild.ImageConfig{Entrypoint: []string{"/app"}, WorkingDir: "srv"})
+	var configErr *scratchbuild.ConfigError
+	if !errors.As(err, &configErr) || len(configErr.Errors) != 1 || configErr.Errors[0].Field != "WorkingDir" {
+		t.Errorf("expected a WorkingDir error, got %v", err)
+	}
+}
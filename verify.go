@@ -0,0 +1,74 @@
+package scratchbuild
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ErrVerifyFailed is wrapped by the errors returned when Options.Verify is set
+// and the registry does not hold what we pushed
+var ErrVerifyFailed = errors.New("verification of pushed image failed")
+
+// verifyManifest reads back a manifest we have pushed to a tag, checks it has
+// the digest we expect, and checks the registry has everything it refers to.
+// This catches proxies that rewrite or drop content.
+func (c *Client) verifyManifest(tag string, dgst digest.Digest) error {
+	data, desc, err := c.GetManifest(tag)
+	if err != nil {
+		return fmt.Errorf("%w: could not fetch manifest for %s: %s", ErrVerifyFailed, tag, err)
+	}
+	if desc.Digest != dgst {
+		return fmt.Errorf("%w: %s has digest %s, expected %s", ErrVerifyFailed, tag, desc.Digest, dgst)
+	}
+	return c.verifyContent(data, desc)
+}
+
+// verifyContent checks the registry has the blobs a manifest refers to. For an
+// index it checks each manifest in it, and their blobs.
+func (c *Client) verifyContent(data []byte, desc Descriptor) error {
+	switch {
+	case isIndex(desc.MediaType):
+		var index Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("%w: could not unmarshal index: %s", ErrVerifyFailed, err)
+		}
+		for _, m := range index.Manifests {
+			child, childDesc, err := c.GetManifest(m.Digest.String())
+			if err != nil {
+				return fmt.Errorf("%w: could not fetch manifest %s: %s", ErrVerifyFailed, m.Digest, err)
+			}
+			if childDesc.Digest != m.Digest {
+				return fmt.Errorf("%w: manifest %s has digest %s", ErrVerifyFailed, m.Digest, childDesc.Digest)
+			}
+			if err := c.verifyContent(child, childDesc); err != nil {
+				return err
+			}
+		}
+
+	case isImageManifest(desc.MediaType):
+		var manifest Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("%w: could not unmarshal manifest: %s", ErrVerifyFailed, err)
+		}
+		for _, blob := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+			if blob.MediaType == MediaTypeForeignLayer {
+				continue
+			}
+			exists, err := c.isBlobUploaded(blob.Digest)
+			if err != nil {
+				return fmt.Errorf("%w: could not check blob %s: %s", ErrVerifyFailed, blob.Digest, err)
+			}
+			if !exists {
+				return fmt.Errorf("%w: blob %s is missing", ErrVerifyFailed, blob.Digest)
+			}
+		}
+
+	default:
+		return fmt.Errorf("%w: %s has unexpected media type %q", ErrVerifyFailed, desc.Digest, desc.MediaType)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package scratchbuild_test
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/philpearl/scratchbuild"
+	"github.com/philpearl/scratchbuild/scratchbuildtest"
+)
+
+func TestVerify(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	c := newClient(t, r, "test/app", "v1")
+	c.Verify = true
+	if _, err := c.BuildImage(&appConfig, appLayer(t)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(r, "GET /v2/test/app/manifests/v1"); n != 1 {
+		t.Errorf("expected the manifest to be read back, got %d reads", n)
+	}
+
+	// Without Verify we don't read anything back
+	c = newClient(t, r, "test/app", "v2")
+	if _, err := c.BuildImage(&appConfig, appLayer(t)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(r, "GET /v2/test/app/manifests/v2"); n != 0 {
+		t.Errorf("expected no reads, got %d", n)
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	result := func() *scratchbuild.BuildResult {
+		r := scratchbuildtest.NewRegistry(nil)
+		defer r.Close()
+		return pushApp(t, r, "test/app")
+	}()
+	other := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	tests := []struct {
+		name string
+		hook func(w http.ResponseWriter, req *http.Request) bool
+		want string
+	}{
+		{
+			name: "registry reports another digest",
+			hook: func(w http.ResponseWriter, req *http.Request) bool {
+				if req.Method == http.MethodPut && strings.Contains(req.URL.Path, "/manifests/") {
+					w.Header().Set("Docker-Content-Digest", other)
+					w.WriteHeader(http.StatusCreated)
+					return true
+				}
+				return false
+			},
+			want: "registry reports manifest digest " + other,
+		},
+		{
+			name: "manifest read back differs",
+			hook: func(w http.ResponseWriter, req *http.Request) bool {
+				if req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/manifests/v1") {
+					w.Header().Set("Content-Type", scratchbuild.MediaTypeManifest)
+					w.Write([]byte(`{"schemaVersion":2,"mediaType":"` + scratchbuild.MediaTypeManifest + `"}`))
+					return true
+				}
+				return false
+			},
+			want: "v1 has digest",
+		},
+		{
+			name: "layer missing",
+			hook: func(w http.ResponseWriter, req *http.Request) bool {
+				if req.Method == http.MethodHead && strings.HasSuffix(req.URL.Path, "/blobs/"+result.Layers[0].Digest.String()) {
+					w.WriteHeader(http.StatusNotFound)
+					return true
+				}
+				return false
+			},
+			want: "blob " + result.Layers[0].Digest.String() + " is missing",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := scratchbuildtest.NewRegistry(&scratchbuildtest.Options{Hook: test.hook})
+			defer r.Close()
+
+			c := newClient(t, r, "test/app", "v1")
+			c.Verify = true
+			_, err := c.BuildImage(&appConfig, appLayer(t))
+			if !errors.Is(err, scratchbuild.ErrVerifyFailed) {
+				t.Fatalf("expected ErrVerifyFailed, got %v", err)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("expected error to contain %q, got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestVerifyIndex(t *testing.T) {
+	r := scratchbuildtest.NewRegistry(nil)
+	defer r.Close()
+
+	image := pushApp(t, r, "test/app")
+	c := newClient(t, r, "test/app", "multi")
+	c.Verify = true
+	if _, err := c.PushIndex([]scratchbuild.Descriptor{image.Descriptor()}); err != nil {
+		t.Fatal(err)
+	}
+	// The image in the index is read back and its blobs checked too
+	if n := countRequests(r, "GET /v2/test/app/manifests/"+image.ManifestDigest.String()); n != 1 {
+		t.Errorf("expected the image manifest to be read back, got %d reads", n)
+	}
+	if n := countRequests(r, "HEAD /v2/test/app/blobs/"+image.Layers[0].Digest.String()); n == 0 {
+		t.Error("expected the layer to be checked")
+	}
+
+	// A layer of the image goes missing
+	r.SetHook(func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method == http.MethodHead && strings.HasSuffix(req.URL.Path, "/blobs/"+image.Layers[0].Digest.String()) {
+			w.WriteHeader(http.StatusNotFound)
+			return true
+		}
+		return false
+	})
+	_, err := c.PushIndex([]scratchbuild.Descriptor{image.Descriptor()})
+	if !errors.Is(err, scratchbuild.ErrVerifyFailed) || !strings.Contains(err.Error(), "blob "+image.Layers[0].Digest.String()+" is missing") {
+		t.Errorf("expected the missing layer to be found, got %v", err)
+	}
+}